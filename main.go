@@ -17,6 +17,15 @@ func main() {
 
 	lib.Mode = lib.GetEnvVar("MODE", "production")
 
+	// print archived logs of releases instead of running jobs
+	if len(os.Args) > 1 && os.Args[1] == "logs" {
+		if err := lib.RunLogsCommand(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// run initialization, detect configs and input parameters
 	jobs, err := lib.Startup(startupLogger)
 	if err != nil {
@@ -38,10 +47,15 @@ func main() {
 	// }
 	lib.InlineTest(false, *jobs[0], logger, true)
 
+	if len(lib.HTTPAddr) > 0 {
+		lib.StartHTTPServer(lib.HTTPAddr, startupLogger)
+	}
+
 	for _, job := range jobs {
 		wg.Add(1)
 		go lib.RunOneJob(job, &wg)
 	}
+	lib.SetJobsScheduled(jobs)
 
 	sigCh := make(chan os.Signal, 1)
 	// Notify the sigCh channel when a SIGINT signal is received (Ctrl-C)
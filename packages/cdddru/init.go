@@ -39,6 +39,20 @@ func Startup(logger *Logger) ([]*Config, error) {
 
 	flag.BoolVar(&FbOnce, "oncerun", false, "once running and exit")
 
+	flag.StringVar(&LogFormat, "logformat", LogFormat, "log format: text or json (env CDDDRU_LOG_FORMAT)")
+
+	flag.StringVar(&TraceEndpoint, "trace-endpoint", TraceEndpoint, "OTLP/HTTP endpoint to export traces to, e.g. http://otel-collector:4318 (env OTEL_EXPORTER_OTLP_ENDPOINT)")
+	flag.StringVar(&TraceFile, "trace-file", TraceFile, "file to append traces to as OTLP json lines (env CDDDRU_TRACE_FILE)")
+
+	flag.IntVar(&CommandTimeout, "command-timeout", CommandTimeout, "seconds every external command may take if its step has no timeout (env CDDDRU_COMMAND_TIMEOUT)")
+
+	flag.StringVar(&CommandOutput, "command-output", CommandOutput, "level output of build and hook commands is logged with: info or debug (env CDDDRU_COMMAND_OUTPUT)")
+
+	flag.StringVar(&ReleaseLogsFolder, "release-logs", ReleaseLogsFolder, "folder of log archives of releases, empty - not archived (env CDDDRU_RELEASE_LOGS)")
+
+	flag.StringVar(&HTTPAddr, "http", HTTPAddr, "address of http server with probes, status api and metrics, e.g. :8080 (env CDDDRU_HTTP_ADDR)")
+	flag.StringVar(&MetricsAddr, "metrics", MetricsAddr, "deprecated, use -http (env CDDDRU_METRICS_ADDR)")
+
 	CurrentWD, err = os.Getwd()
 	if err != nil {
 		CurrentWD = os.Getenv("HOME")
@@ -49,6 +63,16 @@ func Startup(logger *Logger) ([]*Config, error) {
 	if err != nil {
 		return jobsConfigs, fmt.Errorf("failed to parse cmdline args and named parameters: %v", err)
 	}
+	LogFormat = strings.ToLower(LogFormat)
+	if LogFormat != LogFormatText && LogFormat != LogFormatJSON {
+		return jobsConfigs, fmt.Errorf("unknown log format %q", LogFormat)
+	}
+	logger.SetFormat(LogFormat)
+	resolveHTTPAddr(logger)
+	CommandOutput = strings.ToLower(CommandOutput)
+	if CommandOutput != CommandOutputInfo && CommandOutput != CommandOutputDebug {
+		return jobsConfigs, fmt.Errorf("unknown level of command output %q", CommandOutput)
+	}
 
 	// Parse positional arguments
 	args := flag.Args()
@@ -228,6 +252,10 @@ func getOneConfig(configPath string) (*Config, error) {
 
 	config.COMMON.JOB_PATH = configPath
 	config.SetParentLinks()
+	if err = config.GIT.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid git section of %s: %w", configPath, err)
+	}
+	config.RegisterSecrets()
 
 	return &config, nil
 }
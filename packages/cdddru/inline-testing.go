@@ -8,7 +8,7 @@ import (
 func InlineTest(isRun bool, config Config, logger *Logger, isExit bool) {
 	if isRun {
 
-		logger.Debug(fmt.Sprint(PrettyJsonEncodeToString(config)))
+		logger.Debug(fmt.Sprint(config.RedactedJson()))
 		// ready, err := getDeploymentReadinessStatus(config, "kuznetcovay/ddru:v1.0.11")
 		// if err != nil {
 		// 	PrintError(logger, "%v", err)
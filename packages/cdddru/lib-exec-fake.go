@@ -0,0 +1,83 @@
+package cdddru
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// CommandFunc answers command run by FakeExecutor
+type CommandFunc func(ctx context.Context, c Command) (string, error)
+
+// FakeExecutor is Executor for tests: it records commands instead of running them and answers them by scripts.
+// Script of the longest prefix of command line (see Command.String) answers, commands without script get empty output.
+type FakeExecutor struct {
+	mu      sync.Mutex
+	scripts map[string]CommandFunc
+	calls   []Command
+}
+
+// NewFakeExecutor makes executor without scripts
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{scripts: make(map[string]CommandFunc)}
+}
+
+// On scripts answer to commands which command line starts with prefix
+func (f *FakeExecutor) On(prefix string, answer CommandFunc) *FakeExecutor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scripts[prefix] = answer
+	return f
+}
+
+// OnOutput scripts canned output of commands which command line starts with prefix
+func (f *FakeExecutor) OnOutput(prefix, out string) *FakeExecutor {
+	return f.On(prefix, func(context.Context, Command) (string, error) { return out, nil })
+}
+
+// OnError scripts error of commands which command line starts with prefix
+func (f *FakeExecutor) OnError(prefix string, err error) *FakeExecutor {
+	return f.On(prefix, func(context.Context, Command) (string, error) { return "", err })
+}
+
+// Passthrough makes commands which command line starts with prefix really run (e.g. git with local repository)
+func (f *FakeExecutor) Passthrough(prefix string) *FakeExecutor {
+	return f.On(prefix, OSExecutor{}.Run)
+}
+
+// Run records command and answers it by its script
+func (f *FakeExecutor) Run(ctx context.Context, c Command) (string, error) {
+	line := c.String()
+	f.mu.Lock()
+	f.calls = append(f.calls, c)
+	var answer CommandFunc
+	matched := ""
+	for prefix, script := range f.scripts {
+		if strings.HasPrefix(line, prefix) && len(prefix) >= len(matched) {
+			answer, matched = script, prefix
+		}
+	}
+	f.mu.Unlock()
+	if answer == nil {
+		return "", nil
+	}
+	return answer(ctx, c)
+}
+
+// Calls returns commands run so far
+func (f *FakeExecutor) Calls() []Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Command{}, f.calls...)
+}
+
+// CommandLines returns command lines of commands run so far which start with prefix
+func (f *FakeExecutor) CommandLines(prefix string) []string {
+	lines := make([]string, 0)
+	for _, c := range f.Calls() {
+		if line := c.String(); strings.HasPrefix(line, prefix) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,286 @@
+package cdddru
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCommandTimeout = 1800
+	// how long output of killed command is waited for if its pipes are kept open by orphans
+	commandWaitDelay = 5 * time.Second
+)
+
+// CommandTimeout is seconds every external command may take if neither its step nor its caller bound it
+var CommandTimeout, _ = strconv.Atoi(GetEnvVar("CDDDRU_COMMAND_TIMEOUT", strconv.Itoa(defaultCommandTimeout)))
+
+const (
+	CommandOutputInfo  = "info"
+	CommandOutputDebug = "debug"
+)
+
+// CommandOutput is level stdout and stderr of streamed commands (build, hooks) are logged with: info (default) or debug
+var CommandOutput = strings.ToLower(GetEnvVar("CDDDRU_COMMAND_OUTPUT", CommandOutputInfo))
+
+var (
+	// ErrCommandTimeout is kind of error of command killed because its deadline passed
+	ErrCommandTimeout = errors.New("command timed out")
+	// ErrCommandCanceled is kind of error of command killed because its context was canceled
+	ErrCommandCanceled = errors.New("command is canceled")
+	// ErrCommandExit is kind of error of command exited with non-zero code
+	ErrCommandExit = errors.New("command exited with error")
+	// ErrCommandStart is kind of error of command which could not be started
+	ErrCommandStart = errors.New("command failed to start")
+)
+
+// Command is external command run by executor
+type Command struct {
+	Name  string
+	Args  []string
+	Stdin string
+	// variables added to environment of cdddru
+	Env []string
+	// commands stdout of the command is piped through, output of the last one is returned
+	Pipe []Command
+	// if set stdout is written to it as it comes instead of being returned
+	Stdout io.Writer
+	// log output line by line as it comes: commands of build and hooks, not queries whose output is parsed
+	Stream bool
+}
+
+// Executor runs external commands of a job: OSExecutor by default, tests inject FakeExecutor
+type Executor interface {
+	// Run runs command until it exits or ctx is done and returns its stdout, error is *CommandError if command ran
+	Run(ctx context.Context, c Command) (string, error)
+}
+
+// OSExecutor runs commands as processes of operating system, every command in its own process group
+type OSExecutor struct{}
+
+type executorContextKey struct{}
+
+// String is command line of command and of commands it is piped through
+func (c Command) String() string {
+	line := strings.Join(append([]string{c.Name}, c.Args...), " ")
+	for _, next := range c.Pipe {
+		line += " | " + next.String()
+	}
+	return line
+}
+
+// ContextWithExecutor returns context which commands started with are run by executor, nil executor is ignored
+func ContextWithExecutor(ctx context.Context, executor Executor) context.Context {
+	if executor == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, executorContextKey{}, executor)
+}
+
+// ExecutorFromContext returns executor of context, OSExecutor if it has none
+func ExecutorFromContext(ctx context.Context) Executor {
+	if executor, ok := ctx.Value(executorContextKey{}).(Executor); ok {
+		return executor
+	}
+	return OSExecutor{}
+}
+
+// CommandError is error of external command, errors.Is tells its kind:
+// ErrCommandTimeout, ErrCommandCanceled, ErrCommandExit or ErrCommandStart
+type CommandError struct {
+	Kind    error
+	Command string
+	// exit code, -1 if command has not exited by itself
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("%v: %v", e.Command, e.Err)
+	switch e.Kind {
+	case ErrCommandTimeout:
+		msg = fmt.Sprintf("%v timed out: %v", e.Command, e.Err)
+	case ErrCommandCanceled:
+		msg = fmt.Sprintf("%v is canceled: %v", e.Command, e.Err)
+	}
+	if e.Kind == ErrCommandExit || IsStringNotEmpty(strings.TrimSpace(e.Stderr)) {
+		msg += fmt.Sprintf(" < details: (%v) >", Redact(e.Stderr))
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// commandTimeout is default deadline of commands
+func commandTimeout() time.Duration {
+	if CommandTimeout <= 0 {
+		return defaultCommandTimeout * time.Second
+	}
+	return time.Duration(CommandTimeout) * time.Second
+}
+
+// runCommand runs command by executor of ctx and returns its stdout. Command is killed when ctx is done,
+// ctx without deadline gets default one. Command is traced as child of span of ctx.
+func runCommand(ctx context.Context, c Command) (string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, commandTimeout())
+		defer cancel()
+	}
+	finishTrace := traceCommand(ctx, c.Name, c.Args)
+	out, err := ExecutorFromContext(ctx).Run(ctx, c)
+	finishTrace(err)
+	return out, err
+}
+
+// Run runs command in its own process group, the whole group is killed when ctx is done.
+// Output of command is streamed to logger of ctx.
+func (OSExecutor) Run(ctx context.Context, c Command) (string, error) {
+	if len(c.Pipe) > 0 {
+		return runPipe(ctx, c)
+	}
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	flushOutput := func() {}
+	if c.Stream {
+		flushOutput = streamCommandOutput(ctx, cmd, c.Name)
+	}
+	if c.Stdout != nil {
+		cmd.Stdout = c.Stdout
+	}
+	if len(c.Stdin) > 0 {
+		cmd.Stdin = strings.NewReader(c.Stdin)
+	}
+	setProcessGroup(cmd)
+	cmd.WaitDelay = commandWaitDelay
+	err := cmd.Run()
+	flushOutput()
+	if err != nil {
+		return "", commandError(ctx, c.Name, err, errBuf.String())
+	}
+	return outBuf.String(), nil
+}
+
+// runPipe runs command with stdout connected to stdin of the next command of pipe, output of the last one is returned.
+// Commands of pipe get Env of the command in addition to their own. Pipe fails if any command fails
+// or the last one writes to stderr, then the rest of commands are killed and waited for.
+func runPipe(ctx context.Context, c Command) (string, error) {
+	commands := append([]Command{c}, c.Pipe...)
+	var outBuf, errBuf bytes.Buffer
+	var cmd []*exec.Cmd
+	// commands are killed by pipeCtx, errors are reported against ctx to tell a failure from a timeout
+	pipeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Create the command objects
+	for i, stage := range commands {
+		currCmd := exec.CommandContext(pipeCtx, stage.Name, stage.Args...)
+		env := c.Env
+		if i > 0 {
+			env = append(append([]string{}, c.Env...), stage.Env...)
+		}
+		if len(env) > 0 {
+			currCmd.Env = append(os.Environ(), env...)
+		}
+		setProcessGroup(currCmd)
+		currCmd.WaitDelay = commandWaitDelay
+		cmd = append(cmd, currCmd)
+	}
+
+	// Connect the commands in a pipeline
+	if len(c.Stdin) > 0 {
+		cmd[0].Stdin = strings.NewReader(c.Stdin)
+	}
+	for i := 0; i < len(cmd)-1; i++ {
+		pipe, err := cmd[i].StdoutPipe()
+		if err != nil {
+			return "", fmt.Errorf("error creating pipe: %w", err)
+		}
+		cmd[i+1].Stdin = pipe
+	}
+
+	lastCmd := cmd[len(cmd)-1]
+	lastCmd.Stdout = &outBuf
+	lastCmd.Stderr = &errBuf
+
+	// Start the commands in reverse order, already started ones are killed if one can not start
+	for i := len(cmd) - 1; i >= 0; i-- {
+		if err := cmd[i].Start(); err != nil {
+			cancel()
+			for _, started := range cmd[i+1:] {
+				started.Wait()
+			}
+			return "", commandError(ctx, commands[i].Name, err, "")
+		}
+	}
+
+	// Wait for all the commands to finish, the first failure kills the rest
+	var pipeErr error
+	for i, currCmd := range cmd {
+		if err := currCmd.Wait(); err != nil && pipeErr == nil {
+			cancel()
+			pipeErr = commandError(ctx, commands[i].Name, err, errBuf.String())
+		}
+	}
+	if pipeErr != nil {
+		return "", pipeErr
+	}
+	if errBuf.Len() > 0 {
+		return "", &CommandError{Kind: ErrCommandExit, Command: lastCmd.Args[0], ExitCode: 0, Stderr: errBuf.String(),
+			Err: errors.New("stderr is not empty")}
+	}
+	return outBuf.String(), nil
+}
+
+// commandError makes typed error of command from error of its run
+func commandError(ctx context.Context, commandName string, err error, stderr string) error {
+	cmdErr := &CommandError{Command: commandName, ExitCode: -1, Stderr: stderr, Err: err}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		cmdErr.Kind, cmdErr.Err = ErrCommandTimeout, ctx.Err()
+	case ctx.Err() != nil:
+		cmdErr.Kind, cmdErr.Err = ErrCommandCanceled, ctx.Err()
+	case errors.As(err, &exitErr):
+		cmdErr.Kind, cmdErr.ExitCode = ErrCommandExit, exitErr.ExitCode()
+	default:
+		cmdErr.Kind = ErrCommandStart
+	}
+	return cmdErr
+}
+
+// sleepContext waits for d or until ctx is done, error of ctx is returned if it is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// detachedContext keeps values of parent - span and logger - but not its deadline and cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package cdddru
+
+import "os/exec"
+
+// setProcessGroup does nothing where process groups are not supported - only command itself is killed
+func setProcessGroup(cmd *exec.Cmd) {}
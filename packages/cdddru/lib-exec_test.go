@@ -0,0 +1,166 @@
+package cdddru
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// kubectlCalls lists arguments of kubectl commands run by executor, stdin of command follows its arguments
+func kubectlCalls(executor *FakeExecutor) string {
+	var calls strings.Builder
+	for _, c := range executor.Calls() {
+		if c.Name == "kubectl" {
+			calls.WriteString(strings.Join(c.Args, " ") + "\n" + c.Stdin)
+		}
+	}
+	return calls.String()
+}
+
+func TestRunCommandErrors(t *testing.T) {
+	_, err := runCommand(context.Background(), Command{Name: "sh", Args: []string{"-c", "echo broken >&2; exit 3"}})
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || !errors.Is(err, ErrCommandExit) || cmdErr.ExitCode != 3 ||
+		err.Error() != "sh: exit status 3 < details: (broken\n) >" {
+		t.Errorf("expected exit error with code 3, got %#v", err)
+	}
+
+	_, err = RunExternalCmd("", "prefix", "cdddru-no-such-command")
+	if !errors.Is(err, ErrCommandStart) || errors.Is(err, ErrCommandExit) || !strings.HasPrefix(err.Error(), "prefix: cdddru-no-such-command:") {
+		t.Errorf("expected start error, got %v", err)
+	}
+
+	out, err := runCommand(context.Background(), Command{Name: "sh", Args: []string{"-c", "cat; echo $CDDDRU_RELEASE"},
+		Stdin: "input\n", Env: []string{"CDDDRU_RELEASE=v1.0.1"}})
+	if err != nil || out != "input\nv1.0.1\n" {
+		t.Errorf("unexpected output %q, error %v", out, err)
+	}
+}
+
+func TestRunCommandStream(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, &out, InfoLevel, "test")
+
+	// output of queries is only returned - it may be big or hold credentials
+	query, err := runCommand(logger.CommandContext(), Command{Name: "sh", Args: []string{"-c", "echo password=secret; echo warning >&2"}})
+	if err != nil || query != "password=secret\n" || out.Len() != 0 {
+		t.Errorf("expected output of query not to be logged, got %q (%v), log:\n%s", query, err, out.String())
+	}
+
+	_, err = runCommand(logger.CommandContext(), Command{Name: "sh", Args: []string{"-c", "echo step 1/2; echo step 2/2 >&2"}, Stream: true})
+	if err != nil || !strings.Contains(out.String(), "sh | step 1/2") || !strings.Contains(out.String(), "sh | step 2/2") {
+		t.Errorf("expected output of streamed command to be logged, got %v, log:\n%s", err, out.String())
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// child in background keeps stdout open - it is killed with the whole process group
+	_, err := runCommand(ctx, Command{Name: "sh", Args: []string{"-c", "sleep 30 & echo $! > " + pidFile + "; wait"}})
+	if !errors.Is(err, ErrCommandTimeout) || !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "sh timed out") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > commandWaitDelay {
+		t.Errorf("expected command to be killed on timeout, it took %v", elapsed)
+	}
+	pid, _ := os.ReadFile(pidFile)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := os.Stat("/proc/" + strings.TrimSpace(string(pid))); len(pid) > 0 && err == nil {
+		if status, _ := os.ReadFile("/proc/" + strings.TrimSpace(string(pid)) + "/stat"); !strings.Contains(string(status), ") Z ") {
+			t.Errorf("expected child %s to be killed with its group", pid)
+		}
+	}
+
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, err = runCommand(canceled, Command{Name: "sleep", Args: []string{"5"}}); !errors.Is(err, ErrCommandCanceled) {
+		t.Errorf("expected canceled error, got %v", err)
+	}
+}
+
+func TestRunPipe(t *testing.T) {
+	out, err := runCommand(context.Background(), Command{Name: "echo", Args: []string{"input"}, Env: []string{"CDDDRU_RELEASE=v1.0.1"},
+		Pipe: []Command{{Name: "sh", Args: []string{"-c", "cat; echo $CDDDRU_RELEASE $CDDDRU_STAGE"}, Env: []string{"CDDDRU_STAGE=tar"}}}})
+	if err != nil || out != "input\nv1.0.1 tar\n" {
+		t.Errorf("unexpected output %q, error %v", out, err)
+	}
+
+	// failed command kills the rest of pipe instead of leaving them running
+	pidFile := filepath.Join(t.TempDir(), "stage.pid")
+	_, err = runCommand(context.Background(), Command{Name: "sh", Args: []string{"-c", "sleep 0.2; exit 3"},
+		Pipe: []Command{{Name: "sh", Args: []string{"-c", "echo $$ > " + pidFile + "; exec sleep 30"}}}})
+	if !errors.Is(err, ErrCommandExit) {
+		t.Errorf("expected exit error, got %v", err)
+	}
+	if pid, _ := os.ReadFile(pidFile); len(pid) == 0 {
+		t.Error("expected pid of the last command of pipe")
+	} else if _, err = os.Stat("/proc/" + strings.TrimSpace(string(pid))); err == nil {
+		t.Errorf("expected the last command %s to be killed and waited for", pid)
+	}
+
+	// commands started before one which can not start are killed and waited for
+	pidFile = filepath.Join(t.TempDir(), "stage.pid")
+	_, err = runCommand(context.Background(), Command{Name: "cdddru-no-such-command",
+		Pipe: []Command{{Name: "sh", Args: []string{"-c", "echo $$ > " + pidFile + "; exec sleep 30"}}}})
+	if !errors.Is(err, ErrCommandStart) {
+		t.Errorf("expected start error, got %v", err)
+	}
+	if pid, _ := os.ReadFile(pidFile); len(pid) > 0 {
+		if _, err = os.Stat("/proc/" + strings.TrimSpace(string(pid))); err == nil {
+			t.Errorf("expected started command %s to be killed and waited for", pid)
+		}
+	}
+}
+
+func TestPipelineStepTimeout(t *testing.T) {
+	config := &Config{}
+	config.STEPS = []PipelineStep{
+		{NAME: "slow", TYPE: PipelineStepHook, TIMEOUT: 1, HOOKS: []Hook{{COMMAND: []string{"sleep", "30"}}}},
+		{NAME: "cleanup", TYPE: PipelineStepHook, WHEN: PipelineWhenAlways, HOOKS: []Hook{{COMMAND: []string{"true"}}}},
+	}
+	config.SetParentLinks()
+	var out bytes.Buffer
+	logger := NewLogger(&out, &out, InfoLevel, "test")
+
+	start := time.Now()
+	run := &PipelineRun{Data: ReleaseData{Release: "v1.0.1"}}
+	err := config.RunPipeline(run, logger)
+	if err == nil || !strings.Contains(err.Error(), "step timed out after 1s: hook failed: slow hook sleep 30 of v1.0.1: sleep timed out") ||
+		time.Since(start) > 10*time.Second {
+		t.Fatalf("expected step to time out, got %v after %v", err, time.Since(start))
+	}
+	if run.Steps[1].Status != StepSucceeded {
+		t.Errorf("expected commands of next step not to be bound to timed out one, got %+v", run.Steps)
+	}
+}
+
+func TestPipelineStepTimeoutStopsWaits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	config := &Config{}
+	config.VERIFY.RETRY_INTERVAL = 30
+	config.STEPS = []PipelineStep{
+		{NAME: "smoke", TYPE: PipelineStepVerify, TIMEOUT: 1, CHECKS: []VerifyCheck{{TYPE: VerifyCheckHTTP, URL: server.URL, RETRIES: 3}}},
+	}
+	config.SetParentLinks()
+	var out bytes.Buffer
+	logger := NewLogger(&out, &out, InfoLevel, "test")
+
+	start := time.Now()
+	err := config.RunPipeline(&PipelineRun{Data: ReleaseData{Release: "v1.0.1"}}, logger)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 10*time.Second {
+		t.Fatalf("expected wait between attempts of check to be stopped by step timeout, got %v after %v", err, time.Since(start))
+	}
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package cdddru
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes command leader of its own process group, the whole group is killed when context of command is done
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,77 @@
+package cdddru
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// HTTPAddr is address of embedded http server with probes, status api and metrics, empty - server is not started
+var HTTPAddr = GetEnvVar("CDDDRU_HTTP_ADDR", "")
+
+// MetricsAddr is deprecated alias of HTTPAddr (-metrics flag and CDDDRU_METRICS_ADDR) kept for existing deployments
+var MetricsAddr = GetEnvVar("CDDDRU_METRICS_ADDR", "")
+
+// resolveHTTPAddr uses deprecated MetricsAddr as address of http server if HTTPAddr is not set
+func resolveHTTPAddr(logger *Logger) {
+	if len(MetricsAddr) == 0 {
+		return
+	}
+	if len(HTTPAddr) == 0 {
+		PrintWarning(logger, "-metrics and CDDDRU_METRICS_ADDR are deprecated, use -http or CDDDRU_HTTP_ADDR: serving on %s", MetricsAddr)
+		HTTPAddr = MetricsAddr
+		return
+	}
+	if HTTPAddr != MetricsAddr {
+		PrintWarning(logger, "-metrics and CDDDRU_METRICS_ADDR are deprecated, metrics are served with other endpoints on %s instead of %s",
+			HTTPAddr, MetricsAddr)
+	}
+}
+
+// NewHTTPHandler returns handler of embedded http server:
+// /healthz - process is alive, /readyz - all jobs are loaded and scheduled,
+// /api/jobs - status of jobs, /api/webhook - push webhooks of git hostings, /metrics - prometheus metrics
+func NewHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !IsReady() {
+			http.Error(w, "jobs are not scheduled yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/api/jobs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		PrettyJsonEncode(JobStatuses(), w)
+	})
+	mux.HandleFunc("/api/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[len("/api/jobs/"):]
+		for _, status := range JobStatuses() {
+			if status.Name == name {
+				w.Header().Set("Content-Type", "application/json")
+				PrettyJsonEncode(status, w)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "job " + name + " is not found"})
+	})
+	mux.Handle("/api/webhook", WebhookHandler())
+	mux.Handle("/metrics", MetricsHandler())
+	return mux
+}
+
+// StartHTTPServer serves NewHTTPHandler on addr in background
+func StartHTTPServer(addr string, logger *Logger) {
+	server := &http.Server{Addr: addr, Handler: NewHTTPHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		PrintInfo(logger, "serving probes, status api, webhooks and metrics on %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			PrintError(logger, "http server on %s failed: %v", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,177 @@
+package cdddru
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	K8sJobCleanupDelete          = "delete"
+	K8sJobCleanupDeleteOnSuccess = "delete-on-success"
+	K8sJobCleanupKeep            = "keep"
+
+	defaultK8sJobTimeout = 600
+)
+
+// ErrK8sJobFailed is returned when k8s job of a release step or hook has failed or has not completed in time
+var ErrK8sJobFailed = errors.New("k8s job failed")
+
+// k8sJobPollInterval is how often status of k8s job is checked, replaced in tests
+var k8sJobPollInterval = 5 * time.Second
+
+// kubectlArgs returns kubectl arguments for namespace (namespace_k8s of deploy section if empty) and context of the job
+func (cfg *Config) kubectlArgs(namespace string, args ...string) []string {
+	if IsStringEmpty(namespace) {
+		namespace = cfg.DEPLOY.NAMESPACE_K8s
+	}
+	kubectlArgs := []string{"-n", namespace}
+	if IsStringNotEmpty(cfg.DEPLOY.CONTEXT_K8s) {
+		kubectlArgs = append(kubectlArgs, "--context", cfg.DEPLOY.CONTEXT_K8s)
+	}
+	return append(kubectlArgs, args...)
+}
+
+// runK8sJobStep applies k8s Job manifest made from template of the step, streams logs of its pods
+// and waits for the job to complete or fail. Job is deleted or kept according to cleanup policy.
+func (cfg *Config) runK8sJobStep(step PipelineStep, run *PipelineRun, logger *Logger) error {
+	if IsStringEmpty(step.MANIFESTS_K8S) {
+		return errors.New("manifests_k8s with k8s Job is not set")
+	}
+	if err := checkK8sJobCleanup(step.JOB_CLEANUP); err != nil {
+		return err
+	}
+	timeout := time.Duration(step.TIMEOUT) * time.Second
+	if step.TIMEOUT <= 0 {
+		timeout = defaultK8sJobTimeout * time.Second
+	}
+	os.Chdir(CurrentWD)
+	manifestToApply, err := GenerateManifest(step.MANIFESTS_K8S, run.Data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(logger.CommandContext(), timeout)
+	defer cancel()
+	return cfg.runK8sJobs(ctx, manifestToApply, step.NAMESPACE, step.JOB_CLEANUP, timeout, run.Data.Release, logger)
+}
+
+func checkK8sJobCleanup(cleanup string) error {
+	switch cleanup {
+	case "", K8sJobCleanupDelete, K8sJobCleanupDeleteOnSuccess, K8sJobCleanupKeep:
+		return nil
+	}
+	return fmt.Errorf("unknown job_cleanup policy %q", cleanup)
+}
+
+// runK8sJobs applies manifest with k8s jobs (of job steps and hooks), streams logs of their pods and waits
+// until all of them complete, some of them fail or ctx is done. Jobs are deleted or kept according to cleanup policy.
+func (cfg *Config) runK8sJobs(ctx context.Context, manifest, namespace, cleanup string, timeout time.Duration,
+	release string, logger *Logger) error {
+
+	out, err := runCommand(ctx, Command{Name: "kubectl", Args: cfg.kubectlArgs(namespace, "apply", "-f", "-", "-o", "name"),
+		Stdin: manifest})
+	if err != nil {
+		return err
+	}
+	jobs := make([]string, 0)
+	for _, name := range strings.Fields(out) {
+		if strings.HasPrefix(name, "job.batch/") {
+			jobs = append(jobs, name)
+		}
+	}
+	if len(jobs) == 0 {
+		return errors.New("manifest has no k8s Job")
+	}
+	PrintInfo(logger, "k8s jobs %v of release %s are started", jobs, release)
+
+	// logs are streamed until pods complete or the job is waited for
+	var wg sync.WaitGroup
+	logCtx, stopLogs := context.WithCancel(ctx)
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job string) {
+			defer wg.Done()
+			cfg.streamK8sJobLogs(logCtx, namespace, job, timeout, logger)
+		}(job)
+	}
+
+	err = cfg.waitK8sJobs(ctx, namespace, jobs)
+	if err != nil {
+		stopLogs()
+	}
+	// streams end by themselves when pods complete - give them a moment to catch up with the last lines
+	streamsDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(streamsDone)
+	}()
+	select {
+	case <-streamsDone:
+	case <-time.After(k8sJobPollInterval):
+	}
+	stopLogs()
+	<-streamsDone
+
+	if cleanup == K8sJobCleanupKeep || (cleanup == K8sJobCleanupDeleteOnSuccess && err != nil) {
+		PrintInfo(logger, "k8s jobs %v are kept", jobs)
+		return err
+	}
+	deleteCtx, cancelDelete := context.WithTimeout(logger.CleanupContext(), defaultHookTimeout*time.Second)
+	defer cancelDelete()
+	_, errDelete := runCommand(deleteCtx, Command{Name: "kubectl",
+		Args: cfg.kubectlArgs(namespace, append([]string{"delete", "--ignore-not-found"}, jobs...)...)})
+	if errDelete != nil {
+		PrintWarning(logger, "deleting k8s jobs %v failed: %v", jobs, errDelete)
+	}
+	return err
+}
+
+// waitK8sJobs polls conditions of jobs until all of them are complete, some of them failed or context is done
+func (cfg *Config) waitK8sJobs(ctx context.Context, namespace string, jobs []string) error {
+	pending := append([]string{}, jobs...)
+	for {
+		left := pending[:0]
+		for _, job := range pending {
+			out, err := runCommand(ctx, Command{Name: "kubectl", Args: cfg.kubectlArgs(namespace, "get", job, "-o",
+				`jsonpath={range .status.conditions[*]}{.type}={.status}{"\n"}{end}`)})
+			if err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrK8sJobFailed, job, err)
+			}
+			conditions := strings.Fields(out)
+			switch {
+			case slices.Contains(conditions, "Failed=True"):
+				return fmt.Errorf("%w: %s has failed", ErrK8sJobFailed, job)
+			case !slices.Contains(conditions, "Complete=True"):
+				left = append(left, job)
+			}
+		}
+		pending = left
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v are not completed: %v", ErrK8sJobFailed, pending, ctx.Err())
+		case <-time.After(k8sJobPollInterval):
+		}
+	}
+}
+
+// streamK8sJobLogs writes logs of all containers of job pods into logger line by line
+func (cfg *Config) streamK8sJobLogs(ctx context.Context, namespace, job string, timeout time.Duration, logger *Logger) {
+	logs := &lineWriter{logger: logger, level: InfoLevel, prefix: strings.TrimPrefix(job, "job.batch/")}
+	_, err := runCommand(ctx, Command{Name: "kubectl", Args: cfg.kubectlArgs(namespace, "logs", "-f", job, "--all-containers=true",
+		"--pod-running-timeout="+strconv.Itoa(int(timeout.Seconds()))+"s"), Stdout: logs})
+	logs.Flush()
+	if err != nil && ctx.Err() == nil {
+		PrintWarning(logger, "streaming logs of %s failed: %v", job, err)
+	}
+}
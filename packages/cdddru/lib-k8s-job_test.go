@@ -0,0 +1,80 @@
+package cdddru
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeK8sJobExecutor answers kubectl of k8s job step: the job reports condition on the second status request
+// and its pods print logs
+func fakeK8sJobExecutor(condition string) *FakeExecutor {
+	var polls int32
+	return NewFakeExecutor().
+		OnOutput("kubectl -n test-app apply", "job.batch/migrate-v1.0.1\n").
+		On("kubectl -n test-app get", func(context.Context, Command) (string, error) {
+			if atomic.AddInt32(&polls, 1) == 1 {
+				return "", nil
+			}
+			return condition + "\n", nil
+		}).
+		On("kubectl -n test-app logs", func(ctx context.Context, c Command) (string, error) {
+			_, err := io.WriteString(c.Stdout, "applying migration 0042\ndone\n")
+			return "", err
+		})
+}
+
+func TestRunK8sJobStep(t *testing.T) {
+	k8sJobPollInterval = 10 * time.Millisecond
+	defer func() { k8sJobPollInterval = 5 * time.Second }()
+
+	manifest := filepath.Join(t.TempDir(), "migrate-job.yaml")
+	if err := os.WriteFile(manifest, []byte("kind: Job\nname: migrate-{{.Release}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{}
+	config.DEPLOY.NAMESPACE_K8s = "test-app"
+	config.SetParentLinks()
+	var out bytes.Buffer
+	logger := NewLogger(&out, &out, InfoLevel, "test")
+	run := &PipelineRun{Data: ReleaseData{Release: "v1.0.1"}}
+
+	executor := fakeK8sJobExecutor("Complete=True")
+	logger.SetExecutor(executor)
+	step := PipelineStep{TYPE: PipelineStepJob, MANIFESTS_K8S: manifest, TIMEOUT: 10}
+	if err := config.runStep(step, run, logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	calls := kubectlCalls(executor)
+	if !strings.Contains(calls, "-n test-app delete --ignore-not-found job.batch/migrate-v1.0.1") {
+		t.Errorf("expected completed job to be deleted, got calls:\n%s", calls)
+	}
+	if !strings.Contains(out.String(), "migrate-v1.0.1 | applying migration 0042") {
+		t.Errorf("expected logs of job pods in job logger, got:\n%s", out.String())
+	}
+
+	// failed job is kept with delete-on-success policy
+	executor = fakeK8sJobExecutor("Failed=True")
+	logger.SetExecutor(executor)
+	step.JOB_CLEANUP = K8sJobCleanupDeleteOnSuccess
+	if err := config.runStep(step, run, logger); !errors.Is(err, ErrK8sJobFailed) {
+		t.Errorf("expected job failure, got %v", err)
+	}
+	if calls = kubectlCalls(executor); strings.Contains(calls, "delete") {
+		t.Errorf("expected failed job to be kept, got calls:\n%s", calls)
+	}
+
+	// job which does not complete in time fails the step
+	logger.SetExecutor(fakeK8sJobExecutor(""))
+	step.TIMEOUT = 1
+	if err := config.runStep(step, run, logger); !errors.Is(err, ErrK8sJobFailed) {
+		t.Errorf("expected timeout of job, got %v", err)
+	}
+}
@@ -0,0 +1,386 @@
+package cdddru
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+
+// pointer files are small text files - anything bigger is real content
+const lfsPointerMaxSize = 1024
+
+type LfsPointer struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers"`
+	Objects   []LfsPointer `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Objects []struct {
+		Oid     string `json:"oid"`
+		Size    int64  `json:"size"`
+		Actions struct {
+			Download *struct {
+				Href   string            `json:"href"`
+				Header map[string]string `json:"header"`
+			} `json:"download"`
+		} `json:"actions"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"objects"`
+}
+
+// ParseLfsPointer checks if content is git lfs pointer file and returns pointer if so.
+func ParseLfsPointer(content []byte) (*LfsPointer, bool) {
+	if len(content) > lfsPointerMaxSize || !bytes.HasPrefix(content, []byte(lfsPointerVersion)) {
+		return nil, false
+	}
+	pointer := &LfsPointer{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			continue
+		}
+		switch key {
+		case "oid":
+			pointer.Oid = strings.TrimPrefix(value, "sha256:")
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			pointer.Size = size
+		}
+	}
+	if len(pointer.Oid) != 64 {
+		return nil, false
+	}
+	return pointer, true
+}
+
+// lfsObjectPath returns path of the object in lfs storage of the repo with given .git folder
+func lfsObjectPath(gitDir, oid string) string {
+	return filepath.Join(gitDir, "lfs", "objects", oid[0:2], oid[2:4], oid)
+}
+
+// lfsAttributeRule is line of .gitattributes setting (lfs is true) or unsetting filter=lfs for paths matching pattern
+type lfsAttributeRule struct {
+	pattern string
+	lfs     bool
+}
+
+// readLfsAttributes returns rules of .gitattributes of folder which mention filter attribute
+func readLfsAttributes(dir string) ([]lfsAttributeRule, error) {
+	content, err := os.ReadFile(filepath.Join(dir, ".gitattributes"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]lfsAttributeRule, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		for _, attr := range fields[1:] {
+			if attr == "filter" || attr == "-filter" || attr == "!filter" || strings.HasPrefix(attr, "filter=") {
+				rules = append(rules, lfsAttributeRule{pattern: fields[0], lfs: attr == "filter=lfs"})
+			}
+		}
+	}
+	return rules, nil
+}
+
+// FindLfsPointers walks through the worktree and returns pointers found in files with filter=lfs attribute,
+// keyed by path relative to root. Submodules (folders with own .git) are skipped - they are handled by their
+// own repositories.
+func FindLfsPointers(root string) (map[string]*LfsPointer, error) {
+	pointers := make(map[string]*LfsPointer)
+	// rules of .gitattributes by folder relative to root, deeper ones and later lines win
+	attributes := make(map[string][]lfsAttributeRule)
+	isLfsPath := func(relPath string) bool {
+		lfs := false
+		dirs := make([]string, 0)
+		for dir := filepath.Dir(relPath); ; dir = filepath.Dir(dir) {
+			dirs = append([]string{dir}, dirs...)
+			if dir == "." {
+				break
+			}
+		}
+		for _, dir := range dirs {
+			attrPath, _ := filepath.Rel(dir, relPath)
+			for _, rule := range attributes[dir] {
+				if matchSyncPattern(rule.pattern, filepath.ToSlash(attrPath)) {
+					lfs = rule.lfs
+				}
+			}
+		}
+		return lfs
+	}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(root, path)
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if path != root {
+				if isExist, _, _ := IsPathExists(filepath.Join(path, ".git")); isExist {
+					return filepath.SkipDir
+				}
+			}
+			attributes[relPath], err = readLfsAttributes(path)
+			return err
+		}
+		if !d.Type().IsRegular() || !isLfsPath(relPath) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() > lfsPointerMaxSize {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if pointer, ok := ParseLfsPointer(content); ok {
+			pointers[relPath] = pointer
+		}
+		return nil
+	})
+	return pointers, err
+}
+
+// SmudgeLfsObjects replaces lfs pointer files in given folder (worktree or release export) with real content.
+// Objects are taken from local lfs storage, from remote lfs storage for file:// remotes,
+// from lfs batch api for http(s) remotes (with credentials of git) or, for other remotes, fetched by external git-lfs if it is installed.
+func (gitcfg *GitConfig) SmudgeLfsObjects(root string, logger *Logger) (int, error) {
+	pointers, err := FindLfsPointers(root)
+	if err != nil {
+		return 0, fmt.Errorf("searching lfs pointers failed: %w", err)
+	}
+	if len(pointers) == 0 {
+		return 0, nil
+	}
+	PrintDebug(logger, "found %d lfs pointers in %s", len(pointers), root)
+
+	gitDir := filepath.Join(gitcfg.GIT_LOCAL_FOLDER, ".git")
+	missing := make([]LfsPointer, 0)
+	for _, pointer := range pointers {
+		if isExist, _, _ := IsPathExists(lfsObjectPath(gitDir, pointer.Oid)); !isExist {
+			missing = append(missing, *pointer)
+		}
+	}
+
+	if len(missing) > 0 {
+		remoteURL := gitcfg.GIT_REPO_URL
+		switch {
+		case strings.HasPrefix(remoteURL, "file://") || strings.HasPrefix(remoteURL, "/"):
+			remoteDir := strings.TrimPrefix(remoteURL, "file://")
+			if isExist, isDir, _ := IsPathExists(filepath.Join(remoteDir, ".git")); isExist && isDir {
+				remoteDir = filepath.Join(remoteDir, ".git")
+			}
+			for _, pointer := range missing {
+				err = storeLfsObjectFromFile(gitDir, lfsObjectPath(remoteDir, pointer.Oid), pointer)
+				if err != nil {
+					return 0, err
+				}
+			}
+		case strings.HasPrefix(remoteURL, "http://") || strings.HasPrefix(remoteURL, "https://"):
+			err = downloadLfsObjects(logger.CommandContext(), gitcfg.GIT_LOCAL_FOLDER, remoteURL, missing)
+			if err != nil {
+				return 0, err
+			}
+		default:
+			// ssh remotes need git-lfs-authenticate on server side, we leave it to git-lfs itself
+			if _, err := exec.LookPath("git-lfs"); err != nil {
+				return 0, fmt.Errorf("%d lfs objects are missing and git-lfs is not installed for remote %s", len(missing), remoteURL)
+			}
+			stdout, err := RunExternalCmdContext(logger.CommandContext(), "", "git lfs fetch error:", "git", "-C", gitcfg.GIT_LOCAL_FOLDER, "lfs", "fetch")
+			PrintDebug(logger, "%s", stdout)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for relPath, pointer := range pointers {
+		err = CopyFile(lfsObjectPath(gitDir, pointer.Oid), filepath.Join(root, relPath))
+		if err != nil {
+			return 0, fmt.Errorf("smudging lfs object %s to %s failed: %w", pointer.Oid, relPath, err)
+		}
+	}
+	return len(pointers), nil
+}
+
+// storeLfsObject copies content from reader into local lfs storage checking its size and hash
+func storeLfsObject(gitDir string, rd io.Reader, pointer LfsPointer) error {
+	target := lfsObjectPath(gitDir, pointer.Oid)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(target), pointer.Oid+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmpFile, hash), rd)
+	tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("storing lfs object %s failed: %w", pointer.Oid, err)
+	}
+	if size != pointer.Size || hex.EncodeToString(hash.Sum(nil)) != pointer.Oid {
+		return fmt.Errorf("lfs object %s is corrupted: size %d, expected %d", pointer.Oid, size, pointer.Size)
+	}
+	return os.Rename(tmpFile.Name(), target)
+}
+
+func storeLfsObjectFromFile(gitDir, source string, pointer LfsPointer) error {
+	file, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("lfs object %s not found on remote: %w", pointer.Oid, err)
+	}
+	defer file.Close()
+	return storeLfsObject(gitDir, file, pointer)
+}
+
+// lfsCredentials returns credentials of http(s) remote: user info of its url or, if there is none,
+// credentials git of the local clone gives for it (credential helpers, never prompting)
+func lfsCredentials(ctx context.Context, repoFolder string, remote *url.URL) (string, string, bool) {
+	if password, ok := remote.User.Password(); ok {
+		return remote.User.Username(), password, true
+	}
+	query := fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\n", remote.Scheme, remote.Host, strings.TrimPrefix(remote.Path, "/"))
+	if remote.User != nil {
+		query += "username=" + remote.User.Username() + "\n"
+	}
+	out, err := runCommand(ctx, Command{Name: "git", Args: []string{"-C", repoFolder, "credential", "fill"},
+		Stdin: query + "\n", Env: []string{"GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=", "SSH_ASKPASS="}})
+	if err != nil {
+		PrintDebug(LoggerFromContext(ctx), "no git credentials for lfs of %s: %v", remote.Redacted(), err)
+		return "", "", false
+	}
+	var username, password string
+	for _, line := range strings.Split(out, "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "username":
+			username = value
+		case "password":
+			password = value
+		}
+	}
+	if password == "" {
+		return "", "", false
+	}
+	AddSecrets(password)
+	return username, password, true
+}
+
+func downloadLfsObjects(ctx context.Context, repoFolder, remoteURL string, pointers []LfsPointer) error {
+	remote, err := url.Parse(strings.TrimSuffix(remoteURL, "/"))
+	if err != nil {
+		return fmt.Errorf("parsing remote url for lfs failed: %w", err)
+	}
+	username, password, withAuth := lfsCredentials(ctx, repoFolder, remote)
+	remote.User = nil
+	if !strings.HasSuffix(remote.Path, ".git") {
+		remote.Path += ".git"
+	}
+	remote.Path += "/info/lfs/objects/batch"
+	endpoint := remote.String()
+	gitDir := filepath.Join(repoFolder, ".git")
+
+	body, err := json.Marshal(lfsBatchRequest{Operation: "download", Transfers: []string{"basic"}, Objects: pointers})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.git-lfs+json")
+	req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+	if withAuth {
+		req.SetBasicAuth(username, password)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("lfs batch request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("lfs batch request failed with status %s", resp.Status)
+	}
+	var batch lfsBatchResponse
+	if err = json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return fmt.Errorf("decoding lfs batch response failed: %w", err)
+	}
+
+	for _, obj := range batch.Objects {
+		if obj.Error != nil {
+			return fmt.Errorf("lfs object %s: %s (%d)", obj.Oid, obj.Error.Message, obj.Error.Code)
+		}
+		if obj.Actions.Download == nil {
+			return fmt.Errorf("lfs object %s has no download action", obj.Oid)
+		}
+		objReq, err := http.NewRequest(http.MethodGet, obj.Actions.Download.Href, nil)
+		if err != nil {
+			return err
+		}
+		for key, value := range obj.Actions.Download.Header {
+			objReq.Header.Set(key, value)
+		}
+		// storage of other host gets only authorization given by batch api
+		if withAuth && objReq.URL.Host == remote.Host && objReq.Header.Get("Authorization") == "" {
+			objReq.SetBasicAuth(username, password)
+		}
+		objResp, err := client.Do(objReq)
+		if err != nil {
+			return fmt.Errorf("downloading lfs object %s failed: %w", obj.Oid, err)
+		}
+		if objResp.StatusCode != http.StatusOK {
+			objResp.Body.Close()
+			return fmt.Errorf("downloading lfs object %s failed with status %s", obj.Oid, objResp.Status)
+		}
+		err = storeLfsObject(gitDir, objResp.Body, LfsPointer{Oid: obj.Oid, Size: obj.Size})
+		objResp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package cdddru
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+)
+
+func runTestGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	args = append([]string{"-C", dir, "-c", "protocol.file.allow=always",
+		"-c", "user.name=tester", "-c", "user.email=tester@example.com"}, args...)
+	if _, err := RunExternalCmd("", "", "git", args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrepareCheckedOutRelease(t *testing.T) {
+	content := []byte("big binary content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	// submodule repository
+	subPath := t.TempDir()
+	runTestGit(t, subPath, "init", "-q")
+	if err := os.WriteFile(filepath.Join(subPath, "sub.txt"), []byte("sub"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, subPath, "add", ".")
+	runTestGit(t, subPath, "commit", "-q", "-m", "sub")
+
+	// main repository with submodule and lfs pointer, lfs object is stored in remote lfs storage
+	remotePath := t.TempDir()
+	runTestGit(t, remotePath, "init", "-q")
+	pointer := fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsPointerVersion, oid, len(content))
+	if err := os.WriteFile(filepath.Join(remotePath, "asset.bin"), []byte(pointer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// pointer-like file without filter=lfs attribute is kept as it is
+	for name, fileContent := range map[string]string{".gitattributes": "*.bin filter=lfs diff=lfs merge=lfs -text\n",
+		"docs/pointer.txt": pointer} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(remotePath, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(remotePath, name), []byte(fileContent), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objectPath := lfsObjectPath(filepath.Join(remotePath, ".git"), oid)
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(objectPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestGit(t, remotePath, "submodule", "add", "-q", "file://"+subPath, "vendor/sub")
+	runTestGit(t, remotePath, "add", ".")
+	runTestGit(t, remotePath, "commit", "-q", "-m", "main")
+
+	config := Config{}
+	config.GIT.GIT_REPO_URL = "file://" + remotePath
+	config.GIT.GIT_LOCAL_FOLDER = filepath.Join(t.TempDir(), "repo")
+	config.GIT.GIT_SUBMODULES = true
+	config.GIT.GIT_LFS = true
+	config.SetParentLinks()
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+
+	repo, err := git.PlainClone(config.GIT.GIT_LOCAL_FOLDER, false, &git.CloneOptions{URL: config.GIT.GIT_REPO_URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = config.GIT.PrepareCheckedOutRelease(wt, logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	subContent, err := os.ReadFile(filepath.Join(config.GIT.GIT_LOCAL_FOLDER, "vendor", "sub", "sub.txt"))
+	if err != nil || string(subContent) != "sub" {
+		t.Errorf("expected submodule to be checked out, got %q (%v)", subContent, err)
+	}
+	assetContent, err := os.ReadFile(filepath.Join(config.GIT.GIT_LOCAL_FOLDER, "asset.bin"))
+	if err != nil || string(assetContent) != string(content) {
+		t.Errorf("expected lfs pointer to be smudged, got %q (%v)", assetContent, err)
+	}
+	docContent, err := os.ReadFile(filepath.Join(config.GIT.GIT_LOCAL_FOLDER, "docs", "pointer.txt"))
+	if err != nil || string(docContent) != pointer {
+		t.Errorf("expected file without lfs attribute to be kept, got %q (%v)", docContent, err)
+	}
+}
+
+func TestFindLfsPointersAttributes(t *testing.T) {
+	root := t.TempDir()
+	pointer := fmt.Sprintf("%s\noid sha256:%s\nsize 5\n", lfsPointerVersion, strings.Repeat("a", 64))
+	for name, content := range map[string]string{
+		".gitattributes":             "*.bin filter=lfs\nmedia/** filter=lfs\n# comment filter=lfs\n",
+		"media/.gitattributes":       "raw/*.txt -filter\n",
+		"asset.bin":                  pointer,
+		"readme.md":                  pointer,
+		"media/video/intro.txt":      pointer,
+		"media/raw/notes.txt":        pointer,
+		"media/raw/clip.bin":         pointer,
+		"vendor/sub/.git/HEAD":       "ref: refs/heads/main\n",
+		"vendor/sub/module.bin":      pointer,
+		"media/video/not-pointer.md": "text",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pointers, err := FindLfsPointers(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make([]string, 0)
+	for relPath := range pointers {
+		found = append(found, filepath.ToSlash(relPath))
+	}
+	sort.Strings(found)
+	expected := []string{"asset.bin", "media/raw/clip.bin", "media/video/intro.txt"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected pointers %v, got %v", expected, found)
+	}
+}
+
+func TestDownloadLfsObjectsWithGitCredentials(t *testing.T) {
+	content := []byte("big binary content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "ci" || password != "lfs-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/site.git/info/lfs/objects/batch":
+			fmt.Fprintf(w, `{"objects": [{"oid": %q, "size": %d, "actions": {"download": {"href": %q}}}]}`,
+				oid, len(content), server.URL+"/objects/"+oid)
+		case "/objects/" + oid:
+			w.Write(content)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	// credentials come from credential helper of the local clone
+	repoFolder := t.TempDir()
+	runTestGit(t, repoFolder, "init", "-q")
+	runTestGit(t, repoFolder, "config", "credential.helper", "!f() { echo username=ci; echo password=lfs-secret; }; f")
+	pointers := []LfsPointer{{Oid: oid, Size: int64(len(content))}}
+	if err := downloadLfsObjects(context.Background(), repoFolder, server.URL+"/site", pointers); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	stored, err := os.ReadFile(lfsObjectPath(filepath.Join(repoFolder, ".git"), oid))
+	if err != nil || string(stored) != string(content) {
+		t.Errorf("expected lfs object to be downloaded, got %q (%v)", stored, err)
+	}
+
+	// user info of remote url wins over credential helper
+	runTestGit(t, repoFolder, "config", "credential.helper", "!f() { echo username=ci; echo password=wrong; }; f")
+	os.RemoveAll(filepath.Join(repoFolder, ".git", "lfs"))
+	remoteURL := strings.Replace(server.URL, "http://", "http://ci:lfs-secret@", 1) + "/site.git"
+	if err := downloadLfsObjects(context.Background(), repoFolder, remoteURL, pointers); err != nil {
+		t.Fatalf("expected no error with credentials of url, got %v", err)
+	}
+	if err := downloadLfsObjects(context.Background(), repoFolder, server.URL+"/site", pointers); err == nil ||
+		!strings.Contains(err.Error(), "401") {
+		t.Errorf("expected unauthorized error with wrong credentials, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package cdddru
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MetricsStepPull          = "pull"
+	MetricsStepApply         = "apply"
+	MetricsStepReadinessWait = "readiness_wait"
+)
+
+// metricsBuckets are upper bounds (seconds) of step duration histogram buckets
+var metricsBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800}
+
+// histogram is prometheus histogram with metricsBuckets
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// JobMetrics are metrics of one job, they are kept while process lives even if job is restarted
+type JobMetrics struct {
+	mu                sync.Mutex
+	active            bool
+	lastCheck         time.Time
+	deployedTag       string
+	releasesAttempted uint64
+	releasesSucceeded uint64
+	releasesFailed    uint64
+	gitFetchErrors    uint64
+	stepDurations     map[string]*histogram
+}
+
+var metricsRegistry = struct {
+	sync.Mutex
+	jobs map[string]*JobMetrics
+}{jobs: make(map[string]*JobMetrics)}
+
+// GetJobMetrics returns metrics of job by its name, metrics are created on first call
+func GetJobMetrics(jobName string) *JobMetrics {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+	m, ok := metricsRegistry.jobs[jobName]
+	if !ok {
+		m = &JobMetrics{stepDurations: make(map[string]*histogram)}
+		metricsRegistry.jobs[jobName] = m
+	}
+	return m
+}
+
+// SetActive marks job as active or suspended (is_active is false in job config)
+func (m *JobMetrics) SetActive(active bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active = active
+}
+
+// Checked records time of check for new release
+func (m *JobMetrics) Checked() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastCheck = time.Now()
+}
+
+// SetDeployedTag records tag job has deployed or started from
+func (m *JobMetrics) SetDeployedTag(tag string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deployedTag = tag
+}
+
+// ReleaseAttempted counts attempt to upgrade to new release, every attempt ends succeeded or failed
+func (m *JobMetrics) ReleaseAttempted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.releasesAttempted++
+}
+
+// ReleaseSucceeded counts release which pipeline succeeded
+func (m *JobMetrics) ReleaseSucceeded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.releasesSucceeded++
+}
+
+// ReleaseFailed counts release which failed after it was started
+func (m *JobMetrics) ReleaseFailed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.releasesFailed++
+}
+
+// GitFetchError counts failed pull, fetch or listing of remote tags
+func (m *JobMetrics) GitFetchError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gitFetchErrors++
+}
+
+// ObserveStep adds duration of step (pull, build, sync, apply, readiness_wait, ...) to its histogram
+func (m *JobMetrics) ObserveStep(step string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.stepDurations[step]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(metricsBuckets))}
+		m.stepDurations[step] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range metricsBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// metricLabels formats labels of metric in prometheus text format, pairs are name and value
+func metricLabels(pairs ...string) string {
+	labels := make([]string, 0, len(pairs)/2)
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], escaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// WriteMetrics writes metrics of all jobs in prometheus text exposition format
+func WriteMetrics(w io.Writer) {
+	metricsRegistry.Lock()
+	names := make([]string, 0, len(metricsRegistry.jobs))
+	jobs := make(map[string]*JobMetrics, len(metricsRegistry.jobs))
+	for name, m := range metricsRegistry.jobs {
+		names = append(names, name)
+		jobs[name] = m
+	}
+	metricsRegistry.Unlock()
+	sort.Strings(names)
+
+	families := []struct {
+		name, kind, help string
+		write            func(job string, m *JobMetrics)
+	}{
+		{"cdddru_job_active", "gauge", "Whether the job is active (1) or suspended (0).", func(job string, m *JobMetrics) {
+			fmt.Fprintf(w, "cdddru_job_active%s %d\n", metricLabels("job", job), Tiif(m.active, 1, 0))
+		}},
+		{"cdddru_job_last_check_timestamp_seconds", "gauge", "Unix time of the last check for new release.", func(job string, m *JobMetrics) {
+			if !m.lastCheck.IsZero() {
+				fmt.Fprintf(w, "cdddru_job_last_check_timestamp_seconds%s %d\n", metricLabels("job", job), m.lastCheck.Unix())
+			}
+		}},
+		{"cdddru_job_release_info", "gauge", "Release tag deployed by the job.", func(job string, m *JobMetrics) {
+			if IsStringNotEmpty(m.deployedTag) {
+				fmt.Fprintf(w, "cdddru_job_release_info%s 1\n", metricLabels("job", job, "tag", m.deployedTag))
+			}
+		}},
+		{"cdddru_releases_attempted_total", "counter", "Attempts to upgrade to new release.", func(job string, m *JobMetrics) {
+			fmt.Fprintf(w, "cdddru_releases_attempted_total%s %d\n", metricLabels("job", job), m.releasesAttempted)
+		}},
+		{"cdddru_releases_succeeded_total", "counter", "Releases which pipeline succeeded.", func(job string, m *JobMetrics) {
+			fmt.Fprintf(w, "cdddru_releases_succeeded_total%s %d\n", metricLabels("job", job), m.releasesSucceeded)
+		}},
+		{"cdddru_releases_failed_total", "counter", "Releases which pipeline failed.", func(job string, m *JobMetrics) {
+			fmt.Fprintf(w, "cdddru_releases_failed_total%s %d\n", metricLabels("job", job), m.releasesFailed)
+		}},
+		{"cdddru_git_fetch_errors_total", "counter", "Failed pulls, fetches and listings of remote tags.", func(job string, m *JobMetrics) {
+			fmt.Fprintf(w, "cdddru_git_fetch_errors_total%s %d\n", metricLabels("job", job), m.gitFetchErrors)
+		}},
+		{"cdddru_step_duration_seconds", "histogram", "Duration of release steps.", func(job string, m *JobMetrics) {
+			steps := make([]string, 0, len(m.stepDurations))
+			for step := range m.stepDurations {
+				steps = append(steps, step)
+			}
+			sort.Strings(steps)
+			for _, step := range steps {
+				h := m.stepDurations[step]
+				for i, bound := range metricsBuckets {
+					fmt.Fprintf(w, "cdddru_step_duration_seconds_bucket%s %d\n",
+						metricLabels("job", job, "step", step, "le", fmt.Sprint(bound)), h.counts[i])
+				}
+				fmt.Fprintf(w, "cdddru_step_duration_seconds_bucket%s %d\n", metricLabels("job", job, "step", step, "le", "+Inf"), h.count)
+				fmt.Fprintf(w, "cdddru_step_duration_seconds_sum%s %g\n", metricLabels("job", job, "step", step), h.sum)
+				fmt.Fprintf(w, "cdddru_step_duration_seconds_count%s %d\n", metricLabels("job", job, "step", step), h.count)
+			}
+		}},
+	}
+	for _, family := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, name := range names {
+			m := jobs[name]
+			m.mu.Lock()
+			family.write(name, m)
+			m.mu.Unlock()
+		}
+	}
+}
+
+// MetricsHandler serves metrics of all jobs for prometheus
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w)
+	})
+}
@@ -0,0 +1,62 @@
+package cdddru
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	metrics := GetJobMetrics("metrics-site")
+	metrics.SetActive(true)
+	metrics.Checked()
+	metrics.SetDeployedTag("v1.0.1")
+	metrics.ReleaseAttempted()
+	metrics.ReleaseAttempted()
+	metrics.ReleaseSucceeded()
+	metrics.ReleaseFailed()
+	metrics.GitFetchError()
+	metrics.ObserveStep(MetricsStepPull, 3*time.Second)
+	metrics.ObserveStep(MetricsStepPull, 45*time.Second)
+	GetJobMetrics("metrics-suspended").SetActive(false)
+
+	server := httptest.NewServer(MetricsHandler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	expected := []string{
+		"# TYPE cdddru_job_active gauge",
+		`cdddru_job_active{job="metrics-site"} 1`,
+		`cdddru_job_active{job="metrics-suspended"} 0`,
+		`cdddru_job_release_info{job="metrics-site",tag="v1.0.1"} 1`,
+		`cdddru_releases_attempted_total{job="metrics-site"} 2`,
+		`cdddru_releases_succeeded_total{job="metrics-site"} 1`,
+		`cdddru_releases_failed_total{job="metrics-site"} 1`,
+		`cdddru_git_fetch_errors_total{job="metrics-site"} 1`,
+		"# TYPE cdddru_step_duration_seconds histogram",
+		`cdddru_step_duration_seconds_bucket{job="metrics-site",step="pull",le="5"} 1`,
+		`cdddru_step_duration_seconds_bucket{job="metrics-site",step="pull",le="60"} 2`,
+		`cdddru_step_duration_seconds_bucket{job="metrics-site",step="pull",le="+Inf"} 2`,
+		`cdddru_step_duration_seconds_sum{job="metrics-site",step="pull"} 48`,
+		`cdddru_step_duration_seconds_count{job="metrics-site",step="pull"} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("expected %q in metrics:\n%s", line, body)
+		}
+	}
+	if !strings.Contains(string(body), `cdddru_job_last_check_timestamp_seconds{job="metrics-site"} `) ||
+		strings.Contains(string(body), `cdddru_job_last_check_timestamp_seconds{job="metrics-suspended"}`) {
+		t.Errorf("expected last check time only for checked job:\n%s", body)
+	}
+}
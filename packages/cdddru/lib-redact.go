@@ -0,0 +1,164 @@
+package cdddru
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	redactedValue = "******"
+	// shorter values are not masked in free text - they would garble unrelated words
+	minSecretLength = 4
+	// lines of multi-line secrets (keys, kubeconfigs) which are masked on their own
+	minSecretLineLength = 16
+)
+
+// secretNamePattern matches names of env variables which values are secrets
+var secretNamePattern = regexp.MustCompile(`(?i)(passw|pwd|secret|token|api_?key|private_?key|access_?key|credential)`)
+
+// secretTextPatterns mask secrets which are not known in advance: passwords in urls, auth headers and key=value pairs
+var secretTextPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:)[^/\s@]+@`), "${1}" + redactedValue + "@"},
+	{regexp.MustCompile(`(?i)(\b(?:bearer|basic)\s+)[a-zA-Z0-9._~+/=-]{8,}`), "${1}" + redactedValue},
+	{regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api[_-]?key|access[_-]?key)[a-zA-Z0-9_-]*["']?\s*[:=]\s*["']?)[^\s"'&,;]+`),
+		"${1}" + redactedValue},
+}
+
+// secretValues are values masked in every log message, the longest go first
+var secretValues = struct {
+	sync.RWMutex
+	values []string
+}{}
+
+// AddSecrets registers values which are masked in log messages and command errors of every job.
+// Values shorter than 4 characters are ignored, long lines of multi-line values are masked on their own too.
+func AddSecrets(values ...string) {
+	secretValues.Lock()
+	defer secretValues.Unlock()
+	add := func(value string) {
+		if len(value) < minSecretLength {
+			return
+		}
+		for _, known := range secretValues.values {
+			if known == value {
+				return
+			}
+		}
+		secretValues.values = append(secretValues.values, value)
+	}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		add(value)
+		if strings.Contains(value, "\n") {
+			for _, line := range strings.Split(value, "\n") {
+				if line = strings.TrimSpace(line); len(line) >= minSecretLineLength {
+					add(line)
+				}
+			}
+		}
+	}
+	sort.SliceStable(secretValues.values, func(i, j int) bool {
+		return len(secretValues.values[i]) > len(secretValues.values[j])
+	})
+}
+
+// Redact masks registered secrets and secret looking parts of text
+func Redact(text string) string {
+	secretValues.RLock()
+	for _, value := range secretValues.values {
+		text = strings.ReplaceAll(text, value, redactedValue)
+	}
+	secretValues.RUnlock()
+	for _, p := range secretTextPatterns {
+		text = p.pattern.ReplaceAllString(text, p.replacement)
+	}
+	return text
+}
+
+// RegisterSecrets registers values of config fields tagged secret:"true" (docker_password, ...) as secrets
+func (cfg *Config) RegisterSecrets() {
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		switch v.Kind() {
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				field := v.Type().Field(i)
+				if !field.IsExported() {
+					continue
+				}
+				if field.Tag.Get("secret") == "true" && v.Field(i).Kind() == reflect.String {
+					AddSecrets(v.Field(i).String())
+					continue
+				}
+				walk(v.Field(i))
+			}
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i))
+			}
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem())
+}
+
+// secretJsonFields collects json names of fields tagged secret:"true" in struct type t and types nested in it
+func secretJsonFields(t reflect.Type, fields map[string]bool) {
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if field.Tag.Get("secret") == "true" {
+				fields[strings.Split(field.Tag.Get("json"), ",")[0]] = true
+				continue
+			}
+			secretJsonFields(field.Type, fields)
+		}
+	case reflect.Slice:
+		secretJsonFields(t.Elem(), fields)
+	}
+}
+
+// RedactedJson returns pretty json of config for debug output with values of secret fields
+// and registered secrets masked
+func (cfg *Config) RedactedJson() (string, error) {
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	var data interface{}
+	if err = json.Unmarshal(raw, &data); err != nil {
+		return "", err
+	}
+	fields := make(map[string]bool)
+	secretJsonFields(reflect.TypeOf(*cfg), fields)
+	var mask func(v interface{})
+	mask = func(v interface{}) {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			for key, fieldValue := range value {
+				if s, ok := fieldValue.(string); ok && fields[key] && len(s) > 0 {
+					value[key] = redactedValue
+					continue
+				}
+				mask(fieldValue)
+			}
+		case []interface{}:
+			for _, item := range value {
+				mask(item)
+			}
+		}
+	}
+	mask(data)
+	dump, err := PrettyJsonEncodeToString(data)
+	return Redact(dump), err
+}
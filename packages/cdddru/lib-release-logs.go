@@ -0,0 +1,218 @@
+package cdddru
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultReleaseLogsKeep   = 10
+	defaultReleaseLogsFolder = "/tmp/cdddru/release-logs"
+	// file of records written outside of pipeline steps: checkout, hooks of the job, result of the release
+	releaseLogFileName = "00-release.log"
+)
+
+// ReleaseLogsFolder is folder of log archives of releases: <folder>/<job>/<tag>/<NN-step>.log, empty - not archived.
+// Default is under /tmp, so archives do not survive restart of container unless the folder is set to a volume.
+var ReleaseLogsFolder = GetEnvVar("CDDDRU_RELEASE_LOGS", defaultReleaseLogsFolder)
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// releaseArchive is log archive of release being run, records are appended to file of current step
+type releaseArchive struct {
+	dir  string
+	seq  int
+	file *os.File
+}
+
+// safeFileName makes name of job, tag or step usable as name of file
+func safeFileName(name string) string {
+	name = strings.Trim(unsafeFileNameChars.ReplaceAllString(name, "_"), "._")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// ReleaseLogDir is folder of log archive of release tag of job
+func ReleaseLogDir(job, tag string) string {
+	return filepath.Join(ReleaseLogsFolder, safeFileName(job), safeFileName(tag))
+}
+
+// OpenReleaseLog starts archiving all records of logger (of every level) to dir, every pipeline step gets own file.
+// Records of repeated attempts of the release are appended to the same files.
+func (l *Logger) OpenReleaseLog(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// folder of the newest release is kept by cleanup even if the release is attempted again
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.archive.close()
+	l.archive = nil
+	archive := &releaseArchive{dir: dir}
+	if err := archive.open(l.step); err != nil {
+		return err
+	}
+	l.archive = archive
+	return nil
+}
+
+// CloseReleaseLog stops archiving records of logger
+func (l *Logger) CloseReleaseLog() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.archive.close()
+	l.archive = nil
+}
+
+// open switches archive to file of step, empty step is file of the release
+func (a *releaseArchive) open(step string) error {
+	name := releaseLogFileName
+	if IsStringNotEmpty(step) {
+		a.seq++
+		name = fmt.Sprintf("%02d-%s.log", a.seq, safeFileName(step))
+	}
+	file, err := os.OpenFile(filepath.Join(a.dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	a.close()
+	a.file = file
+	return nil
+}
+
+func (a *releaseArchive) close() {
+	if a != nil && a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// write appends every line of message with time and level
+func (a *releaseArchive) write(level, msg string) {
+	if a == nil || a.file == nil {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	buf := &bytes.Buffer{}
+	for _, line := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+		fmt.Fprintf(buf, "%s %-7s %s\n", now, strings.ToUpper(level), strings.TrimRight(line, "\r"))
+	}
+	a.file.Write(buf.Bytes())
+}
+
+// releaseLogs lists log archives of releases of job, the newest first
+func releaseLogs(jobDir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(jobDir)
+	if err != nil {
+		return nil, err
+	}
+	releases := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, info)
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].ModTime().After(releases[j].ModTime()) })
+	return releases, nil
+}
+
+// CleanupReleaseLogs removes log archives of all but release_logs_keep last releases of the job,
+// archive of current release is always kept
+func (cmncfg *CommonConfig) CleanupReleaseLogs(current string, logger *Logger) error {
+	keep := cmncfg.RELEASE_LOGS_KEEP
+	if keep <= 0 {
+		keep = defaultReleaseLogsKeep
+	}
+	jobDir := filepath.Join(ReleaseLogsFolder, safeFileName(cmncfg.JOB_NAME))
+	releases, err := releaseLogs(jobDir)
+	if err != nil {
+		return err
+	}
+	old := make([]string, 0, len(releases))
+	for _, release := range releases {
+		if path := filepath.Join(jobDir, release.Name()); path != current {
+			old = append(old, path)
+		}
+	}
+	// current release is one of kept
+	for i := keep - 1; i < len(old); i++ {
+		PrintDebug(logger, "removing old release log %s", old[i])
+		if err = os.RemoveAll(old[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunLogsCommand is `logs <job> [<tag> [<step>]]` command of cli: it lists archived releases of job
+// or prints archived logs of release, only of one step if it is given
+func RunLogsCommand(args []string, out io.Writer) error {
+	flagset := flag.NewFlagSet("logs", flag.ContinueOnError)
+	folder := flagset.String("release-logs", ReleaseLogsFolder, "folder of log archives of releases (env CDDDRU_RELEASE_LOGS)")
+	if err := ParseFlagSet(flagset, args); err != nil {
+		return err
+	}
+	args = flagset.Args()
+	if len(args) == 0 || len(args) > 3 {
+		return fmt.Errorf("usage: %s logs <job> [<tag> [<step>]] [-release-logs folder]", filepath.Base(os.Args[0]))
+	}
+	jobDir := filepath.Join(*folder, safeFileName(args[0]))
+
+	if len(args) == 1 {
+		releases, err := releaseLogs(jobDir)
+		if err != nil {
+			return fmt.Errorf("no release logs of job %s: %w", args[0], err)
+		}
+		for _, release := range releases {
+			fmt.Fprintf(out, "%s\t%s\n", release.Name(), release.ModTime().Format(time.RFC3339))
+		}
+		return nil
+	}
+
+	releaseDir := filepath.Join(jobDir, safeFileName(args[1]))
+	entries, err := os.ReadDir(releaseDir)
+	if err != nil {
+		return fmt.Errorf("no logs of release %s of job %s: %w", args[1], args[0], err)
+	}
+	printed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+		if len(args) == 3 {
+			// NN-step.log
+			_, step, _ := strings.Cut(strings.TrimSuffix(entry.Name(), ".log"), "-")
+			if step != safeFileName(args[2]) {
+				continue
+			}
+		}
+		content, err := os.ReadFile(filepath.Join(releaseDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "==> %s <==\n", entry.Name())
+		out.Write(content)
+		printed++
+	}
+	if printed == 0 && len(args) == 3 {
+		return fmt.Errorf("no logs of step %s of release %s of job %s", args[2], args[1], args[0])
+	}
+	return nil
+}
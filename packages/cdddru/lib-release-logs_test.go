@@ -0,0 +1,93 @@
+package cdddru
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReleaseLogs(t *testing.T) {
+	ReleaseLogsFolder = t.TempDir()
+	defer func() { ReleaseLogsFolder = "" }()
+
+	config := &Config{}
+	config.COMMON.JOB_NAME = "main-site"
+	config.COMMON.RELEASE_LOGS_KEEP = 2
+	config.STEPS = []PipelineStep{{NAME: "smoke test", TYPE: PipelineStepHook,
+		HOOKS: []Hook{{COMMAND: []string{"sh", "-c", "echo checked; echo warming up >&2"}}}}}
+	config.SetParentLinks()
+	var out bytes.Buffer
+	logger := NewLogger(&out, &out, InfoLevel, "main-site")
+
+	for i, tag := range []string{"v1.0.0", "v1.0.1", "v1.0.2"} {
+		dir := ReleaseLogDir(config.COMMON.JOB_NAME, tag)
+		if err := logger.OpenReleaseLog(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.COMMON.CleanupReleaseLogs(dir, logger); err != nil {
+			t.Fatal(err)
+		}
+		PrintInfo(logger, "starting upgrade for %s release", tag)
+		if err := config.RunPipeline(&PipelineRun{Data: ReleaseData{Release: tag}}, logger); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		logger.CloseReleaseLog()
+		// releases run minutes apart
+		used := time.Now().Add(time.Duration(i-3) * time.Minute)
+		os.Chtimes(dir, used, used)
+	}
+	PrintInfo(logger, "not archived")
+
+	if !strings.Contains(out.String(), " sh | warming up") || !strings.Contains(out.String(), " sh | checked") {
+		t.Errorf("expected stdout and stderr of command to be streamed on info level, got:\n%s", out.String())
+	}
+	if _, err := os.Stat(ReleaseLogDir("main-site", "v1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("expected log of the oldest release to be removed, got %v", err)
+	}
+
+	var listed bytes.Buffer
+	if err := RunLogsCommand([]string{"main-site"}, &listed); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(listed.String()), "\n"); len(lines) != 2 ||
+		!strings.HasPrefix(lines[0], "v1.0.2\t") || !strings.HasPrefix(lines[1], "v1.0.1\t") {
+		t.Errorf("expected the last two releases, the newest first, got:\n%s", listed.String())
+	}
+
+	var printed bytes.Buffer
+	if err := RunLogsCommand([]string{"main-site", "v1.0.2"}, &printed); err != nil {
+		t.Fatal(err)
+	}
+	release, step, found := strings.Cut(printed.String(), "==> 01-smoke_test.log <==\n")
+	if !found || !strings.HasPrefix(release, "==> 00-release.log <==\n") || !strings.Contains(release, "INFO    starting upgrade for v1.0.2 release") ||
+		strings.Contains(printed.String(), "not archived") {
+		t.Errorf("unexpected log of release:\n%s", printed.String())
+	}
+	for _, line := range []string{"INFO    sh | checked", "INFO    sh | warming up", "INFO    step smoke test of release v1.0.2 succeeded"} {
+		if !strings.Contains(step, line) {
+			t.Errorf("expected %q in log of step, got:\n%s", line, step)
+		}
+	}
+
+	printed.Reset()
+	if err := RunLogsCommand([]string{"main-site", "v1.0.2", "smoke test", "-release-logs", ReleaseLogsFolder}, &printed); err != nil ||
+		strings.Contains(printed.String(), "00-release.log") {
+		t.Errorf("expected only log of step, got %v:\n%s", err, printed.String())
+	}
+	if err := RunLogsCommand([]string{"main-site", "v0.9.0"}, &printed); err == nil {
+		t.Error("expected error for release without logs")
+	}
+
+	// output of commands can be moved to debug level
+	CommandOutput = CommandOutputDebug
+	defer func() { CommandOutput = CommandOutputInfo }()
+	out.Reset()
+	if err := config.RunPipeline(&PipelineRun{Data: ReleaseData{Release: "v1.0.3"}}, logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if strings.Contains(out.String(), "sh | ") {
+		t.Errorf("expected output of command on debug level only, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,289 @@
+package cdddru
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	plumbing "github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// every finished export has marker file next to it - folders without it are leftovers of crashed exports.
+// Marker is kept outside of export so it never gets into built images or synced assets.
+const releaseMarkerSuffix = ".json"
+
+const defaultReleasesKeep = 3
+
+type ReleaseExport struct {
+	Tag    string `json:"tag"`
+	Commit string `json:"commit"`
+	Tree   string `json:"tree"`
+	Path   string `json:"path"`
+	// sparse dirs, submodules and lfs settings the export is made with
+	Settings  string    `json:"settings"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// exportSettings describes settings which change content of export of the same tree
+func (gitcfg *GitConfig) exportSettings() string {
+	return fmt.Sprintf("sparse=%s submodules=%v lfs=%v", strings.Join(gitcfg.SparseCheckoutDirs(), ","),
+		gitcfg.GIT_SUBMODULES, gitcfg.GIT_LFS)
+}
+
+// readReleaseExport reads marker of finished export
+func readReleaseExport(markerPath string) (*ReleaseExport, error) {
+	content, err := os.ReadFile(markerPath)
+	if err != nil {
+		return nil, err
+	}
+	export := &ReleaseExport{}
+	if err = json.Unmarshal(content, export); err != nil {
+		return nil, fmt.Errorf("reading marker %s failed: %w", markerPath, err)
+	}
+	return export, nil
+}
+
+// ReleasesFolder returns folder where release exports of the job are stored.
+func (gitcfg *GitConfig) ReleasesFolder() string {
+	if IsStringNotEmpty(gitcfg.GIT_RELEASES_FOLDER) {
+		return gitcfg.GIT_RELEASES_FOLDER
+	}
+	return filepath.Clean(gitcfg.GIT_LOCAL_FOLDER) + ".releases"
+}
+
+// ExportRelease writes files of the given commit into its own folder named by the commit's tree hash,
+// so the same content is exported only once and never changed afterwards. Export is made again only if
+// sparse dirs, submodules or lfs settings have changed.
+// Submodules (already updated in the worktree) and lfs objects are exported too if enabled in config.
+// Export is made in temporary folder and renamed when complete, so a crash never leaves half exported release.
+func (gitcfg *GitConfig) ExportRelease(gitRepository *git.Repository, gitWorkTree *git.Worktree, tag string,
+	commitHash plumbing.Hash, logger *Logger) (string, error) {
+
+	commit, err := gitRepository.CommitObject(commitHash)
+	if err != nil {
+		return "", fmt.Errorf("getting commit %s failed: %w", commitHash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", fmt.Errorf("getting tree of commit %s failed: %w", commitHash, err)
+	}
+
+	releasesFolder := gitcfg.ReleasesFolder()
+	exportPath := filepath.Join(releasesFolder, tree.Hash.String())
+	markerPath := exportPath + releaseMarkerSuffix
+	settings := gitcfg.exportSettings()
+	if export, err := readReleaseExport(markerPath); err == nil {
+		if export.Settings == settings {
+			// touch marker - retention policy keeps recently used exports
+			now := time.Now()
+			os.Chtimes(markerPath, now, now)
+			PrintInfo(logger, "release %s is already exported to %s", tag, exportPath)
+			return exportPath, nil
+		}
+		PrintInfo(logger, "release %s is exported to %s with other settings (%s), exporting again", tag, exportPath, export.Settings)
+	}
+	// export with other settings is unfinished one too
+	if err = os.Remove(markerPath); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err = os.MkdirAll(releasesFolder, 0755); err != nil {
+		return "", err
+	}
+	// export without marker is unfinished one
+	if err = os.RemoveAll(exportPath); err != nil {
+		return "", err
+	}
+	tmpPath, err := os.MkdirTemp(releasesFolder, ".tmp-"+tree.Hash.String()[:12]+"-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	dirs := gitcfg.SparseCheckoutDirs()
+	if err = ExportTree(tree, tmpPath, dirs); err != nil {
+		return "", fmt.Errorf("exporting tree of %s failed: %w", tag, err)
+	}
+
+	if gitcfg.GIT_SUBMODULES {
+		if err = exportSubmodules(gitWorkTree, tree, tmpPath, dirs); err != nil {
+			return "", err
+		}
+	}
+	if gitcfg.GIT_LFS {
+		count, err := gitcfg.SmudgeLfsObjects(tmpPath, logger)
+		if err != nil {
+			return "", fmt.Errorf("smudging lfs objects in export failed: %w", err)
+		}
+		PrintDebug(logger, "smudged %d lfs objects in export of %s", count, tag)
+	}
+
+	if err = os.Chmod(tmpPath, 0755); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmpPath, exportPath); err != nil {
+		return "", fmt.Errorf("publishing export of %s failed: %w", tag, err)
+	}
+	marker, err := json.Marshal(ReleaseExport{
+		Tag: tag, Commit: commitHash.String(), Tree: tree.Hash.String(), Path: exportPath, Settings: settings, CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	if err = os.WriteFile(markerPath, marker, 0644); err != nil {
+		return "", err
+	}
+	PrintInfo(logger, "release %s (commit %s) exported to %s", tag, commitHash, exportPath)
+	return exportPath, nil
+}
+
+// ExportTree writes files of the git tree into targetDir keeping executable bits and symlinks.
+// If dirs are given only files inside them are written.
+func ExportTree(tree *object.Tree, targetDir string, dirs []string) error {
+	return tree.Files().ForEach(func(f *object.File) error {
+		if !isPathInDirs(f.Name, dirs) {
+			return nil
+		}
+		target := filepath.Join(targetDir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		if f.Mode == filemode.Symlink {
+			linkTarget, err := f.Contents()
+			if err != nil {
+				return err
+			}
+			return os.Symlink(linkTarget, target)
+		}
+
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			return err
+		}
+		reader, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, reader)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+}
+
+func isPathInDirs(path string, dirs []string) bool {
+	if len(dirs) == 0 {
+		return true
+	}
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// exportSubmodules exports trees of submodules at commits recorded in the main tree
+func exportSubmodules(gitWorkTree *git.Worktree, tree *object.Tree, targetDir string, dirs []string) error {
+	submodules, err := gitWorkTree.Submodules()
+	if err != nil {
+		return fmt.Errorf("getting submodules failed: %w", err)
+	}
+	for _, submodule := range submodules {
+		subPath := submodule.Config().Path
+		if !isPathInDirs(subPath, dirs) {
+			continue
+		}
+		entry, err := tree.FindEntry(subPath)
+		if err != nil {
+			// submodule is not presented in this release
+			continue
+		}
+		subRepository, err := submodule.Repository()
+		if err != nil {
+			return fmt.Errorf("opening submodule %s failed: %w", subPath, err)
+		}
+		subCommit, err := subRepository.CommitObject(entry.Hash)
+		if err != nil {
+			return fmt.Errorf("getting commit %s of submodule %s failed: %w", entry.Hash, subPath, err)
+		}
+		subTree, err := subCommit.Tree()
+		if err != nil {
+			return err
+		}
+		if err = ExportTree(subTree, filepath.Join(targetDir, filepath.FromSlash(subPath)), nil); err != nil {
+			return fmt.Errorf("exporting submodule %s failed: %w", subPath, err)
+		}
+	}
+	return nil
+}
+
+// CleanupReleaseExports removes leftovers of crashed exports and all but git_releases_keep
+// most recently used exports. The current export is never removed.
+func (gitcfg *GitConfig) CleanupReleaseExports(current string, logger *Logger) error {
+	keep := gitcfg.GIT_RELEASES_KEEP
+	if keep <= 0 {
+		keep = defaultReleasesKeep
+	}
+	releasesFolder := gitcfg.ReleasesFolder()
+	entries, err := os.ReadDir(releasesFolder)
+	if err != nil {
+		return err
+	}
+
+	type usedExport struct {
+		path string
+		used time.Time
+	}
+	exports := make([]usedExport, 0, len(entries))
+	for _, entry := range entries {
+		path := filepath.Join(releasesFolder, entry.Name())
+		if !entry.IsDir() {
+			// marker left from removed export
+			if isExist, _, _ := IsPathExists(strings.TrimSuffix(path, releaseMarkerSuffix)); !isExist {
+				os.Remove(path)
+			}
+			continue
+		}
+		if path == current {
+			continue
+		}
+		info, err := os.Stat(path + releaseMarkerSuffix)
+		if err != nil {
+			// unfinished export of crashed job
+			PrintDebug(logger, "removing unfinished export %s", path)
+			if err = os.RemoveAll(path); err != nil {
+				return err
+			}
+			continue
+		}
+		exports = append(exports, usedExport{path: path, used: info.ModTime()})
+	}
+
+	sort.Slice(exports, func(i, j int) bool { return exports[i].used.After(exports[j].used) })
+	// current export is one of kept
+	for i := keep - 1; i < len(exports); i++ {
+		PrintInfo(logger, "removing old release export %s", exports[i].path)
+		if err = os.RemoveAll(exports[i].path); err != nil {
+			return err
+		}
+		os.Remove(exports[i].path + releaseMarkerSuffix)
+	}
+	return nil
+}
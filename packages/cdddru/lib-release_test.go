@@ -0,0 +1,94 @@
+package cdddru
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	plumbing "github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestExportRelease(t *testing.T) {
+	repoPath := t.TempDir()
+	repo, err := git.PlainInit(repoPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(repoPath, "assets"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(repoPath, "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wt.Add("run.sh"); err != nil {
+		t.Fatal(err)
+	}
+	commits := []plumbing.Hash{
+		commitTestFile(t, repoPath, wt, "assets/a.txt", "a1"),
+		commitTestFile(t, repoPath, wt, "assets/a.txt", "a2"),
+		commitTestFile(t, repoPath, wt, "assets/a.txt", "a3"),
+	}
+
+	config := Config{}
+	config.GIT.GIT_LOCAL_FOLDER = repoPath
+	config.GIT.GIT_RELEASES_FOLDER = t.TempDir()
+	config.GIT.GIT_RELEASES_KEEP = 2
+	config.SetParentLinks()
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+
+	exports := make([]string, 0, len(commits))
+	for i, commit := range commits {
+		exportPath, err := config.GIT.ExportRelease(repo, wt, fmt.Sprintf("v1.0.%d", i), commit, logger)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err = config.GIT.CleanupReleaseExports(exportPath, logger); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		exports = append(exports, exportPath)
+	}
+
+	content, err := os.ReadFile(filepath.Join(exports[2], "assets", "a.txt"))
+	if err != nil || string(content) != "a3" {
+		t.Errorf("expected exported content a3, got %q (%v)", content, err)
+	}
+	info, err := os.Stat(filepath.Join(exports[2], "run.sh"))
+	if err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("expected executable bit to be kept, got %v (%v)", info, err)
+	}
+
+	// the oldest export is removed by retention policy
+	if isExist, _, _ := IsPathExists(exports[0]); isExist {
+		t.Errorf("expected %s to be removed", exports[0])
+	}
+	if isExist, _, _ := IsPathExists(exports[1]); !isExist {
+		t.Errorf("expected %s to be kept", exports[1])
+	}
+
+	// the same tree is exported once
+	exportPath, err := config.GIT.ExportRelease(repo, wt, "v1.0.3", commits[2], logger)
+	if err != nil || exportPath != exports[2] {
+		t.Errorf("expected export %s to be reused, got %s (%v)", exports[2], exportPath, err)
+	}
+
+	// the same tree with other sparse dirs is exported again
+	config.GIT.GIT_SPARSE_CHECKOUT = true
+	config.GIT.GIT_SPARSE_DIRS = []string{"assets"}
+	exportPath, err = config.GIT.ExportRelease(repo, wt, "v1.0.3", commits[2], logger)
+	if err != nil || exportPath != exports[2] {
+		t.Fatalf("expected export to %s, got %s (%v)", exports[2], exportPath, err)
+	}
+	if isExist, _, _ := IsPathExists(filepath.Join(exportPath, "run.sh")); isExist {
+		t.Error("expected file outside of sparse dirs not to be exported")
+	}
+	export, err := readReleaseExport(exportPath + releaseMarkerSuffix)
+	if err != nil || export.Settings != "sparse=assets submodules=false lfs=false" {
+		t.Errorf("expected settings of export in its marker, got %+v (%v)", export, err)
+	}
+}
@@ -0,0 +1,215 @@
+package cdddru
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RolloutApply     = "apply"
+	RolloutBlueGreen = "blue-green"
+	RolloutCanary    = "canary"
+
+	RolloutColourBlue  = "blue"
+	RolloutColourGreen = "green"
+	RolloutTrackStable = "stable"
+	RolloutTrackCanary = "canary"
+
+	// label of pods and service selector which tells blue deployment from green one
+	rolloutColourLabel = "colour"
+
+	defaultRolloutTimeout  = 600
+	defaultCanaryReplicas  = 1
+	defaultCanaryBakeTime  = 300
+	canaryDeploymentSuffix = "-canary"
+)
+
+// ErrCanaryAborted is returned when canary deployment does not pass checks and is removed
+var ErrCanaryAborted = errors.New("canary is aborted")
+
+// kubectl runs kubectl with namespace and context of the job
+func (cfg *Config) kubectl(ctx context.Context, stdinString string, args ...string) (string, error) {
+	return runHookCommand(ctx, stdinString, nil, "kubectl", cfg.kubectlArgs("", args...)...)
+}
+
+// rolloutTimeout is how long blue-green or canary deployment may take to become ready
+func (cfg *Config) rolloutTimeout() time.Duration {
+	if cfg.DEPLOY.ROLLOUT_TIMEOUT <= 0 {
+		return defaultRolloutTimeout * time.Second
+	}
+	return time.Duration(cfg.DEPLOY.ROLLOUT_TIMEOUT) * time.Second
+}
+
+// applyAndWaitRollout applies manifest made from template with given data and waits for rollout of deployment
+func (cfg *Config) applyAndWaitRollout(step PipelineStep, data ReleaseData, deployment string, logger *Logger) error {
+	manifestToApply, err := GenerateManifest(step.Manifests(cfg), data)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(logger.CommandContext(), cfg.rolloutTimeout()+time.Minute)
+	defer cancel()
+	metrics := GetJobMetrics(cfg.COMMON.JOB_NAME)
+	start := time.Now()
+	out, err := cfg.kubectl(ctx, manifestToApply, "apply", "-f", "-")
+	metrics.ObserveStep(MetricsStepApply, time.Since(start))
+	if err != nil {
+		return err
+	}
+	PrintInfo(logger, "manifests of release %s are applied\n%v", data.Release, out)
+	start = time.Now()
+	_, err = cfg.kubectl(ctx, "", "rollout", "status", "deployment/"+deployment,
+		"--timeout="+strconv.Itoa(int(cfg.rolloutTimeout().Seconds()))+"s")
+	metrics.ObserveStep(MetricsStepReadinessWait, time.Since(start))
+	if err != nil {
+		return fmt.Errorf("%w: deployment %s is not ready: %v", ErrReleaseNotApplied, deployment, err)
+	}
+	return nil
+}
+
+// blueGreenRollout renders deployment of colour the service does not point to, waits it is ready,
+// switches service selector to it and scales deployment of previous colour down. When service has no colour
+// selector yet (job used apply strategy), deployment_name_k8s without colour is scaled down instead.
+// Manifest template must name deployment {deployment_name_k8s}-{{.Colour}} and label its pods with colour: {{.Colour}},
+// service itself is not expected in the template - its selector is patched.
+func (cfg *Config) blueGreenRollout(step PipelineStep, run *PipelineRun, logger *Logger) error {
+	if IsStringEmpty(cfg.DEPLOY.SERVICE_NAME_K8s) {
+		return errors.New("service_name_k8s is not set for blue-green rollout")
+	}
+	ctx, cancel := context.WithTimeout(logger.CommandContext(), defaultHookTimeout*time.Second)
+	defer cancel()
+	activeColour, err := cfg.activeColour(ctx)
+	if err != nil {
+		return err
+	}
+	colour := RolloutColourBlue
+	if activeColour == RolloutColourBlue {
+		colour = RolloutColourGreen
+	}
+	PrintInfo(logger, "service %s points to %q deployment, release %s goes to %s one", cfg.DEPLOY.SERVICE_NAME_K8s,
+		activeColour, run.Data.Release, colour)
+
+	data := run.Data
+	data.Colour, data.Track = colour, RolloutTrackStable
+	err = cfg.applyAndWaitRollout(step, data, cfg.DEPLOY.DEPLOYMENT_NAME_K8s+"-"+colour, logger)
+	if err != nil {
+		return err
+	}
+
+	patch := fmt.Sprintf(`{"spec":{"selector":{%q:%q}}}`, rolloutColourLabel, colour)
+	_, err = cfg.kubectl(ctx, "", "patch", "service", cfg.DEPLOY.SERVICE_NAME_K8s, "--type=merge", "-p", patch)
+	if err != nil {
+		return fmt.Errorf("switching service %s to %s failed: %w", cfg.DEPLOY.SERVICE_NAME_K8s, colour, err)
+	}
+	PrintInfo(logger, "service %s is switched to %s deployment", cfg.DEPLOY.SERVICE_NAME_K8s, colour)
+
+	oldDeployment := cfg.DEPLOY.DEPLOYMENT_NAME_K8s + "-" + activeColour
+	if IsStringEmpty(activeColour) {
+		// the first blue-green rollout of job which used apply strategy - deployment without colour served traffic
+		out, err := cfg.kubectl(ctx, "", "get", "deployment", cfg.DEPLOY.DEPLOYMENT_NAME_K8s,
+			"--ignore-not-found", "-o", "name")
+		if err != nil || IsStringEmpty(strings.TrimSpace(out)) {
+			return nil
+		}
+		oldDeployment = cfg.DEPLOY.DEPLOYMENT_NAME_K8s
+	}
+	_, err = cfg.kubectl(ctx, "", "scale", "deployment/"+oldDeployment, "--replicas=0")
+	if err != nil {
+		// release already serves traffic - old deployment is only extra load
+		PrintWarning(logger, "scaling down deployment %s failed: %v", oldDeployment, err)
+	}
+	return nil
+}
+
+// activeColour is colour of deployment service of blue-green rollout points to, empty before the first rollout
+func (cfg *Config) activeColour(ctx context.Context) (string, error) {
+	out, err := cfg.kubectl(ctx, "", "get", "service", cfg.DEPLOY.SERVICE_NAME_K8s,
+		"-o", "jsonpath={.spec.selector."+rolloutColourLabel+"}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// ActiveDeployment is deployment running the current release: deployment of active colour with blue-green rollout,
+// deployment_name_k8s otherwise and before the first blue-green rollout
+func (cfg *Config) ActiveDeployment(ctx context.Context) (string, error) {
+	if cfg.DEPLOY.ROLLOUT_STRATEGY != RolloutBlueGreen {
+		return cfg.DEPLOY.DEPLOYMENT_NAME_K8s, nil
+	}
+	colour, err := cfg.activeColour(ctx)
+	if err != nil {
+		return "", fmt.Errorf("getting active colour of service %s failed: %w", cfg.DEPLOY.SERVICE_NAME_K8s, err)
+	}
+	if IsStringEmpty(colour) {
+		return cfg.DEPLOY.DEPLOYMENT_NAME_K8s, nil
+	}
+	if colour != RolloutColourBlue && colour != RolloutColourGreen {
+		return "", fmt.Errorf("service %s points to neither blue nor green deployment", cfg.DEPLOY.SERVICE_NAME_K8s)
+	}
+	return cfg.DEPLOY.DEPLOYMENT_NAME_K8s + "-" + colour, nil
+}
+
+// canaryRollout renders canary deployment ({{.Track}} is canary, {{.Replicas}} is canary_replicas), runs after_canary
+// checks again and again for bake time and then promotes release to stable deployment or aborts it.
+// Manifest template must name deployment {deployment_name_k8s}-canary when track is canary.
+func (cfg *Config) canaryRollout(step PipelineStep, run *PipelineRun, logger *Logger) error {
+	replicas := cfg.DEPLOY.CANARY_REPLICAS
+	if replicas <= 0 {
+		replicas = defaultCanaryReplicas
+	}
+	bakeTime := time.Duration(cfg.DEPLOY.CANARY_BAKE_TIME) * time.Second
+	if cfg.DEPLOY.CANARY_BAKE_TIME <= 0 {
+		bakeTime = defaultCanaryBakeTime * time.Second
+	}
+	interval := time.Duration(cfg.VERIFY.RETRY_INTERVAL) * time.Second
+	if cfg.VERIFY.RETRY_INTERVAL <= 0 {
+		interval = defaultVerifyRetryInterval * time.Second
+	}
+	canaryDeployment := cfg.DEPLOY.DEPLOYMENT_NAME_K8s + canaryDeploymentSuffix
+	removeCanary := func() {
+		ctx, cancel := context.WithTimeout(logger.CleanupContext(), defaultHookTimeout*time.Second)
+		defer cancel()
+		_, err := cfg.kubectl(ctx, "", "delete", "deployment", canaryDeployment, "--ignore-not-found")
+		if err != nil {
+			PrintWarning(logger, "deleting canary deployment %s failed: %v", canaryDeployment, err)
+		}
+	}
+
+	data := run.Data
+	data.Track, data.Replicas = RolloutTrackCanary, replicas
+	err := cfg.applyAndWaitRollout(step, data, canaryDeployment, logger)
+	if err != nil {
+		removeCanary()
+		return err
+	}
+
+	PrintInfo(logger, "canary of release %s with %d replicas is baking for %v", run.Data.Release, replicas, bakeTime)
+	deadline := time.Now().Add(bakeTime)
+	for {
+		err = cfg.VERIFY.VerifyRelease(VerifyCanary, data, logger)
+		if err != nil {
+			removeCanary()
+			return fmt.Errorf("%w: %v", ErrCanaryAborted, err)
+		}
+		if !time.Now().Add(interval).Before(deadline) {
+			break
+		}
+		if err = verifySleep(logger.CommandContext(), interval); err != nil {
+			removeCanary()
+			return fmt.Errorf("baking of canary of release %s is interrupted: %w", run.Data.Release, err)
+		}
+	}
+	PrintInfo(logger, "canary of release %s passed checks, promoting", run.Data.Release)
+
+	data.Track, data.Replicas = RolloutTrackStable, 0
+	err = cfg.applyRollout(step, run, data, logger)
+	if err != nil {
+		return err
+	}
+	removeCanary()
+	return nil
+}
@@ -0,0 +1,140 @@
+package cdddru
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRolloutExecutor answers kubectl of rollout with activeColour as colour of service selector
+func fakeRolloutExecutor(activeColour string) *FakeExecutor {
+	return NewFakeExecutor().OnOutput("kubectl -n test-app get service", activeColour+"\n")
+}
+
+func rolloutTestConfig(t *testing.T, strategy string) *Config {
+	manifest := filepath.Join(t.TempDir(), "deployment.yaml")
+	template := "name: main-site{{if .Colour}}-{{.Colour}}{{end}}{{if eq .Track \"canary\"}}-canary{{end}}\n" +
+		"colour: {{.Colour}}\nreplicas: {{if .Replicas}}{{.Replicas}}{{else}}3{{end}}\n"
+	if err := os.WriteFile(manifest, []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{}
+	config.DEPLOY.ROLLOUT_STRATEGY = strategy
+	config.DEPLOY.MANIFESTS_K8S = manifest
+	config.DEPLOY.NAMESPACE_K8s = "test-app"
+	config.DEPLOY.DEPLOYMENT_NAME_K8s = "main-site"
+	config.DEPLOY.SERVICE_NAME_K8s = "main-site"
+	config.SetParentLinks()
+	return config
+}
+
+func TestBlueGreenRollout(t *testing.T) {
+	config := rolloutTestConfig(t, RolloutBlueGreen)
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+	run := &PipelineRun{Data: ReleaseData{Release: "v1.0.1", Image: "ddru:v1.0.1"}}
+
+	executor := fakeRolloutExecutor("blue")
+	logger.SetExecutor(executor)
+	if err := config.runDeployStep(PipelineStep{TYPE: PipelineStepDeploy}, run, logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	calls := kubectlCalls(executor)
+	expected := []string{
+		"-n test-app get service main-site -o jsonpath={.spec.selector.colour}",
+		"-n test-app apply -f -",
+		"name: main-site-green\ncolour: green\nreplicas: 3",
+		"-n test-app rollout status deployment/main-site-green --timeout=600s",
+		`-n test-app patch service main-site --type=merge -p {"spec":{"selector":{"colour":"green"}}}`,
+		"-n test-app scale deployment/main-site-blue --replicas=0",
+	}
+	if strings.TrimSpace(calls) != strings.Join(expected, "\n") {
+		t.Errorf("unexpected kubectl calls:\n%s", calls)
+	}
+
+	// first blue-green rollout - there is no deployment to scale down
+	executor = fakeRolloutExecutor("")
+	logger.SetExecutor(executor)
+	if err := config.runDeployStep(PipelineStep{TYPE: PipelineStepDeploy}, run, logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	calls = kubectlCalls(executor)
+	if !strings.Contains(calls, "deployment/main-site-blue --timeout") || strings.Contains(calls, " scale ") {
+		t.Errorf("unexpected kubectl calls:\n%s", calls)
+	}
+
+	// first blue-green rollout of job which used apply strategy - deployment without colour is scaled down
+	executor = fakeRolloutExecutor("").
+		OnOutput("kubectl -n test-app get deployment main-site --ignore-not-found", "deployment.apps/main-site\n")
+	logger.SetExecutor(executor)
+	if err := config.runDeployStep(PipelineStep{TYPE: PipelineStepDeploy}, run, logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	calls = kubectlCalls(executor)
+	if !strings.HasSuffix(strings.TrimSpace(calls), "-n test-app scale deployment/main-site --replicas=0") {
+		t.Errorf("expected deployment without colour to be scaled down, got calls:\n%s", calls)
+	}
+}
+
+func TestCanaryRolloutAbort(t *testing.T) {
+	verifySleep = func(context.Context, time.Duration) error { return nil }
+	defer func() { verifySleep = sleepContext }()
+
+	config := rolloutTestConfig(t, RolloutCanary)
+	config.DEPLOY.CANARY_REPLICAS = 2
+	config.DEPLOY.CANARY_BAKE_TIME = 60
+	config.VERIFY.RETRIES = 1
+	config.VERIFY.AFTER_CANARY = []VerifyCheck{{TYPE: VerifyCheckCommand, COMMAND: []string{"curl", "-f", "http://main-site-canary/health"}}}
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+	run := &PipelineRun{Data: ReleaseData{Release: "v1.0.1", Image: "ddru:v1.0.1"}}
+
+	// canary becomes unhealthy on the third round of checks
+	checks := 0
+	executor := fakeRolloutExecutor("").On("curl", func(ctx context.Context, c Command) (string, error) {
+		if checks++; checks < 3 {
+			return "ok", nil
+		}
+		return "", &CommandError{Kind: ErrCommandExit, Command: c.Name, ExitCode: 22, Err: errors.New("exit status 22")}
+	})
+	logger.SetExecutor(executor)
+	err := config.runDeployStep(PipelineStep{TYPE: PipelineStepDeploy}, run, logger)
+	if !errors.Is(err, ErrCanaryAborted) || checks != 3 {
+		t.Fatalf("expected canary to be aborted on the third check, got %v after %d checks", err, checks)
+	}
+	calls := kubectlCalls(executor)
+	expected := []string{
+		"-n test-app apply -f -",
+		"name: main-site-canary\ncolour: \nreplicas: 2",
+		"-n test-app rollout status deployment/main-site-canary --timeout=600s",
+		"-n test-app delete deployment main-site-canary --ignore-not-found",
+	}
+	if strings.TrimSpace(calls) != strings.Join(expected, "\n") {
+		t.Errorf("unexpected kubectl calls:\n%s", calls)
+	}
+}
+
+func TestBlueGreenImageTag(t *testing.T) {
+	config := rolloutTestConfig(t, RolloutBlueGreen)
+	config.DOCKER.DOCKER_IMAGE = "ddru"
+	config.GIT.GIT_TAG_PREFIX = "v"
+	config.logger = NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+	executor := fakeRolloutExecutor("green").
+		OnOutput("kubectl get deployment main-site-blue", `[{"name":"main-site","image":"ddru:v1.0.1"}]`).
+		OnOutput("kubectl get deployment main-site-green", `[{"name":"main-site","image":"ddru:v1.0.2"}]`)
+	config.logger.SetExecutor(executor)
+
+	tag, err := GetImageTag(config)
+	if err != nil || tag != "v1.0.2" {
+		t.Errorf("expected tag of active green deployment, got %s (%v)", tag, err)
+	}
+
+	// service selects no colour before the first blue-green rollout - deployment without colour serves traffic
+	config.logger.SetExecutor(fakeRolloutExecutor("").
+		OnOutput("kubectl get deployment main-site", `[{"name":"main-site","image":"ddru:v1.0.0"}]`))
+	if tag, err = GetImageTag(config); err != nil || tag != "v1.0.0" {
+		t.Errorf("expected tag of deployment without colour, got %s (%v)", tag, err)
+	}
+}
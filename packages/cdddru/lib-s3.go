@@ -0,0 +1,464 @@
+package cdddru
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Endpoint = "https://s3.amazonaws.com"
+	defaultS3Region   = "us-east-1"
+	sigV4Algorithm    = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat   = "20060102T150405Z"
+)
+
+// S3Target is sync target given as s3://bucket/prefix
+type S3Target struct {
+	Bucket string
+	// key prefix without leading and trailing slashes, empty - bucket root
+	Prefix string
+}
+
+// IsS3Target reports if sync target is s3 bucket.
+func IsS3Target(target string) bool {
+	return strings.HasPrefix(target, "s3://")
+}
+
+// ParseS3Target parses s3://bucket/prefix target.
+func ParseS3Target(target string) (*S3Target, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(target, "s3://"), "/")
+	if !IsS3Target(target) || bucket == "" {
+		return nil, fmt.Errorf("s3 target %s should be s3://bucket/prefix", target)
+	}
+	prefix = strings.Trim(path.Clean("/"+prefix), "/")
+	return &S3Target{Bucket: bucket, Prefix: prefix}, nil
+}
+
+// key returns object key of the path relative to synced folder
+func (target *S3Target) key(relPath string) string {
+	if target.Prefix == "" {
+		return relPath
+	}
+	return target.Prefix + "/" + relPath
+}
+
+type s3Credentials struct {
+	AccessKey string
+	SecretKey string
+}
+
+// s3Client is minimal client of s3 compatible storage with path-style addressing
+type s3Client struct {
+	endpoint    *url.URL
+	region      string
+	credentials s3Credentials
+	httpClient  *http.Client
+}
+
+// readS3Secret reads key given as VAR:NAME or as path to file with it, empty source means envVarName env var
+func readS3Secret(source, envVarName string) (string, error) {
+	if source == "" {
+		source = "VAR:" + envVarName
+	}
+	if strings.HasPrefix(source, "VAR:") {
+		value := os.Getenv(strings.TrimPrefix(source, "VAR:"))
+		AddSecrets(value)
+		return value, nil
+	}
+	content, err := os.ReadFile(source)
+	if err != nil {
+		return "", fmt.Errorf("read s3 key file %s failed: %w", source, err)
+	}
+	AddSecrets(string(content))
+	return strings.TrimSpace(string(content)), nil
+}
+
+// NewS3Client returns client of s3_endpoint with credentials from config, files or env.
+func (synccfg *SyncConfig) NewS3Client() (*s3Client, error) {
+	endpoint := synccfg.S3_ENDPOINT
+	if !IsStringNotEmpty(endpoint) {
+		endpoint = defaultS3Endpoint
+	}
+	endpointURL, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || endpointURL.Host == "" {
+		return nil, fmt.Errorf("wrong s3 endpoint %s", endpoint)
+	}
+	region := synccfg.S3_REGION
+	if !IsStringNotEmpty(region) {
+		region = defaultS3Region
+	}
+	credentials := s3Credentials{}
+	if credentials.AccessKey, err = readS3Secret(synccfg.S3_ACCESS_KEY, "AWS_ACCESS_KEY_ID"); err != nil {
+		return nil, err
+	}
+	if credentials.SecretKey, err = readS3Secret(synccfg.S3_SECRET_KEY, "AWS_SECRET_ACCESS_KEY"); err != nil {
+		return nil, err
+	}
+	if credentials.AccessKey == "" || credentials.SecretKey == "" {
+		return nil, fmt.Errorf("s3 credentials are not set")
+	}
+	return &s3Client{
+		endpoint:    endpointURL,
+		region:      region,
+		credentials: credentials,
+		httpClient:  &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+// s3URIEncode encodes string as aws signature v4 requires - everything except unreserved characters
+func s3URIEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalS3Request builds canonical request of aws signature v4 from request and names of signed headers
+func canonicalS3Request(req *http.Request, signedHeaders []string, payloadHash string) string {
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	queryParts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			queryParts = append(queryParts, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		strings.Join(queryParts, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// sigV4Signature signs canonical request for s3 service
+func sigV4Signature(credentials s3Credentials, region, amzDate, canonicalRequest string) string {
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretKey), amzDate[:8])
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// signS3Request adds aws signature v4 to request, host and all headers set on request are signed
+func signS3Request(req *http.Request, credentials s3Credentials, region, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(sigV4TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host"}
+	for name := range req.Header {
+		signedHeaders = append(signedHeaders, strings.ToLower(name))
+	}
+	sort.Strings(signedHeaders)
+
+	signature := sigV4Signature(credentials, region, amzDate, canonicalS3Request(req, signedHeaders, payloadHash))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s/%s/s3/aws4_request, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, credentials.AccessKey, amzDate[:8], region, strings.Join(signedHeaders, ";"), signature))
+}
+
+// objectURL returns path-style url of the object (bucket url if key is empty)
+func (c *s3Client) objectURL(bucket, key string) *url.URL {
+	objectURL := *c.endpoint
+	objectURL.Path = c.endpoint.Path + "/" + bucket
+	if key != "" {
+		objectURL.Path += "/" + key
+	}
+	objectURL.RawPath = s3URIEncode(objectURL.Path, false)
+	return &objectURL
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (c *s3Client) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	signS3Request(req, c.credentials, c.region, payloadHash, time.Now())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var s3Err s3Error
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("s3 %s %s failed with status %s: %s (%s)", req.Method, req.URL.Path, resp.Status, s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("s3 %s %s failed with status %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+type s3Object struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+	ETag string `xml:"ETag"`
+}
+
+type s3ListBucketResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// ListObjects returns all objects with the key prefix
+func (c *s3Client) ListObjects(bucket, prefix string) ([]s3Object, error) {
+	objects := make([]s3Object, 0)
+	continuationToken := ""
+	emptyHash := sha256.Sum256(nil)
+	for {
+		listURL := c.objectURL(bucket, "")
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		listURL.RawQuery = query.Encode()
+		req, err := http.NewRequest(http.MethodGet, listURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req, hex.EncodeToString(emptyHash[:]))
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding s3 objects list failed: %w", err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// PutObject uploads local file as object, payloadHash is hex sha256 of the file
+func (c *s3Client) PutObject(bucket, key, filePath, payloadHash string, headers map[string]string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, c.objectURL(bucket, key).String(), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := c.do(req, payloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// HeadObject returns headers stored with the object
+func (c *s3Client) HeadObject(bucket, key string) (http.Header, error) {
+	req, err := http.NewRequest(http.MethodHead, c.objectURL(bucket, key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	emptyHash := sha256.Sum256(nil)
+	resp, err := c.do(req, hex.EncodeToString(emptyHash[:]))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp.Header, nil
+}
+
+func (c *s3Client) DeleteObject(bucket, key string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.objectURL(bucket, key).String(), nil)
+	if err != nil {
+		return err
+	}
+	emptyHash := sha256.Sum256(nil)
+	resp, err := c.do(req, hex.EncodeToString(emptyHash[:]))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// fileDigests returns hex sha256 (for signing) and md5 (to compare with ETag) of file in one pass
+func fileDigests(filePath string) (string, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	sha256Hash, md5Hash := sha256.New(), md5.New()
+	if _, err = io.Copy(io.MultiWriter(sha256Hash, md5Hash), file); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(sha256Hash.Sum(nil)), hex.EncodeToString(md5Hash.Sum(nil)), nil
+}
+
+// s3ContentType detects content type by file extension or, if it is unknown, by content
+func s3ContentType(filePath string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(filePath)); contentType != "" {
+		return contentType
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	return http.DetectContentType(head[:n])
+}
+
+// s3CacheControl returns value of the first cache control rule matching path
+func s3CacheControl(rules []S3CacheControlRule, relPath string) string {
+	for _, rule := range rules {
+		if matchSyncPatterns([]string{rule.PATTERN}, relPath) {
+			return rule.VALUE
+		}
+	}
+	return ""
+}
+
+// SyncFoldersToS3 makes objects under target prefix the same as files of source folder. Objects are compared
+// with files by size and md5 (ETag of single part upload) and by cache control, so only changed files are uploaded. Stale objects are
+// deleted after all files are uploaded. Symlinks to files are uploaded as files, folders are not objects in s3.
+func SyncFoldersToS3(client *s3Client, sourcePath string, target *S3Target, options SyncOptions,
+	cacheControlRules []S3CacheControlRule) (*SyncSummary, error) {
+
+	summary := &SyncSummary{}
+	sourcePath = filepath.Clean(sourcePath)
+	entries, _, err := collectSyncEntries(sourcePath, options)
+	if err != nil {
+		return summary, err
+	}
+
+	listPrefix := target.Prefix
+	if listPrefix != "" {
+		listPrefix += "/"
+	}
+	objects, err := client.ListObjects(target.Bucket, listPrefix)
+	if err != nil {
+		return summary, err
+	}
+	existing := make(map[string]s3Object, len(objects))
+	for _, object := range objects {
+		existing[object.Key] = object
+	}
+
+	uploaded := make(map[string]bool)
+	for _, entry := range entries {
+		filePath := filepath.Join(sourcePath, filepath.FromSlash(entry.path))
+		info, err := os.Stat(filePath)
+		if err != nil || !info.Mode().IsRegular() {
+			// folders, broken links and links to folders
+			continue
+		}
+		key := target.key(entry.path)
+		uploaded[key] = true
+		sha256Hex, md5Hex, err := fileDigests(filePath)
+		if err != nil {
+			return summary, err
+		}
+		cacheControl := s3CacheControl(cacheControlRules, entry.path)
+		object, exists := existing[key]
+		if exists && object.Size == info.Size() && strings.Trim(object.ETag, `"`) == md5Hex {
+			// listing has no headers, object with the same content is uploaded again if cache control rules are changed
+			stored, err := client.HeadObject(target.Bucket, key)
+			if err != nil {
+				return summary, fmt.Errorf("reading headers of %s failed: %w", entry.path, err)
+			}
+			if stored.Get("Cache-Control") == cacheControl {
+				summary.Unchanged++
+				continue
+			}
+		}
+		headers := map[string]string{"Content-Type": s3ContentType(filePath)}
+		if cacheControl != "" {
+			headers["Cache-Control"] = cacheControl
+		}
+		if err = client.PutObject(target.Bucket, key, filePath, sha256Hex, headers); err != nil {
+			return summary, fmt.Errorf("uploading %s failed: %w", entry.path, err)
+		}
+		addChanged(summary, entry.path, exists)
+	}
+
+	if options.Delete {
+		for _, object := range objects {
+			relPath := strings.TrimPrefix(object.Key, listPrefix)
+			if uploaded[object.Key] || options.isFiltered(relPath) {
+				continue
+			}
+			if err = client.DeleteObject(target.Bucket, object.Key); err != nil {
+				return summary, fmt.Errorf("deleting %s failed: %w", object.Key, err)
+			}
+			summary.Deleted = append(summary.Deleted, relPath)
+		}
+	}
+	return summary, nil
+}
@@ -0,0 +1,931 @@
+package cdddru
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	xssh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// packet types and codes of sftp protocol version 3 (draft-ietf-secsh-filexfer-02),
+// only ones needed to sync files are implemented
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpOpen          = 3
+	sshFxpClose         = 4
+	sshFxpRead          = 5
+	sshFxpWrite         = 6
+	sshFxpLstat         = 7
+	sshFxpSetstat       = 9
+	sshFxpOpendir       = 11
+	sshFxpReaddir       = 12
+	sshFxpRemove        = 13
+	sshFxpMkdir         = 14
+	sshFxpRmdir         = 15
+	sshFxpRename        = 18
+	sshFxpReadlink      = 19
+	sshFxpSymlink       = 20
+	sshFxpStatus        = 101
+	sshFxpHandle        = 102
+	sshFxpData          = 103
+	sshFxpName          = 104
+	sshFxpAttrs         = 105
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+
+	sshFxOk               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxFailure          = 4
+
+	sshFxfRead  = 0x01
+	sshFxfWrite = 0x02
+	sshFxfCreat = 0x08
+	sshFxfTrunc = 0x10
+
+	sshFileXferAttrSize        = 0x01
+	sshFileXferAttrPermissions = 0x04
+	sshFileXferAttrAcModTime   = 0x08
+
+	sftpProtocolVersion = 3
+	sftpPosixRename     = "posix-rename@openssh.com"
+	// servers must accept packets up to 34000 bytes, so data is sent by smaller chunks
+	sftpChunkSize = 32768
+	// posix file type bits of sftp permissions
+	sftpModeType    = 0170000
+	sftpModeDir     = 0040000
+	sftpModeRegular = 0100000
+	sftpModeSymlink = 0120000
+)
+
+// SftpTarget is sync target given as sftp://user@host[:port]/path
+type SftpTarget struct {
+	User string
+	// host:port
+	Address string
+	Path    string
+}
+
+// IsSftpTarget reports if sync target is remote one.
+func IsSftpTarget(target string) bool {
+	return strings.HasPrefix(target, "sftp://")
+}
+
+// ParseSftpTarget parses sftp://user@host[:port]/path target, port 22 is used by default.
+func ParseSftpTarget(target string) (*SftpTarget, error) {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("parsing sftp target %s failed: %w", target, err)
+	}
+	if parsed.Scheme != "sftp" || parsed.Hostname() == "" || parsed.User == nil || parsed.User.Username() == "" {
+		return nil, fmt.Errorf("sftp target %s should be sftp://user@host[:port]/path", target)
+	}
+	if _, hasPassword := parsed.User.Password(); hasPassword {
+		return nil, fmt.Errorf("sftp target %s should not contain password - only key auth is supported", parsed.Redacted())
+	}
+	if parsed.Path == "" || parsed.Path == "/" {
+		return nil, fmt.Errorf("sftp target %s should contain path other than root", target)
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = "22"
+	}
+	return &SftpTarget{
+		User:    parsed.User.Username(),
+		Address: net.JoinHostPort(parsed.Hostname(), port),
+		Path:    path.Clean(parsed.Path),
+	}, nil
+}
+
+// sftpPrivateKey reads key for sftp targets: sftp_private_key or, if empty, git_private_key.
+// Key can be given by environment variable as VAR:NAME like git_private_key.
+func (synccfg *SyncConfig) sftpPrivateKey() (xssh.Signer, error) {
+	keySource := synccfg.SFTP_PRIVATE_KEY
+	if !IsStringNotEmpty(keySource) && synccfg.parentLink != nil {
+		keySource = synccfg.parentLink.GIT.GIT_PRIVATE_KEY
+	}
+	var rawKey []byte
+	var err error
+	if strings.HasPrefix(keySource, "VAR:") {
+		varName := strings.TrimPrefix(keySource, "VAR:")
+		if rawKey = []byte(os.Getenv(varName)); len(rawKey) == 0 {
+			return nil, fmt.Errorf("sftp private key given by var %s is empty", varName)
+		}
+	} else {
+		rawKey, err = os.ReadFile(keySource)
+		if err != nil {
+			return nil, fmt.Errorf("read sftp private key file %s failed: %w", keySource, err)
+		}
+	}
+	AddSecrets(string(rawKey))
+	signer, err := xssh.ParsePrivateKey(rawKey)
+	if err != nil {
+		return nil, fmt.Errorf("parsing sftp private key failed: %w", err)
+	}
+	return signer, nil
+}
+
+// sftpHostKeyCallback pins host key by sftp_host_key (SHA256 fingerprint or public key line) or checks it
+// in sftp_known_hosts (~/.ssh/known_hosts by default). Unknown hosts are never accepted.
+func (synccfg *SyncConfig) sftpHostKeyCallback() (xssh.HostKeyCallback, error) {
+	if pinned := strings.TrimSpace(synccfg.SFTP_HOST_KEY); pinned != "" {
+		var pinnedKey xssh.PublicKey
+		if !strings.HasPrefix(pinned, "SHA256:") {
+			key, _, _, _, err := xssh.ParseAuthorizedKey([]byte(pinned))
+			if err != nil {
+				return nil, fmt.Errorf("parsing sftp_host_key failed: %w", err)
+			}
+			pinnedKey = key
+		}
+		return func(hostname string, remote net.Addr, key xssh.PublicKey) error {
+			if pinnedKey != nil && bytes.Equal(key.Marshal(), pinnedKey.Marshal()) {
+				return nil
+			}
+			if pinnedKey == nil && xssh.FingerprintSHA256(key) == pinned {
+				return nil
+			}
+			return fmt.Errorf("host key %s of %s does not match pinned one", xssh.FingerprintSHA256(key), hostname)
+		}, nil
+	}
+
+	knownHostsFile := synccfg.SFTP_KNOWN_HOSTS
+	if !IsStringNotEmpty(knownHostsFile) {
+		knownHostsFile = filepath.Join(USER.HomeDir, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("sftp host key is not pinned: set sftp_host_key or sftp_known_hosts (%w)", err)
+	}
+	return callback, nil
+}
+
+// DialSftp connects to sftp target with key auth and pinned host key.
+func (synccfg *SyncConfig) DialSftp(target *SftpTarget) (*sftpClient, error) {
+	signer, err := synccfg.sftpPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := synccfg.sftpHostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := xssh.Dial("tcp", target.Address, &xssh.ClientConfig{
+		User:            target.User,
+		Auth:            []xssh.AuthMethod{xssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ssh connection to %s failed: %w", target.Address, err)
+	}
+	client, err := newSftpClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// SyncFoldersToSftp is SyncFolders for remote target. Hashes of uploaded files are kept in manifest in target folder,
+// so files of the same size are compared without downloading them.
+func SyncFoldersToSftp(client *sftpClient, sourcePath, targetPath string, options SyncOptions) (*SyncSummary, error) {
+	target, err := newSftpSyncTarget(client, path.Clean(targetPath))
+	if err != nil {
+		return nil, err
+	}
+	options.Exclude = append(append([]string{}, options.Exclude...), sftpManifestName)
+	summary, err := syncFoldersTo(target, sourcePath, target.root, options)
+	if saveErr := target.saveManifest(); err == nil && saveErr != nil {
+		err = fmt.Errorf("saving sync manifest failed: %w", saveErr)
+	}
+	return summary, err
+}
+
+// sftpManifestName is file in root of sftp target with hashes of synced files
+const sftpManifestName = ".cdddru-sync-manifest.json"
+
+// sftpManifestEntry is hash of file which is valid while size and modification time of the file are the same
+type sftpManifestEntry struct {
+	Hash    string `json:"sha256"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+// sftpSyncTarget is sftp client which keeps hashes of files written by it in manifest of target folder
+type sftpSyncTarget struct {
+	*sftpClient
+	root string
+	// keyed by path relative to root
+	manifest map[string]sftpManifestEntry
+}
+
+func newSftpSyncTarget(client *sftpClient, root string) (*sftpSyncTarget, error) {
+	target := &sftpSyncTarget{sftpClient: client, root: root, manifest: make(map[string]sftpManifestEntry)}
+	var content bytes.Buffer
+	err := client.readFile(path.Join(root, sftpManifestName), &content)
+	if errors.Is(err, fs.ErrNotExist) {
+		return target, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading sync manifest failed: %w", err)
+	}
+	// broken manifest only makes files to be compared by download
+	json.Unmarshal(content.Bytes(), &target.manifest)
+	return target, nil
+}
+
+func (t *sftpSyncTarget) relPath(p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(p, t.root), "/")
+}
+
+func (t *sftpSyncTarget) saveManifest() error {
+	content, err := json.Marshal(t.manifest)
+	if err != nil {
+		return err
+	}
+	return t.sftpClient.WriteFile(path.Join(t.root, sftpManifestName), bytes.NewReader(content), 0644)
+}
+
+// Hash returns hash from manifest if file has not changed since it was recorded, otherwise file is downloaded
+func (t *sftpSyncTarget) Hash(p string) ([]byte, error) {
+	info, err := t.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	if entry, ok := t.manifest[t.relPath(p)]; ok && entry.Size == info.Size() && entry.ModTime == info.ModTime().Unix() {
+		if hash, err := hex.DecodeString(entry.Hash); err == nil {
+			return hash, nil
+		}
+	}
+	hash, err := t.sftpClient.Hash(p)
+	if err != nil {
+		return nil, err
+	}
+	t.manifest[t.relPath(p)] = sftpManifestEntry{Hash: hex.EncodeToString(hash), Size: info.Size(), ModTime: info.ModTime().Unix()}
+	return hash, nil
+}
+
+// WriteFile uploads file and records its hash, modification time is recorded by Chtimes
+func (t *sftpSyncTarget) WriteFile(p string, rd io.Reader, perm fs.FileMode) error {
+	delete(t.manifest, t.relPath(p))
+	hash := sha256.New()
+	counter := &byteCounter{}
+	if err := t.sftpClient.WriteFile(p, io.TeeReader(rd, io.MultiWriter(hash, counter)), perm); err != nil {
+		return err
+	}
+	t.manifest[t.relPath(p)] = sftpManifestEntry{Hash: hex.EncodeToString(hash.Sum(nil)), Size: counter.n, ModTime: -1}
+	return nil
+}
+
+func (t *sftpSyncTarget) Chtimes(p string, mtime time.Time) error {
+	if err := t.sftpClient.Chtimes(p, mtime); err != nil {
+		return err
+	}
+	if entry, ok := t.manifest[t.relPath(p)]; ok {
+		entry.ModTime = mtime.Unix()
+		t.manifest[t.relPath(p)] = entry
+	}
+	return nil
+}
+
+func (t *sftpSyncTarget) Remove(p string) error {
+	delete(t.manifest, t.relPath(p))
+	return t.sftpClient.Remove(p)
+}
+
+func (t *sftpSyncTarget) RemoveAll(p string) error {
+	rel := t.relPath(p)
+	for name := range t.manifest {
+		if name == rel || strings.HasPrefix(name, rel+"/") {
+			delete(t.manifest, name)
+		}
+	}
+	return t.sftpClient.RemoveAll(p)
+}
+
+// byteCounter counts bytes written to it
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+type sftpStatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp error %d: %s", e.Code, e.Message)
+}
+
+// Is makes errors.Is(err, fs.ErrNotExist) work for remote files like for local ones
+func (e *sftpStatusError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Code == sshFxNoSuchFile
+	case fs.ErrPermission:
+		return e.Code == sshFxPermissionDenied
+	}
+	return false
+}
+
+// sftpBuffer builds packet payload
+type sftpBuffer struct {
+	bytes.Buffer
+}
+
+func (b *sftpBuffer) uint32(v uint32) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func (b *sftpBuffer) uint64(v uint64) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func (b *sftpBuffer) string(s string) {
+	b.uint32(uint32(len(s)))
+	b.WriteString(s)
+}
+
+func (b *sftpBuffer) attrs(attrs sftpAttrs) {
+	b.uint32(attrs.Flags)
+	if attrs.Flags&sshFileXferAttrSize != 0 {
+		b.uint64(attrs.Size)
+	}
+	if attrs.Flags&sshFileXferAttrPermissions != 0 {
+		b.uint32(attrs.Mode)
+	}
+	if attrs.Flags&sshFileXferAttrAcModTime != 0 {
+		b.uint32(attrs.Atime)
+		b.uint32(attrs.Mtime)
+	}
+}
+
+// sftpReader parses packet payload, the first error is kept and all following reads return zero values
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if r.err != nil || len(r.data) < 4 {
+		r.err = errors.New("sftp packet is too short")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if r.err != nil || len(r.data) < 8 {
+		r.err = errors.New("sftp packet is too short")
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *sftpReader) string() string {
+	length := r.uint32()
+	if r.err != nil || uint32(len(r.data)) < length {
+		r.err = errors.New("sftp packet is too short")
+		return ""
+	}
+	s := string(r.data[:length])
+	r.data = r.data[length:]
+	return s
+}
+
+func (r *sftpReader) attrs() sftpAttrs {
+	attrs := sftpAttrs{Flags: r.uint32()}
+	if attrs.Flags&sshFileXferAttrSize != 0 {
+		attrs.Size = r.uint64()
+	}
+	if attrs.Flags&0x02 != 0 {
+		// uid and gid are not used
+		r.uint32()
+		r.uint32()
+	}
+	if attrs.Flags&sshFileXferAttrPermissions != 0 {
+		attrs.Mode = r.uint32()
+	}
+	if attrs.Flags&sshFileXferAttrAcModTime != 0 {
+		attrs.Atime = r.uint32()
+		attrs.Mtime = r.uint32()
+	}
+	if attrs.Flags&0x80000000 != 0 {
+		for count := r.uint32(); count > 0 && r.err == nil; count-- {
+			r.string()
+			r.string()
+		}
+	}
+	return attrs
+}
+
+func writeSftpPacket(w io.Writer, packetType byte, payload []byte) error {
+	packet := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(packet, uint32(len(payload)+1))
+	packet[4] = packetType
+	_, err := w.Write(append(packet, payload...))
+	return err
+}
+
+func readSftpPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 1 || length > 256*1024 {
+		return 0, nil, fmt.Errorf("wrong sftp packet length %d", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+type sftpAttrs struct {
+	Flags uint32
+	Size  uint64
+	Mode  uint32
+	Atime uint32
+	Mtime uint32
+}
+
+// sftpFileInfo is fs.FileInfo of remote file
+type sftpFileInfo struct {
+	name  string
+	attrs sftpAttrs
+}
+
+func (fi *sftpFileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *sftpFileInfo) Size() int64 {
+	return int64(fi.attrs.Size)
+}
+
+func (fi *sftpFileInfo) ModTime() time.Time {
+	return time.Unix(int64(fi.attrs.Mtime), 0)
+}
+
+func (fi *sftpFileInfo) IsDir() bool {
+	return fi.Mode().IsDir()
+}
+
+func (fi *sftpFileInfo) Sys() any {
+	return fi.attrs
+}
+
+func (fi *sftpFileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(fi.attrs.Mode & 0777)
+	switch fi.attrs.Mode & sftpModeType {
+	case sftpModeDir:
+		mode |= fs.ModeDir
+	case sftpModeSymlink:
+		mode |= fs.ModeSymlink
+	case sftpModeRegular:
+	default:
+		mode |= fs.ModeIrregular
+	}
+	return mode
+}
+
+// sftpClient is minimal sequential sftp client, it implements syncTarget for remote folders.
+// It has one request in flight at a time, so uploads are bound by latency of the link rather than its bandwidth,
+// and it speaks protocol version 3 where mtimes are 32-bit unsigned seconds.
+// Replacing files is atomic only with posix-rename extension, see Rename.
+type sftpClient struct {
+	conn       *xssh.Client
+	session    *xssh.Session
+	stdin      io.WriteCloser
+	stdout     io.Reader
+	mu         sync.Mutex
+	nextID     uint32
+	extensions map[string]string
+}
+
+func newSftpClient(conn *xssh.Client) (*sftpClient, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("opening ssh session failed: %w", err)
+	}
+	client := &sftpClient{conn: conn, session: session, extensions: make(map[string]string)}
+	if client.stdin, err = session.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if client.stdout, err = session.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err = session.RequestSubsystem("sftp"); err != nil {
+		return nil, fmt.Errorf("starting sftp subsystem failed: %w", err)
+	}
+
+	var init sftpBuffer
+	init.uint32(sftpProtocolVersion)
+	if err = writeSftpPacket(client.stdin, sshFxpInit, init.Bytes()); err != nil {
+		return nil, err
+	}
+	packetType, payload, err := readSftpPacket(client.stdout)
+	if err != nil {
+		return nil, fmt.Errorf("sftp handshake failed: %w", err)
+	}
+	if packetType != sshFxpVersion {
+		return nil, fmt.Errorf("sftp handshake failed: unexpected packet %d", packetType)
+	}
+	rd := &sftpReader{data: payload}
+	if version := rd.uint32(); version != sftpProtocolVersion {
+		return nil, fmt.Errorf("sftp protocol version %d is not supported", version)
+	}
+	for len(rd.data) > 0 && rd.err == nil {
+		name := rd.string()
+		client.extensions[name] = rd.string()
+	}
+	return client, rd.err
+}
+
+func (c *sftpClient) Close() error {
+	c.session.Close()
+	return c.conn.Close()
+}
+
+// request sends request and returns type and payload (after request id) of the response
+func (c *sftpClient) request(packetType byte, build func(b *sftpBuffer)) (byte, *sftpReader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	id := c.nextID
+	var b sftpBuffer
+	b.uint32(id)
+	build(&b)
+	if err := writeSftpPacket(c.stdin, packetType, b.Bytes()); err != nil {
+		return 0, nil, err
+	}
+	responseType, payload, err := readSftpPacket(c.stdout)
+	if err != nil {
+		return 0, nil, err
+	}
+	rd := &sftpReader{data: payload}
+	if responseID := rd.uint32(); responseID != id {
+		return 0, nil, fmt.Errorf("sftp response id %d does not match request id %d", responseID, id)
+	}
+	return responseType, rd, rd.err
+}
+
+// statusError returns error of status response, nil for OK status
+func statusError(responseType byte, rd *sftpReader) error {
+	if responseType != sshFxpStatus {
+		return fmt.Errorf("unexpected sftp response %d", responseType)
+	}
+	code := rd.uint32()
+	message := rd.string()
+	if rd.err != nil {
+		return rd.err
+	}
+	if code == sshFxOk {
+		return nil
+	}
+	return &sftpStatusError{Code: code, Message: message}
+}
+
+func (c *sftpClient) requestStatus(packetType byte, build func(b *sftpBuffer)) error {
+	responseType, rd, err := c.request(packetType, build)
+	if err != nil {
+		return err
+	}
+	return statusError(responseType, rd)
+}
+
+func (c *sftpClient) requestHandle(packetType byte, build func(b *sftpBuffer)) (string, error) {
+	responseType, rd, err := c.request(packetType, build)
+	if err != nil {
+		return "", err
+	}
+	if responseType != sshFxpHandle {
+		return "", statusError(responseType, rd)
+	}
+	handle := rd.string()
+	return handle, rd.err
+}
+
+func (c *sftpClient) closeHandle(handle string) error {
+	return c.requestStatus(sshFxpClose, func(b *sftpBuffer) { b.string(handle) })
+}
+
+func (c *sftpClient) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+func (c *sftpClient) Lstat(p string) (fs.FileInfo, error) {
+	responseType, rd, err := c.request(sshFxpLstat, func(b *sftpBuffer) { b.string(p) })
+	if err != nil {
+		return nil, err
+	}
+	if responseType != sshFxpAttrs {
+		return nil, statusError(responseType, rd)
+	}
+	attrs := rd.attrs()
+	return &sftpFileInfo{name: path.Base(p), attrs: attrs}, rd.err
+}
+
+func (c *sftpClient) ReadDir(p string) ([]fs.FileInfo, error) {
+	handle, err := c.requestHandle(sshFxpOpendir, func(b *sftpBuffer) { b.string(p) })
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(handle)
+
+	infos := make([]fs.FileInfo, 0)
+	for {
+		responseType, rd, err := c.request(sshFxpReaddir, func(b *sftpBuffer) { b.string(handle) })
+		if err != nil {
+			return nil, err
+		}
+		if responseType != sshFxpName {
+			err = statusError(responseType, rd)
+			var statusErr *sftpStatusError
+			if errors.As(err, &statusErr) && statusErr.Code == sshFxEOF {
+				return infos, nil
+			}
+			return nil, err
+		}
+		for count := rd.uint32(); count > 0 && rd.err == nil; count-- {
+			name := rd.string()
+			rd.string() // long name
+			attrs := rd.attrs()
+			if name != "." && name != ".." {
+				infos = append(infos, &sftpFileInfo{name: name, attrs: attrs})
+			}
+		}
+		if rd.err != nil {
+			return nil, rd.err
+		}
+	}
+}
+
+func (c *sftpClient) Mkdir(p string, perm fs.FileMode) error {
+	return c.requestStatus(sshFxpMkdir, func(b *sftpBuffer) {
+		b.string(p)
+		b.attrs(sftpAttrs{Flags: sshFileXferAttrPermissions, Mode: uint32(perm.Perm())})
+	})
+}
+
+func (c *sftpClient) MkdirAll(p string, perm fs.FileMode) error {
+	info, err := c.Lstat(p)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a folder", p)
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if parent := path.Dir(p); parent != p {
+		if err = c.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	return c.Mkdir(p, perm)
+}
+
+func (c *sftpClient) setstat(p string, attrs sftpAttrs) error {
+	return c.requestStatus(sshFxpSetstat, func(b *sftpBuffer) {
+		b.string(p)
+		b.attrs(attrs)
+	})
+}
+
+func (c *sftpClient) Chmod(p string, perm fs.FileMode) error {
+	return c.setstat(p, sftpAttrs{Flags: sshFileXferAttrPermissions, Mode: uint32(perm.Perm())})
+}
+
+func (c *sftpClient) Chtimes(p string, mtime time.Time) error {
+	return c.setstat(p, sftpAttrs{Flags: sshFileXferAttrAcModTime, Atime: uint32(mtime.Unix()), Mtime: uint32(mtime.Unix())})
+}
+
+func (c *sftpClient) Remove(p string) error {
+	return c.requestStatus(sshFxpRemove, func(b *sftpBuffer) { b.string(p) })
+}
+
+func (c *sftpClient) RemoveAll(p string) error {
+	info, err := c.Lstat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return c.Remove(p)
+	}
+	infos, err := c.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, child := range infos {
+		if err = c.RemoveAll(path.Join(p, child.Name())); err != nil {
+			return err
+		}
+	}
+	return c.requestStatus(sshFxpRmdir, func(b *sftpBuffer) { b.string(p) })
+}
+
+// Rename replaces newPath atomically if server supports posix-rename extension (OpenSSH does).
+// Otherwise plain rename is tried, which replaces newPath on some servers. If it fails as newPath exists,
+// existing newPath is renamed aside, oldPath is renamed into its place and only then the old copy is removed;
+// that fallback is NOT atomic - newPath is missing for a moment between two renames,
+// and it is restored if oldPath can not be renamed.
+func (c *sftpClient) Rename(oldPath, newPath string) error {
+	if _, ok := c.extensions[sftpPosixRename]; ok {
+		return c.requestStatus(sshFxpExtended, func(b *sftpBuffer) {
+			b.string(sftpPosixRename)
+			b.string(oldPath)
+			b.string(newPath)
+		})
+	}
+	rename := func(from, to string) error {
+		return c.requestStatus(sshFxpRename, func(b *sftpBuffer) {
+			b.string(from)
+			b.string(to)
+		})
+	}
+	err := rename(oldPath, newPath)
+	if err == nil {
+		return nil
+	}
+	// plain rename of protocol version 3 fails when newPath exists - anything else is a real error
+	if _, statErr := c.Lstat(oldPath); statErr != nil {
+		return err
+	}
+	if _, statErr := c.Lstat(newPath); statErr != nil {
+		return err
+	}
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	asidePath := path.Join(path.Dir(newPath), "."+path.Base(newPath)+".old-"+hex.EncodeToString(suffix))
+	if err = rename(newPath, asidePath); err != nil {
+		return err
+	}
+	if err = rename(oldPath, newPath); err != nil {
+		if restoreErr := rename(asidePath, newPath); restoreErr != nil {
+			return fmt.Errorf("%w (restoring %s failed: %v)", err, newPath, restoreErr)
+		}
+		return err
+	}
+	return c.Remove(asidePath)
+}
+
+// Symlink creates symlink p pointing to linkTarget. Arguments are sent in OpenSSH order (target first),
+// which is reversed in comparison with the draft, but is what servers actually implement.
+func (c *sftpClient) Symlink(linkTarget, p string) error {
+	return c.requestStatus(sshFxpSymlink, func(b *sftpBuffer) {
+		b.string(linkTarget)
+		b.string(p)
+	})
+}
+
+func (c *sftpClient) Readlink(p string) (string, error) {
+	responseType, rd, err := c.request(sshFxpReadlink, func(b *sftpBuffer) { b.string(p) })
+	if err != nil {
+		return "", err
+	}
+	if responseType != sshFxpName {
+		return "", statusError(responseType, rd)
+	}
+	if count := rd.uint32(); count != 1 && rd.err == nil {
+		return "", fmt.Errorf("unexpected sftp readlink response with %d names", count)
+	}
+	linkTarget := rd.string()
+	return linkTarget, rd.err
+}
+
+// WriteFile uploads file next to target and renames it, so readers never see half written file
+func (c *sftpClient) WriteFile(p string, rd io.Reader, perm fs.FileMode) error {
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	tmpPath := path.Join(path.Dir(p), "."+path.Base(p)+".tmp-"+hex.EncodeToString(suffix))
+
+	handle, err := c.requestHandle(sshFxpOpen, func(b *sftpBuffer) {
+		b.string(tmpPath)
+		b.uint32(sshFxfWrite | sshFxfCreat | sshFxfTrunc)
+		b.attrs(sftpAttrs{Flags: sshFileXferAttrPermissions, Mode: uint32(perm.Perm())})
+	})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, sftpChunkSize)
+	var offset uint64
+	for err == nil {
+		var n int
+		n, err = io.ReadFull(rd, buf)
+		if n > 0 {
+			chunk := buf[:n]
+			if writeErr := c.requestStatus(sshFxpWrite, func(b *sftpBuffer) {
+				b.string(handle)
+				b.uint64(offset)
+				b.string(string(chunk))
+			}); writeErr != nil {
+				err = writeErr
+				break
+			}
+			offset += uint64(n)
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if closeErr := c.closeHandle(handle); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// permissions given on open are masked by server umask
+		err = c.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = c.Rename(tmpPath, p)
+	}
+	if err != nil {
+		c.Remove(tmpPath)
+	}
+	return err
+}
+
+// Hash downloads file and returns its sha256
+func (c *sftpClient) Hash(p string) ([]byte, error) {
+	hash := sha256.New()
+	if err := c.readFile(p, hash); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// readFile downloads file into w
+func (c *sftpClient) readFile(p string, w io.Writer) error {
+	handle, err := c.requestHandle(sshFxpOpen, func(b *sftpBuffer) {
+		b.string(p)
+		b.uint32(sshFxfRead)
+		b.attrs(sftpAttrs{})
+	})
+	if err != nil {
+		return err
+	}
+	defer c.closeHandle(handle)
+
+	var offset uint64
+	for {
+		responseType, rd, err := c.request(sshFxpRead, func(b *sftpBuffer) {
+			b.string(handle)
+			b.uint64(offset)
+			b.uint32(sftpChunkSize)
+		})
+		if err != nil {
+			return err
+		}
+		if responseType != sshFxpData {
+			err = statusError(responseType, rd)
+			var statusErr *sftpStatusError
+			if errors.As(err, &statusErr) && statusErr.Code == sshFxEOF {
+				return nil
+			}
+			return err
+		}
+		data := rd.string()
+		if rd.err != nil {
+			return rd.err
+		}
+		if _, err = w.Write([]byte(data)); err != nil {
+			return err
+		}
+		offset += uint64(len(data))
+	}
+}
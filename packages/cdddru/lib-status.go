@@ -0,0 +1,202 @@
+package cdddru
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	JobStateLoading   = "loading"
+	JobStateWaiting   = "waiting"
+	JobStateUpgrading = "upgrading"
+	JobStateSuspended = "suspended"
+	JobStateStopped   = "stopped"
+
+	RunOutcomeSucceeded = "succeeded"
+	RunOutcomePending   = "pending"
+	RunOutcomeFailed    = "failed"
+
+	// how many runs are kept in history of job
+	jobHistorySize = 20
+)
+
+// JobSummary is part of job config shown by status api
+type JobSummary struct {
+	JobPath       string   `json:"job_path"`
+	RepoURL       string   `json:"repo_url,omitempty"`
+	Branch        string   `json:"branch,omitempty"`
+	TagPrefix     string   `json:"tag_prefix,omitempty"`
+	MaxTag        string   `json:"max_tag,omitempty"`
+	CheckInterval int      `json:"check_interval"`
+	Steps         []string `json:"steps"`
+	Namespace     string   `json:"namespace,omitempty"`
+	Deployment    string   `json:"deployment,omitempty"`
+}
+
+// RunRecord is outcome of one release run of job
+type RunRecord struct {
+	Release  string    `json:"release"`
+	Outcome  string    `json:"outcome"`
+	Summary  string    `json:"summary,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// JobStatus is state of job shown by status api, it is kept while process lives even if job is restarted
+type JobStatus struct {
+	mu         sync.Mutex
+	Name       string      `json:"name"`
+	Active     bool        `json:"active"`
+	State      string      `json:"state"`
+	Config     JobSummary  `json:"config"`
+	CurrentTag string      `json:"current_tag,omitempty"`
+	TargetTag  string      `json:"target_tag,omitempty"`
+	LastCheck  *time.Time  `json:"last_check,omitempty"`
+	NextCheck  *time.Time  `json:"next_check,omitempty"`
+	LastRun    *RunRecord  `json:"last_run,omitempty"`
+	History    []RunRecord `json:"history"`
+}
+
+var statusRegistry = struct {
+	sync.Mutex
+	jobs map[string]*JobStatus
+	// all jobs are loaded and their goroutines are started
+	scheduled bool
+}{jobs: make(map[string]*JobStatus)}
+
+// GetJobStatus returns status of job by its name, status is created on first call
+func GetJobStatus(jobName string) *JobStatus {
+	statusRegistry.Lock()
+	defer statusRegistry.Unlock()
+	s, ok := statusRegistry.jobs[jobName]
+	if !ok {
+		s = &JobStatus{Name: jobName, State: JobStateLoading, History: make([]RunRecord, 0)}
+		statusRegistry.jobs[jobName] = s
+	}
+	return s
+}
+
+// SetJobsScheduled registers loaded jobs and marks them scheduled - from now the process is ready
+func SetJobsScheduled(configs []*Config) {
+	for _, config := range configs {
+		GetJobStatus(config.COMMON.JOB_NAME).SetConfig(config)
+	}
+	statusRegistry.Lock()
+	defer statusRegistry.Unlock()
+	statusRegistry.scheduled = true
+}
+
+// IsReady tells all jobs are loaded and scheduled and every job has started
+func IsReady() bool {
+	statusRegistry.Lock()
+	defer statusRegistry.Unlock()
+	if !statusRegistry.scheduled {
+		return false
+	}
+	for _, s := range statusRegistry.jobs {
+		s.mu.Lock()
+		state := s.State
+		s.mu.Unlock()
+		if state == JobStateLoading {
+			return false
+		}
+	}
+	return true
+}
+
+// JobStatuses returns copies of statuses of all jobs sorted by name
+func JobStatuses() []*JobStatus {
+	statusRegistry.Lock()
+	jobs := make([]*JobStatus, 0, len(statusRegistry.jobs))
+	for _, s := range statusRegistry.jobs {
+		jobs = append(jobs, s)
+	}
+	statusRegistry.Unlock()
+
+	statuses := make([]*JobStatus, 0, len(jobs))
+	for _, s := range jobs {
+		s.mu.Lock()
+		statuses = append(statuses, &JobStatus{
+			Name:       s.Name,
+			Active:     s.Active,
+			State:      s.State,
+			Config:     s.Config,
+			CurrentTag: s.CurrentTag,
+			TargetTag:  s.TargetTag,
+			LastCheck:  s.LastCheck,
+			NextCheck:  s.NextCheck,
+			LastRun:    s.LastRun,
+			History:    append([]RunRecord{}, s.History...),
+		})
+		s.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// SetConfig updates config summary of job
+func (s *JobStatus) SetConfig(config *Config) {
+	steps := make([]string, 0)
+	for _, step := range config.Pipeline() {
+		steps = append(steps, step.Name())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Active = config.COMMON.IS_ACTIVE
+	s.Config = JobSummary{
+		JobPath:       config.COMMON.JOB_PATH,
+		RepoURL:       Redact(config.GIT.GIT_REPO_URL),
+		Branch:        config.GIT.GIT_BRANCH,
+		TagPrefix:     config.GIT.GIT_TAG_PREFIX,
+		MaxTag:        config.GIT.GIT_MAX_TAG,
+		CheckInterval: config.COMMON.CHECK_INTERVAL,
+		Steps:         steps,
+		Namespace:     config.DEPLOY.NAMESPACE_K8s,
+		Deployment:    config.DEPLOY.DEPLOYMENT_NAME_K8s,
+	}
+}
+
+// SetState sets state of job: waiting, upgrading, suspended or stopped
+func (s *JobStatus) SetState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.State = state
+	if state == JobStateSuspended {
+		s.Active = false
+	}
+}
+
+// SetCurrentTag sets tag job has deployed or started from
+func (s *JobStatus) SetCurrentTag(tag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.CurrentTag = tag
+}
+
+// Checked records check for new release, target tag is the max tag found
+func (s *JobStatus) Checked(targetTag string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastCheck, s.TargetTag = &now, targetTag
+}
+
+// SetNextCheck records time of next check for new release
+func (s *JobStatus) SetNextCheck(next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.NextCheck = &next
+}
+
+// AddRun records outcome of release run and keeps it in history
+func (s *JobStatus) AddRun(record RunRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastRun = &record
+	s.History = append(s.History, record)
+	if len(s.History) > jobHistorySize {
+		s.History = s.History[len(s.History)-jobHistorySize:]
+	}
+}
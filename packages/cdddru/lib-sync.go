@@ -0,0 +1,728 @@
+package cdddru
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SyncOptions tunes SyncFolders behavior.
+type SyncOptions struct {
+	// remove files and folders in target which are absent in source
+	Delete bool
+	// glob patterns of paths to sync (all if empty), see SyncMapping for syntax
+	Include []string
+	// glob patterns of paths not to sync, such paths are not deleted in target either
+	Exclude []string
+}
+
+// isFiltered reports if path relative to sync root is left out by include or exclude patterns
+func (options SyncOptions) isFiltered(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	if matchSyncPatterns(options.Exclude, relPath) {
+		return true
+	}
+	return len(options.Include) > 0 && !matchSyncPatterns(options.Include, relPath)
+}
+
+// matchSyncPatterns reports if path or any of its parent folders matches any of patterns
+func matchSyncPatterns(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		for current := relPath; current != "." && current != ""; current = path.Dir(current) {
+			if matchSyncPattern(pattern, current) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchSyncPattern(pattern, relPath string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if !strings.Contains(pattern, "/") && !strings.Contains(pattern, "**") {
+		relPath = path.Base(relPath)
+	}
+	regex, err := syncPatternRegexp(pattern)
+	if err != nil {
+		return false
+	}
+	return regex.MatchString(relPath)
+}
+
+// syncPatternRegexp converts glob pattern into regular expression: ** matches any number of path elements,
+// * and ? match within one path element.
+func syncPatternRegexp(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			expr.WriteString("[^/]*")
+		case pattern[i] == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// SyncSummary describes what SyncFolders has changed in target, paths are relative to target.
+type SyncSummary struct {
+	Added     []string
+	Updated   []string
+	Deleted   []string
+	Unchanged int
+}
+
+func (summary *SyncSummary) String() string {
+	return fmt.Sprintf("added: %d, updated: %d, deleted: %d, unchanged: %d",
+		len(summary.Added), len(summary.Updated), len(summary.Deleted), summary.Unchanged)
+}
+
+// LogDetails prints summary and, at debug level, every changed path.
+func (summary *SyncSummary) LogDetails(logger *Logger) {
+	PrintInfo(logger, "sync summary: %s", summary)
+	for _, path := range summary.Added {
+		PrintDebug(logger, "added: %s", path)
+	}
+	for _, path := range summary.Updated {
+		PrintDebug(logger, "updated: %s", path)
+	}
+	for _, path := range summary.Deleted {
+		PrintDebug(logger, "deleted: %s", path)
+	}
+}
+
+type syncEntry struct {
+	path string
+	info fs.FileInfo
+}
+
+// syncTarget is file system SyncFolders writes into - local or remote one (sftp).
+// Paths are absolute paths of the target file system, missing paths are reported with fs.ErrNotExist.
+type syncTarget interface {
+	Join(elem ...string) string
+	Lstat(path string) (fs.FileInfo, error)
+	ReadDir(path string) ([]fs.FileInfo, error)
+	Mkdir(path string, perm fs.FileMode) error
+	MkdirAll(path string, perm fs.FileMode) error
+	Chmod(path string, perm fs.FileMode) error
+	Chtimes(path string, mtime time.Time) error
+	Remove(path string) error
+	RemoveAll(path string) error
+	Symlink(linkTarget, path string) error
+	Readlink(path string) (string, error)
+	// WriteFile replaces file with content of reader atomically
+	WriteFile(path string, rd io.Reader, perm fs.FileMode) error
+	// Hash returns sha256 of file content
+	Hash(path string) ([]byte, error)
+}
+
+// localSyncTarget writes into local file system
+type localSyncTarget struct{}
+
+func (localSyncTarget) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+func (localSyncTarget) Lstat(path string) (fs.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func (localSyncTarget) Mkdir(path string, perm fs.FileMode) error {
+	return os.Mkdir(path, perm)
+}
+
+func (localSyncTarget) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (localSyncTarget) Chmod(path string, perm fs.FileMode) error {
+	return os.Chmod(path, perm)
+}
+
+func (localSyncTarget) Chtimes(path string, mtime time.Time) error {
+	return os.Chtimes(path, mtime, mtime)
+}
+
+func (localSyncTarget) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (localSyncTarget) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (localSyncTarget) Symlink(linkTarget, path string) error {
+	return os.Symlink(linkTarget, path)
+}
+
+func (localSyncTarget) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+func (localSyncTarget) Hash(path string) ([]byte, error) {
+	return fileSHA256(path)
+}
+
+func (localSyncTarget) ReadDir(path string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// WriteFile writes file next to target and renames it, so readers never see half written file
+func (localSyncTarget) WriteFile(path string, rd io.Reader, perm fs.FileMode) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = io.Copy(tmpFile, rd)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpFile.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// SyncFolders makes content of targetPath the same as content of sourcePath (like "rsync -a --delete source/ target/").
+// Content of source is always synced into target itself, no matter if paths end with slash or not.
+// Files are compared by size and content hash, so only changed files are copied. Modes and modification
+// times are preserved, .git folders are never synced. Every file is replaced atomically.
+// If include patterns are given, folders are synced only when they match or contain matching paths.
+func SyncFolders(sourcePath, targetPath string, options SyncOptions) (*SyncSummary, error) {
+	return syncFoldersTo(localSyncTarget{}, sourcePath, filepath.Clean(targetPath), options)
+}
+
+func syncFoldersTo(target syncTarget, sourcePath, targetPath string, options SyncOptions) (*SyncSummary, error) {
+	summary := &SyncSummary{}
+	sourcePath = filepath.Clean(sourcePath)
+
+	sourceInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return summary, fmt.Errorf("sync source %s is not available: %w", sourcePath, err)
+	}
+	if !sourceInfo.IsDir() {
+		return summary, fmt.Errorf("sync source %s is not a folder", sourcePath)
+	}
+	if err = target.MkdirAll(targetPath, sourceInfo.Mode().Perm()); err != nil {
+		return summary, err
+	}
+
+	entries, sourcePaths, err := collectSyncEntries(sourcePath, options)
+	if err != nil {
+		return summary, err
+	}
+
+	if options.Delete {
+		if err = deleteExtraneous(target, targetPath, "", sourcePaths, options, summary); err != nil {
+			return summary, err
+		}
+	}
+
+	for _, entry := range entries {
+		err = syncOneEntry(target, filepath.Join(sourcePath, filepath.FromSlash(entry.path)), target.Join(targetPath, entry.path), entry, summary)
+		if err != nil {
+			return summary, fmt.Errorf("syncing %s failed: %w", entry.path, err)
+		}
+	}
+
+	// folder modification times are changed by files written inside, so they are set at last - deepest first
+	sort.SliceStable(entries, func(i, j int) bool {
+		return strings.Count(entries[i].path, "/") > strings.Count(entries[j].path, "/")
+	})
+	for _, entry := range entries {
+		if entry.info.IsDir() {
+			target.Chtimes(target.Join(targetPath, entry.path), entry.info.ModTime())
+		}
+	}
+	target.Chtimes(targetPath, sourceInfo.ModTime())
+	return summary, nil
+}
+
+// collectSyncEntries returns entries of source folder to sync (paths are slash separated and relative to source)
+// and set of their paths
+func collectSyncEntries(sourcePath string, options SyncOptions) ([]syncEntry, map[string]bool, error) {
+	entries := make([]syncEntry, 0)
+	sourcePaths := make(map[string]bool)
+	err := filepath.WalkDir(sourcePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == sourcePath {
+			return nil
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		relPath, _ := filepath.Rel(sourcePath, path)
+		relPath = filepath.ToSlash(relPath)
+		if matchSyncPatterns(options.Exclude, relPath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// folders are checked against include patterns when their content is known
+		if !d.IsDir() && options.isFiltered(relPath) {
+			return nil
+		}
+		entries = append(entries, syncEntry{path: relPath, info: info})
+		sourcePaths[relPath] = true
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading sync source %s failed: %w", sourcePath, err)
+	}
+	if len(options.Include) > 0 {
+		entries = pruneSyncFolders(entries, sourcePaths, options)
+	}
+	return entries, sourcePaths, nil
+}
+
+// pruneSyncFolders leaves out folders which neither match include patterns nor contain synced paths
+func pruneSyncFolders(entries []syncEntry, sourcePaths map[string]bool, options SyncOptions) []syncEntry {
+	neededFolders := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.info.IsDir() {
+			continue
+		}
+		for dir := path.Dir(entry.path); dir != "."; dir = path.Dir(dir) {
+			neededFolders[dir] = true
+		}
+	}
+	pruned := entries[:0]
+	for _, entry := range entries {
+		if entry.info.IsDir() && !neededFolders[entry.path] && options.isFiltered(entry.path) {
+			delete(sourcePaths, entry.path)
+			continue
+		}
+		pruned = append(pruned, entry)
+	}
+	return pruned
+}
+
+// deleteExtraneous removes from target folder everything that is absent in source except paths left out by patterns
+func deleteExtraneous(target syncTarget, targetPath, relFolder string, sourcePaths map[string]bool,
+	options SyncOptions, summary *SyncSummary) error {
+
+	infos, err := target.ReadDir(target.Join(targetPath, relFolder))
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		relPath := path.Join(relFolder, info.Name())
+		if sourcePaths[relPath] {
+			if info.IsDir() {
+				if err = deleteExtraneous(target, targetPath, relPath, sourcePaths, options, summary); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if matchSyncPatterns(options.Exclude, relPath) {
+			continue
+		}
+		if options.isFiltered(relPath) {
+			// folder itself is not included, but it can contain included paths
+			if info.IsDir() {
+				if err = deleteExtraneous(target, targetPath, relPath, sourcePaths, options, summary); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err = target.RemoveAll(target.Join(targetPath, relPath)); err != nil {
+			return err
+		}
+		summary.Deleted = append(summary.Deleted, relPath)
+	}
+	return nil
+}
+
+func syncOneEntry(target syncTarget, sourcePath, targetPath string, entry syncEntry, summary *SyncSummary) error {
+	sourceInfo := entry.info
+	targetInfo, err := target.Lstat(targetPath)
+	targetExists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// different kind of entry in target (file instead of folder etc.) is replaced entirely
+	if targetExists && targetInfo.Mode().Type() != sourceInfo.Mode().Type() {
+		if err = target.RemoveAll(targetPath); err != nil {
+			return err
+		}
+		targetExists = false
+	}
+
+	switch {
+	case sourceInfo.IsDir():
+		if !targetExists {
+			if err = target.Mkdir(targetPath, sourceInfo.Mode().Perm()); err != nil {
+				return err
+			}
+			summary.Added = append(summary.Added, entry.path)
+			return nil
+		}
+		if targetInfo.Mode().Perm() != sourceInfo.Mode().Perm() {
+			return target.Chmod(targetPath, sourceInfo.Mode().Perm())
+		}
+		return nil
+
+	case sourceInfo.Mode()&fs.ModeSymlink != 0:
+		linkTarget, err := os.Readlink(sourcePath)
+		if err != nil {
+			return err
+		}
+		if targetExists {
+			if current, err := target.Readlink(targetPath); err == nil && current == linkTarget {
+				summary.Unchanged++
+				return nil
+			}
+			if err = target.Remove(targetPath); err != nil {
+				return err
+			}
+		}
+		if err = target.Symlink(linkTarget, targetPath); err != nil {
+			return err
+		}
+		addChanged(summary, entry.path, targetExists)
+		return nil
+
+	case sourceInfo.Mode().IsRegular():
+		same := false
+		if targetExists && targetInfo.Size() == sourceInfo.Size() {
+			if same, err = isSameContent(target, sourcePath, targetPath); err != nil {
+				return err
+			}
+		}
+		if !same {
+			file, err := os.Open(sourcePath)
+			if err != nil {
+				return err
+			}
+			err = target.WriteFile(targetPath, file, sourceInfo.Mode().Perm())
+			file.Close()
+			if err != nil {
+				return err
+			}
+			addChanged(summary, entry.path, targetExists)
+		} else {
+			if targetInfo.Mode().Perm() != sourceInfo.Mode().Perm() {
+				if err = target.Chmod(targetPath, sourceInfo.Mode().Perm()); err != nil {
+					return err
+				}
+			}
+			summary.Unchanged++
+		}
+		return target.Chtimes(targetPath, sourceInfo.ModTime())
+	}
+	// sockets, devices etc. are not synced
+	return nil
+}
+
+func addChanged(summary *SyncSummary, path string, existed bool) {
+	if existed {
+		summary.Updated = append(summary.Updated, path)
+	} else {
+		summary.Added = append(summary.Added, path)
+	}
+}
+
+func isSameContent(target syncTarget, sourcePath, targetPath string) (bool, error) {
+	sourceHash, err := fileSHA256(sourcePath)
+	if err != nil {
+		return false, err
+	}
+	targetHash, err := target.Hash(targetPath)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sourceHash, targetHash), nil
+}
+
+func fileSHA256(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+const (
+	SyncModeInPlace    = "in-place"
+	SyncModeAtomicSwap = "atomic-swap"
+)
+
+const defaultSyncKeepReleases = 3
+
+const (
+	SyncDeletePolicyDelete = "delete"
+	SyncDeletePolicyKeep   = "keep"
+)
+
+// Mappings returns sync_mappings or, if they are not given, the mapping of git_sub_folder to target_folder.
+// Legacy mapping keeps layout of former "rsync repo/sub target": the folder itself is synced into target_folder,
+// so content of "/assets/" lands in target_folder/assets and nothing else in target_folder is touched.
+func (synccfg *SyncConfig) Mappings() []SyncMapping {
+	if len(synccfg.SYNC_MAPPINGS) > 0 {
+		return synccfg.SYNC_MAPPINGS
+	}
+	localFolder := ""
+	if synccfg.parentLink != nil {
+		localFolder = synccfg.parentLink.GIT.GIT_LOCAL_FOLDER
+	}
+	folderName := filepath.Base(filepath.Join(string(filepath.Separator), localFolder, synccfg.GIT_SUB_FOLDER))
+	target := strings.TrimSuffix(synccfg.TARGET_FOLDER, "/") + "/" + folderName
+	return []SyncMapping{{SOURCE: synccfg.GIT_SUB_FOLDER, TARGET: target}}
+}
+
+// SyncOptions returns options of SyncFolders for the mapping.
+func (mapping *SyncMapping) SyncOptions() (SyncOptions, error) {
+	options := SyncOptions{Include: mapping.INCLUDE, Exclude: mapping.EXCLUDE}
+	switch mapping.DELETE_POLICY {
+	case "", SyncDeletePolicyDelete:
+		options.Delete = true
+	case SyncDeletePolicyKeep:
+	default:
+		return options, fmt.Errorf("unknown delete policy %q of sync target %s", mapping.DELETE_POLICY, mapping.TARGET)
+	}
+	for _, pattern := range append(append([]string{}, mapping.INCLUDE...), mapping.EXCLUDE...) {
+		if _, err := syncPatternRegexp(strings.Trim(pattern, "/")); err != nil {
+			return options, fmt.Errorf("wrong sync pattern %q: %w", pattern, err)
+		}
+	}
+	return options, nil
+}
+
+// SyncReleasesFolder returns folder next to target where release folders of atomic-swap mode are stored.
+func SyncReleasesFolder(target string) string {
+	return filepath.Clean(target) + ".releases"
+}
+
+// SyncRelease syncs every mapping from releaseFolder (repo root of checked out release) in the configured mode.
+// Options of all mappings are checked before the first one is synced. Sync stops at the first failed mapping
+// and release is reported as not applied - all mappings are synced again on the next attempt.
+func (synccfg *SyncConfig) SyncRelease(releaseFolder, tag string, logger *Logger) error {
+	mappings := synccfg.Mappings()
+	for _, mapping := range mappings {
+		if _, err := mapping.SyncOptions(); err != nil {
+			return err
+		}
+	}
+	for i, mapping := range mappings {
+		sourcePath := filepath.Join(releaseFolder, mapping.SOURCE)
+		PrintInfo(logger, "start sync %s to %s for tag %s", sourcePath, mapping.TARGET, tag)
+		summary, err := synccfg.syncMapping(mapping, sourcePath, tag, logger)
+		if err != nil {
+			return fmt.Errorf("%w: sync %s to %s failed (%d of %d mappings are synced): %v", ErrReleaseNotApplied,
+				sourcePath, mapping.TARGET, i, len(mappings), err)
+		}
+		summary.LogDetails(logger)
+	}
+	return nil
+}
+
+func (synccfg *SyncConfig) syncMapping(mapping SyncMapping, sourcePath, tag string, logger *Logger) (*SyncSummary, error) {
+	options, err := mapping.SyncOptions()
+	if err != nil {
+		return nil, err
+	}
+	if IsSftpTarget(mapping.TARGET) {
+		return synccfg.syncToSftp(mapping.TARGET, sourcePath, options)
+	}
+	if IsS3Target(mapping.TARGET) {
+		return synccfg.syncToS3(mapping.TARGET, sourcePath, options)
+	}
+	switch synccfg.SYNC_MODE {
+	case "", SyncModeInPlace:
+		return SyncFolders(sourcePath, mapping.TARGET, options)
+	case SyncModeAtomicSwap:
+		keep := synccfg.SYNC_KEEP_RELEASES
+		if keep <= 0 {
+			keep = defaultSyncKeepReleases
+		}
+		return SwapSyncFolders(sourcePath, mapping.TARGET, SyncReleasesFolder(mapping.TARGET), tag, options, keep, logger)
+	default:
+		return nil, fmt.Errorf("unknown sync mode %q", synccfg.SYNC_MODE)
+	}
+}
+
+func (synccfg *SyncConfig) syncToSftp(targetURL, sourcePath string, options SyncOptions) (*SyncSummary, error) {
+	if synccfg.SYNC_MODE == SyncModeAtomicSwap {
+		return nil, fmt.Errorf("%s mode is not supported for sftp targets", SyncModeAtomicSwap)
+	}
+	target, err := ParseSftpTarget(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	client, err := synccfg.DialSftp(target)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return SyncFoldersToSftp(client, sourcePath, target.Path, options)
+}
+
+func (synccfg *SyncConfig) syncToS3(targetURL, sourcePath string, options SyncOptions) (*SyncSummary, error) {
+	if synccfg.SYNC_MODE == SyncModeAtomicSwap {
+		return nil, fmt.Errorf("%s mode is not supported for s3 targets", SyncModeAtomicSwap)
+	}
+	target, err := ParseS3Target(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	client, err := synccfg.NewS3Client()
+	if err != nil {
+		return nil, err
+	}
+	return SyncFoldersToS3(client, sourcePath, target, options, synccfg.S3_CACHE_CONTROL)
+}
+
+// SwapSyncFolders stages content of sourcePath into new release folder inside releasesFolder and publishes it by
+// atomic replace of targetPath symlink, so readers of targetPath see either previous or new release entirely.
+// Staging starts from copy of the published release, so summary shows changes against it.
+// Newest keep release folders are left (the published one is never removed) - previous ones can be used
+// for instant rollback by switching the symlink back.
+func SwapSyncFolders(sourcePath, targetPath, releasesFolder, tag string, options SyncOptions, keep int,
+	logger *Logger) (*SyncSummary, error) {
+
+	targetPath = filepath.Clean(targetPath)
+	if err := os.MkdirAll(releasesFolder, 0755); err != nil {
+		return nil, err
+	}
+
+	// release folder names start with timestamp, so they sort in order of creation
+	releaseName := time.Now().Format("20060102-150405.000") + "-" + strings.ReplaceAll(tag, "/", "_")
+	releasePath := filepath.Join(releasesFolder, releaseName)
+	stagePath := filepath.Join(releasesFolder, ".stage-"+releaseName)
+	defer os.RemoveAll(stagePath)
+
+	targetInfo, err := os.Lstat(targetPath)
+	targetExists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if targetExists {
+		publishedPath, err := filepath.EvalSymlinks(targetPath)
+		if err != nil {
+			return nil, fmt.Errorf("resolving published release failed: %w", err)
+		}
+		if _, err = SyncFolders(publishedPath, stagePath, SyncOptions{Delete: true}); err != nil {
+			return nil, fmt.Errorf("staging published release failed: %w", err)
+		}
+	}
+	summary, err := SyncFolders(sourcePath, stagePath, options)
+	if err != nil {
+		return summary, err
+	}
+	if err = os.Rename(stagePath, releasePath); err != nil {
+		return summary, err
+	}
+
+	if targetExists && targetInfo.Mode()&fs.ModeSymlink == 0 {
+		// first swap of target previously synced in place - it's kept among releases, but target is
+		// missing for a moment until symlink is created
+		PrintWarning(logger, "target %s is not a symlink yet and is moved to %s", targetPath, releasesFolder)
+		previousPath := filepath.Join(releasesFolder, targetInfo.ModTime().Format("20060102-150405.000")+"-in-place")
+		if err = os.Rename(targetPath, previousPath); err != nil {
+			return summary, fmt.Errorf("moving in-place target aside failed: %w", err)
+		}
+	}
+
+	// relative link keeps working when the parent folder is mounted at other path (nfs in pods)
+	linkTarget, err := filepath.Rel(filepath.Dir(targetPath), releasePath)
+	if err != nil {
+		linkTarget = releasePath
+	}
+	tmpLink := targetPath + ".swap-" + releaseName
+	os.Remove(tmpLink)
+	if err = os.Symlink(linkTarget, tmpLink); err != nil {
+		return summary, err
+	}
+	if err = os.Rename(tmpLink, targetPath); err != nil {
+		os.Remove(tmpLink)
+		return summary, fmt.Errorf("switching %s to %s failed: %w", targetPath, releasePath, err)
+	}
+	PrintInfo(logger, "%s is switched to release folder %s", targetPath, releasePath)
+
+	return summary, CleanupSyncReleases(releasesFolder, releasePath, keep, logger)
+}
+
+// CleanupSyncReleases removes all but keep newest release folders and leftovers of crashed stages.
+func CleanupSyncReleases(releasesFolder, current string, keep int, logger *Logger) error {
+	entries, err := os.ReadDir(releasesFolder)
+	if err != nil {
+		return err
+	}
+	releases := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		path := filepath.Join(releasesFolder, entry.Name())
+		if strings.HasPrefix(entry.Name(), ".stage-") {
+			PrintDebug(logger, "removing unfinished stage %s", path)
+			os.RemoveAll(path)
+			continue
+		}
+		if entry.IsDir() && path != current {
+			releases = append(releases, path)
+		}
+	}
+	// newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(releases)))
+	// current release is one of kept
+	for i := keep - 1; i < len(releases); i++ {
+		if i < 0 {
+			continue
+		}
+		PrintInfo(logger, "removing old release folder %s", releases[i])
+		if err = os.RemoveAll(releases[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package cdddru
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncFolders(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "assets") + "/"
+	target := t.TempDir()
+
+	files := map[string]string{
+		"index.html":     "index",
+		"css/site.css":   "body {}",
+		"js/app.js":      "app",
+		".git/HEAD":      "ref: refs/heads/main",
+		"old/remove.txt": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(source, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(source, "js/app.js"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("index.html", filepath.Join(source, "default.html")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(source, "index.html"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	// extraneous file in target is removed
+	if err := os.WriteFile(filepath.Join(target, "stale.txt"), []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := SyncFolders(source, target, SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(summary.Added) != 8 || !reflect.DeepEqual(summary.Deleted, []string{"stale.txt"}) {
+		t.Errorf("unexpected summary of the first sync: %+v", summary)
+	}
+	if isExist, _, _ := IsPathExists(filepath.Join(target, ".git")); isExist {
+		t.Errorf("expected .git not to be synced")
+	}
+	if isExist, _, _ := IsPathExists(filepath.Join(target, "assets")); isExist {
+		t.Errorf("expected content of source to be synced into target itself")
+	}
+	info, err := os.Stat(filepath.Join(target, "js/app.js"))
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("expected mode to be kept, got %v (%v)", info, err)
+	}
+	info, err = os.Stat(filepath.Join(target, "index.html"))
+	if err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("expected mtime to be kept, got %v (%v)", info, err)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "default.html")); err != nil || link != "index.html" {
+		t.Errorf("expected symlink to index.html, got %q (%v)", link, err)
+	}
+
+	// only changed files are copied
+	if err = os.WriteFile(filepath.Join(source, "css/site.css"), []byte("body {color: red}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.RemoveAll(filepath.Join(source, "old")); err != nil {
+		t.Fatal(err)
+	}
+	// same content with new mtime is not copied again
+	now := time.Now()
+	if err = os.Chtimes(filepath.Join(source, "js/app.js"), now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err = SyncFolders(source, target, SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	sort.Strings(summary.Deleted)
+	if len(summary.Added) != 0 || !reflect.DeepEqual(summary.Updated, []string{"css/site.css"}) ||
+		!reflect.DeepEqual(summary.Deleted, []string{"old"}) || summary.Unchanged != 3 {
+		t.Errorf("unexpected summary of the second sync: %+v", summary)
+	}
+	content, err := os.ReadFile(filepath.Join(target, "css/site.css"))
+	if err != nil || string(content) != "body {color: red}" {
+		t.Errorf("expected updated content, got %q (%v)", content, err)
+	}
+	info, err = os.Stat(filepath.Join(target, "js/app.js"))
+	if err != nil || !info.ModTime().Equal(now) {
+		t.Errorf("expected mtime of unchanged file to be updated, got %v (%v)", info, err)
+	}
+}
+
+func TestSwapSyncFolders(t *testing.T) {
+	source := t.TempDir()
+	root := t.TempDir()
+	config := Config{}
+	config.SYNC.TARGET_FOLDER = filepath.Join(root, "site")
+	config.SYNC.SYNC_MODE = SyncModeAtomicSwap
+	config.SYNC.SYNC_KEEP_RELEASES = 2
+	config.SetParentLinks()
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+
+	// target synced in place before is kept among releases
+	if err := os.MkdirAll(config.SYNC.TARGET_FOLDER, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(config.SYNC.TARGET_FOLDER, "index.html"), []byte("v0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"v1", "v2", "v3"} {
+		if err := os.WriteFile(filepath.Join(source, "index.html"), []byte(version), 0644); err != nil {
+			t.Fatal(err)
+		}
+		options, _ := config.SYNC.Mappings()[0].SyncOptions()
+		summary, err := SwapSyncFolders(source, config.SYNC.TARGET_FOLDER, SyncReleasesFolder(config.SYNC.TARGET_FOLDER),
+			version, options, config.SYNC.SYNC_KEEP_RELEASES, logger)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !reflect.DeepEqual(summary.Updated, []string{"index.html"}) {
+			t.Errorf("expected index.html to be updated against published release, got %+v", summary)
+		}
+		info, err := os.Lstat(config.SYNC.TARGET_FOLDER)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Fatalf("expected target to be symlink, got %v (%v)", info, err)
+		}
+		content, err := os.ReadFile(filepath.Join(config.SYNC.TARGET_FOLDER, "index.html"))
+		if err != nil || string(content) != version {
+			t.Errorf("expected published %s, got %q (%v)", version, content, err)
+		}
+		releases, _ := os.ReadDir(SyncReleasesFolder(config.SYNC.TARGET_FOLDER))
+		if len(releases) != 2 {
+			t.Errorf("expected 2 release folders, got %d", len(releases))
+		}
+	}
+
+	link, err := os.Readlink(config.SYNC.TARGET_FOLDER)
+	if err != nil || filepath.IsAbs(link) {
+		t.Errorf("expected relative symlink, got %q (%v)", link, err)
+	}
+}
+
+func TestSyncReleaseMappings(t *testing.T) {
+	release := t.TempDir()
+	for _, name := range []string{"assets/css/site.css", "assets/css/site.css.map", "assets/img/logo.png",
+		"assets/drafts/new.html", "docs/guide.md", "docs/api/ref.md", "docs/api/ref.txt"} {
+		path := filepath.Join(release, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := t.TempDir()
+	config := Config{}
+	config.SYNC.SYNC_MAPPINGS = []SyncMapping{
+		{SOURCE: "assets/", TARGET: filepath.Join(root, "assets"), EXCLUDE: []string{"*.map", "drafts"}},
+		{SOURCE: "/docs", TARGET: filepath.Join(root, "docs"), INCLUDE: []string{"**/*.md"}, DELETE_POLICY: SyncDeletePolicyKeep},
+	}
+	config.SetParentLinks()
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+
+	// excluded paths are not deleted, extraneous are deleted only if delete policy allows
+	for _, name := range []string{"assets/drafts/local.html", "assets/stale.css", "docs/stale.md"} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := config.SYNC.SyncRelease(release, "v1.0.0", logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := map[string]bool{
+		"assets/css/site.css":      true,
+		"assets/css/site.css.map":  false,
+		"assets/img/logo.png":      true,
+		"assets/drafts/new.html":   false,
+		"assets/drafts/local.html": true,
+		"assets/stale.css":         false,
+		"docs/guide.md":            true,
+		"docs/api/ref.md":          true,
+		"docs/api/ref.txt":         false,
+		"docs/stale.md":            true,
+	}
+	for name, shouldExist := range expected {
+		if isExist, _, _ := IsPathExists(filepath.Join(root, name)); isExist != shouldExist {
+			t.Errorf("expected %s to exist: %v, got %v", name, shouldExist, isExist)
+		}
+	}
+
+	// nothing is synced if options of any mapping are wrong
+	os.Remove(filepath.Join(root, "assets", "css", "site.css"))
+	config.SYNC.SYNC_MAPPINGS[1].DELETE_POLICY = "wipe"
+	if err := config.SYNC.SyncRelease(release, "v1.0.0", logger); err == nil {
+		t.Errorf("expected error for unknown delete policy")
+	}
+	if isExist, _, _ := IsPathExists(filepath.Join(root, "assets", "css", "site.css")); isExist {
+		t.Errorf("expected no mapping to be synced with wrong options")
+	}
+
+	// sync stops at the first failed mapping
+	config.SYNC.SYNC_MAPPINGS[1].DELETE_POLICY = ""
+	config.SYNC.SYNC_MAPPINGS = []SyncMapping{
+		{SOURCE: "missing", TARGET: filepath.Join(root, "missing")},
+		config.SYNC.SYNC_MAPPINGS[0],
+	}
+	err := config.SYNC.SyncRelease(release, "v1.0.1", logger)
+	if !errors.Is(err, ErrReleaseNotApplied) || !strings.Contains(err.Error(), "0 of 2 mappings are synced") {
+		t.Errorf("expected release not to be applied, got %v", err)
+	}
+	if isExist, _, _ := IsPathExists(filepath.Join(root, "assets", "css", "site.css")); isExist {
+		t.Errorf("expected mappings after failed one not to be synced")
+	}
+}
+
+func TestSyncReleaseLegacyMapping(t *testing.T) {
+	release := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(release, "assets", "css"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(release, "assets", "css", "site.css"), []byte("body {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "uploads.txt"), []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{}
+	config.GIT.GIT_LOCAL_FOLDER = "/tmp/cdddru/main-ddru-assets"
+	config.SYNC.GIT_SUB_FOLDER = "/assets/"
+	config.SYNC.TARGET_FOLDER = root + "/"
+	config.SetParentLinks()
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+
+	if mappings := config.SYNC.Mappings(); len(mappings) != 1 || mappings[0].TARGET != filepath.Join(root, "assets") {
+		t.Errorf("expected sub folder to be synced into its own folder of target, got %+v", mappings)
+	}
+	if err := config.SYNC.SyncRelease(release, "v1.0.0", logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// the same layout as "rsync --delete repo/assets target_folder" gave
+	for _, name := range []string{"assets/css/site.css", "uploads.txt"} {
+		if isExist, _, _ := IsPathExists(filepath.Join(root, name)); !isExist {
+			t.Errorf("expected %s in target folder", name)
+		}
+	}
+	if isExist, _, _ := IsPathExists(filepath.Join(root, "css")); isExist {
+		t.Errorf("expected content of sub folder not to be synced into target folder itself")
+	}
+
+	// whole repo is synced into folder named as local clone
+	config.SYNC.GIT_SUB_FOLDER = ""
+	if mappings := config.SYNC.Mappings(); mappings[0].TARGET != filepath.Join(root, "main-ddru-assets") {
+		t.Errorf("expected repo to be synced into folder of local clone name, got %+v", mappings)
+	}
+}
+
+func TestMatchSyncPatterns(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"*.map", "css/site.css.map", true},
+		{"*.map", "site.css", false},
+		{"drafts", "a/drafts/new.html", true},
+		{"css/*.css", "css/site.css", true},
+		{"css/*.css", "css/vendor/lib.css", false},
+		{"css/**/*.css", "css/vendor/lib.css", true},
+		{"css/**/*.css", "css/site.css", true},
+		{"/img/", "img/logo.png", true},
+		{"?.txt", "a.txt", true},
+		{"?.txt", "ab.txt", false},
+	}
+	for _, c := range cases {
+		if match := matchSyncPatterns([]string{c.pattern}, c.path); match != c.match {
+			t.Errorf("pattern %q on %q: expected %v, got %v", c.pattern, c.path, c.match, match)
+		}
+	}
+}
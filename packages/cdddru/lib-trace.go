@@ -0,0 +1,267 @@
+package cdddru
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceServiceName = "cdddru"
+	// OTLP span kinds and status codes
+	spanKindInternal = 1
+	spanKindClient   = 3
+	spanStatusOk     = 1
+	spanStatusError  = 2
+
+	defaultTraceExportTimeout = 10
+)
+
+// TraceEndpoint is OTLP/HTTP endpoint traces are exported to (e.g. http://otel-collector:4318), empty - not exported
+var TraceEndpoint = GetEnvVar("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+
+// TraceFile is file traces are appended to as OTLP json lines for offline inspection, empty - not written
+var TraceFile = GetEnvVar("CDDDRU_TRACE_FILE", "")
+
+// traceFileMu serializes writes of traces of all jobs to TraceFile
+var traceFileMu sync.Mutex
+
+// Span is a timed operation of trace: check cycle, release, step or external command.
+// All methods do nothing on nil span - it is what tracing disabled means.
+type Span struct {
+	mu         sync.Mutex
+	trace      *trace
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+// trace collects ended spans until root span ends and the trace is exported
+type trace struct {
+	mu     sync.Mutex
+	spans  []*Span
+	logger *Logger
+}
+
+type spanContextKey struct{}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// IsTracingEnabled tells traces are exported to OTLP endpoint or file
+func IsTracingEnabled() bool {
+	return IsStringNotEmpty(TraceEndpoint) || IsStringNotEmpty(TraceFile)
+}
+
+// StartTrace starts root span of new trace, trace is exported when root span ends.
+// Export errors are written to logger. Returns nil if tracing is disabled.
+func StartTrace(name string, logger *Logger) *Span {
+	if !IsTracingEnabled() {
+		return nil
+	}
+	return &Span{trace: &trace{logger: logger}, traceID: randomHex(16), spanID: randomHex(8), name: name,
+		kind: spanKindInternal, start: time.Now(), attributes: make(map[string]interface{})}
+}
+
+// StartChild starts span which parent is s
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return &Span{trace: s.trace, traceID: s.traceID, spanID: randomHex(8), parentID: s.spanID, name: name,
+		kind: spanKindInternal, start: time.Now(), attributes: make(map[string]interface{})}
+}
+
+// SetAttribute sets attribute of span, values are strings, bools, ints or floats
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks span failed with err, nil err is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End ends span, ending of root span exports the whole trace
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.trace.mu.Lock()
+	s.trace.spans = append(s.trace.spans, s)
+	spans := s.trace.spans
+	s.trace.mu.Unlock()
+	if IsStringEmpty(s.parentID) {
+		if err := exportTrace(spans); err != nil {
+			PrintWarning(s.trace.logger, "exporting trace %s failed: %v", s.traceID, err)
+		}
+	}
+}
+
+// ContextWithSpan returns context which commands started with are traced as children of span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// SpanFromContext returns span of context or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// traceCommand starts span of external command in trace of ctx, returned func ends it with exit code of command
+func traceCommand(ctx context.Context, commandName string, commandArgs []string) func(err error) {
+	span := SpanFromContext(ctx).StartChild("exec " + commandName)
+	if span == nil {
+		return func(error) {}
+	}
+	span.kind = spanKindClient
+	span.SetAttribute("process.command", commandName)
+	span.SetAttribute("process.command_line", Redact(strings.Join(append([]string{commandName}, commandArgs...), " ")))
+	return func(err error) {
+		exitCode := 0
+		var exitErr *exec.ExitError
+		switch {
+		case errors.As(err, &exitErr):
+			exitCode = exitErr.ExitCode()
+		case err != nil:
+			exitCode = -1
+		}
+		span.SetAttribute("process.exit_code", exitCode)
+		span.SetAttribute("duration_ms", time.Since(span.start).Milliseconds())
+		span.SetError(err)
+		span.End()
+	}
+}
+
+// otlpAttributes converts attributes to OTLP json key-value list
+func otlpAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		var otlpValue map[string]interface{}
+		switch v := value.(type) {
+		case bool:
+			otlpValue = map[string]interface{}{"boolValue": v}
+		case int:
+			otlpValue = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			otlpValue = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			otlpValue = map[string]interface{}{"doubleValue": v}
+		default:
+			otlpValue = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		list = append(list, map[string]interface{}{"key": key, "value": otlpValue})
+	}
+	return list
+}
+
+// otlpTraceRequest encodes spans as OTLP ExportTraceServiceRequest in json
+func otlpTraceRequest(spans []*Span) ([]byte, error) {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		status := map[string]interface{}{"code": spanStatusOk}
+		if s.err != nil {
+			status = map[string]interface{}{"code": spanStatusError, "message": Redact(s.err.Error())}
+		}
+		otlpSpan := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+			"status":            status,
+		}
+		if IsStringNotEmpty(s.parentID) {
+			otlpSpan["parentSpanId"] = s.parentID
+		}
+		s.mu.Unlock()
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": traceServiceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": traceServiceName},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+}
+
+// exportTrace sends spans to OTLP endpoint and appends them to trace file
+func exportTrace(spans []*Span) error {
+	payload, err := otlpTraceRequest(spans)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if IsStringNotEmpty(TraceFile) {
+		traceFileMu.Lock()
+		f, err := os.OpenFile(TraceFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.Write(append(payload, '\n'))
+			f.Close()
+		}
+		traceFileMu.Unlock()
+		errs = append(errs, err)
+	}
+	if IsStringNotEmpty(TraceEndpoint) {
+		client := &http.Client{Timeout: defaultTraceExportTimeout * time.Second}
+		resp, err := client.Post(strings.TrimSuffix(TraceEndpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(payload))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("otlp endpoint responded %s", resp.Status)
+			}
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,108 @@
+package cdddru
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// otlpTestSpan is part of OTLP json span checked by tests
+type otlpTestSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func decodeOtlpSpans(t *testing.T, payload []byte) map[string]otlpTestSpan {
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpTestSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		t.Fatalf("expected OTLP json, got %q: %v", payload, err)
+	}
+	spans := make(map[string]otlpTestSpan)
+	for _, span := range request.ResourceSpans[0].ScopeSpans[0].Spans {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func (span otlpTestSpan) attribute(key string) interface{} {
+	for _, attribute := range span.Attributes {
+		if attribute.Key == key {
+			for _, value := range attribute.Value {
+				return value
+			}
+		}
+	}
+	return nil
+}
+
+func TestTracePipeline(t *testing.T) {
+	var exported []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			exported, _ = io.ReadAll(r.Body)
+		}
+	}))
+	defer collector.Close()
+	traceFile := filepath.Join(t.TempDir(), "traces.jsonl")
+	TraceEndpoint, TraceFile = collector.URL, traceFile
+	defer func() { TraceEndpoint, TraceFile = "", "" }()
+
+	config := &Config{}
+	config.COMMON.JOB_NAME = "trace-site"
+	config.HOOKS.PRE_DEPLOY = []Hook{{NAME: "migrations", COMMAND: []string{"sh", "-c", "exit 3"}, ON_ERROR: HookOnErrorContinue}}
+	config.STEPS = []PipelineStep{{NAME: "smoke", TYPE: PipelineStepHook, HOOKS: []Hook{{COMMAND: []string{"true"}}}}}
+	config.SetParentLinks()
+	var out bytes.Buffer
+	logger := NewLogger(&out, &out, InfoLevel, "test")
+
+	cycle := StartTrace("check trace-site", logger)
+	logger.SetSpan(cycle)
+	run := &PipelineRun{Data: ReleaseData{Release: "v1.0.1"}}
+	if err := config.RunPipeline(run, logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	config.HOOKS.RunHooks(HookPreDeploy, run.Data, logger)
+	cycle.End()
+
+	spans := decodeOtlpSpans(t, exported)
+	root, step := spans["check trace-site"], spans["step smoke"]
+	if root.TraceID == "" || root.ParentSpanID != "" || step.ParentSpanID != root.SpanID || step.TraceID != root.TraceID {
+		t.Fatalf("expected step to be child of check cycle, got %+v", spans)
+	}
+	if command := spans["exec true"]; command.ParentSpanID != spans["smoke hook true"].SpanID ||
+		command.attribute("process.exit_code") != "0" || command.attribute("duration_ms") == nil {
+		t.Errorf("unexpected span of command %+v", command)
+	}
+	if failed := spans["exec sh"]; failed.attribute("process.exit_code") != "3" || failed.Status.Code != spanStatusError {
+		t.Errorf("expected failed command span, got %+v", failed)
+	}
+
+	content, err := os.ReadFile(traceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(content)), "\n"); len(lines) != 1 || lines[0] != string(exported) {
+		t.Errorf("expected the same trace in file, got %q", content)
+	}
+}
@@ -0,0 +1,244 @@
+package cdddru
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WebhookProviderGitHub = "github"
+	WebhookProviderGitLab = "gitlab"
+	WebhookProviderGitea  = "gitea"
+
+	// webhook payloads are small - anything bigger is not a push event
+	maxWebhookPayload = 5 << 20
+)
+
+// jobTrigger wakes job sleeping between checks for new release
+type jobTrigger struct {
+	config *Config
+	wake   chan struct{}
+}
+
+var jobTriggers = struct {
+	sync.Mutex
+	jobs map[string]*jobTrigger
+}{jobs: make(map[string]*jobTrigger)}
+
+// RegisterJobTrigger makes job possible to wake by webhook, config of restarted job replaces previous one
+func RegisterJobTrigger(config *Config) {
+	jobTriggers.Lock()
+	defer jobTriggers.Unlock()
+	trigger, ok := jobTriggers.jobs[config.COMMON.JOB_NAME]
+	if !ok {
+		trigger = &jobTrigger{wake: make(chan struct{}, 1)}
+		jobTriggers.jobs[config.COMMON.JOB_NAME] = trigger
+	}
+	trigger.config = config
+}
+
+// WakeJob makes job check for new release now, repeated wakes before the check are merged into one
+func WakeJob(jobName string) bool {
+	jobTriggers.Lock()
+	trigger, ok := jobTriggers.jobs[jobName]
+	jobTriggers.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case trigger.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// WaitForNextCheck sleeps for interval or until job is woken by webhook, returns true if job is woken
+func WaitForNextCheck(jobName string, interval time.Duration) bool {
+	jobTriggers.Lock()
+	trigger, ok := jobTriggers.jobs[jobName]
+	jobTriggers.Unlock()
+	if !ok {
+		time.Sleep(interval)
+		return false
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return false
+	case <-trigger.wake:
+		return true
+	}
+}
+
+// webhookEvent is what cdddru needs from push and tag push events of git hostings
+type webhookEvent struct {
+	Ref        string `json:"ref"`
+	Repository struct {
+		CloneURL   string `json:"clone_url"`
+		SshURL     string `json:"ssh_url"`
+		HtmlURL    string `json:"html_url"`
+		GitHttpURL string `json:"git_http_url"`
+		GitSshURL  string `json:"git_ssh_url"`
+		URL        string `json:"url"`
+		Homepage   string `json:"homepage"`
+	} `json:"repository"`
+	Project struct {
+		GitHttpURL string `json:"git_http_url"`
+		GitSshURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+}
+
+// repoURLs returns all urls of repository given in event
+func (event webhookEvent) repoURLs() []string {
+	urls := make([]string, 0)
+	for _, u := range []string{event.Repository.CloneURL, event.Repository.SshURL, event.Repository.HtmlURL,
+		event.Repository.GitHttpURL, event.Repository.GitSshURL, event.Repository.URL, event.Repository.Homepage,
+		event.Project.GitHttpURL, event.Project.GitSshURL, event.Project.WebURL} {
+		if IsStringNotEmpty(u) {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// normalizeRepoURL turns https, ssh and scp-like urls of repository into host/path
+func normalizeRepoURL(repoURL string) string {
+	u := strings.ToLower(strings.TrimSpace(repoURL))
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+	} else if i := strings.Index(u, ":"); i >= 0 && !strings.Contains(u[:i], "/") {
+		// scp-like git@host:owner/repo.git
+		u = u[:i] + "/" + u[i+1:]
+	}
+	if i := strings.Index(u, "@"); i >= 0 && !strings.Contains(u[:i], "/") {
+		u = u[i+1:]
+	}
+	// port of ssh urls differs from one of https urls
+	if slash := strings.Index(u, "/"); slash >= 0 {
+		if colon := strings.Index(u[:slash], ":"); colon >= 0 {
+			u = u[:colon] + u[slash:]
+		}
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(u, "/"), ".git")
+}
+
+// matches tells event is push of tag with prefix of the job or push to branch of the job in its repository
+func (event webhookEvent) matches(config *Config) bool {
+	repo := normalizeRepoURL(config.GIT.GIT_REPO_URL)
+	isRepo := false
+	for _, u := range event.repoURLs() {
+		if normalizeRepoURL(u) == repo {
+			isRepo = true
+			break
+		}
+	}
+	if !isRepo {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(event.Ref, "refs/tags/"):
+		return strings.HasPrefix(strings.TrimPrefix(event.Ref, "refs/tags/"), config.GIT.GIT_TAG_PREFIX)
+	case strings.HasPrefix(event.Ref, "refs/heads/"):
+		return IsStringEmpty(config.GIT.GIT_BRANCH) || strings.TrimPrefix(event.Ref, "refs/heads/") == config.GIT.GIT_BRANCH
+	}
+	return false
+}
+
+// webhookProvider detects git hosting by headers of request
+func webhookProvider(header http.Header) string {
+	switch {
+	case header.Get("X-Gitea-Event") != "" || header.Get("X-Gogs-Event") != "":
+		return WebhookProviderGitea
+	case header.Get("X-Gitlab-Event") != "":
+		return WebhookProviderGitLab
+	case header.Get("X-GitHub-Event") != "":
+		return WebhookProviderGitHub
+	}
+	return ""
+}
+
+// isValidWebhookSignature checks HMAC-SHA256 signature of payload (github, gitea) or token (gitlab) against secret
+func isValidWebhookSignature(provider string, header http.Header, payload []byte, secret string) bool {
+	if IsStringEmpty(secret) {
+		return false
+	}
+	if provider == WebhookProviderGitLab {
+		return subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(secret)) == 1
+	}
+	signature := strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+	if provider == WebhookProviderGitea {
+		signature = Tiif(header.Get("X-Gitea-Signature") != "", header.Get("X-Gitea-Signature"), header.Get("X-Gogs-Signature")).(string)
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// WebhookHandler accepts push and tag push webhooks of github, gitlab and gitea and wakes jobs of pushed
+// repository and ref which git_webhook_secret the request is signed with
+func WebhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJson := func(code int, data interface{}) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(data)
+		}
+		if r.Method != http.MethodPost {
+			writeJson(http.StatusMethodNotAllowed, map[string]string{"error": "only POST is allowed"})
+			return
+		}
+		provider := webhookProvider(r.Header)
+		if provider == "" {
+			writeJson(http.StatusBadRequest, map[string]string{"error": "unknown webhook provider"})
+			return
+		}
+		payload, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+		if err != nil {
+			writeJson(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		var event webhookEvent
+		if err = json.Unmarshal(payload, &event); err != nil {
+			writeJson(http.StatusBadRequest, map[string]string{"error": "wrong payload: " + err.Error()})
+			return
+		}
+
+		jobTriggers.Lock()
+		triggers := make(map[string]*Config, len(jobTriggers.jobs))
+		for name, trigger := range jobTriggers.jobs {
+			triggers[name] = trigger.config
+		}
+		jobTriggers.Unlock()
+
+		matched, woken := 0, make([]string, 0)
+		for name, config := range triggers {
+			if !event.matches(config) {
+				continue
+			}
+			matched++
+			if isValidWebhookSignature(provider, r.Header, payload, config.GIT.GIT_WEBHOOK_SECRET) && WakeJob(name) {
+				woken = append(woken, name)
+			}
+		}
+		switch {
+		case matched > 0 && len(woken) == 0:
+			writeJson(http.StatusUnauthorized, map[string]string{"error": "signature does not match secret of any job"})
+		default:
+			writeJson(http.StatusOK, map[string]interface{}{"ref": event.Ref, "jobs": woken})
+		}
+	})
+}
@@ -6,24 +6,29 @@ import (
 	"html/template"
 	"io/fs"
 	"os"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	texttemplate "text/template"
 
 	git "github.com/go-git/go-git/v5"
 	plumbing "github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 func GetDeploymentReadinessStatus(config *Config, imageNameTag string) (bool, error) {
 
+	deployment, err := config.ActiveDeployment(config.logger.CommandContext())
+	if err != nil {
+		return false, err
+	}
 	pipeCommands := [][]string{
 		{"kubectx", config.DEPLOY.CONTEXT_K8s},
-		{"kubectl", "get", "deployment", config.DEPLOY.DEPLOYMENT_NAME_K8s, "-n", "test-app", "-o", "wide"},
-		{"grep", config.DEPLOY.DEPLOYMENT_NAME_K8s + ".*" + imageNameTag},
+		{"kubectl", "get", "deployment", deployment, "-n", "test-app", "-o", "wide"},
+		{"grep", deployment + ".*" + imageNameTag},
 		{"awk", `{print $2}`},
 	}
-	out, err := RunExternalCmdsPiped("", "pipe error", pipeCommands)
+	out, err := RunExternalCmdsPipedContext(config.logger.CommandContext(), "", "pipe error", pipeCommands)
 	if err != nil || len(out) == 0 {
 		return false, nil
 	}
@@ -37,26 +42,27 @@ func GetDeploymentReadinessStatus(config *Config, imageNameTag string) (bool, er
 // get current image tag from k8s deployment - we will run kubectl ...
 func GetImageTag(cfg *Config) (string, error) {
 
-	var deployment, namespace, dockerImage = cfg.DEPLOY.DEPLOYMENT_NAME_K8s, cfg.DEPLOY.NAMESPACE_K8s, cfg.DOCKER.DOCKER_IMAGE
+	var namespace, dockerImage = cfg.DEPLOY.NAMESPACE_K8s, cfg.DOCKER.DOCKER_IMAGE
 
-	_, err := RunExternalCmd("", "error while switching to context "+cfg.DEPLOY.CONTEXT_K8s, "kubectx", cfg.DEPLOY.CONTEXT_K8s)
+	_, err := RunExternalCmdContext(cfg.logger.CommandContext(), "", "error while switching to context "+cfg.DEPLOY.CONTEXT_K8s,
+		"kubectx", cfg.DEPLOY.CONTEXT_K8s)
 	if err != nil {
 		return "", fmt.Errorf("failed to switch context: %v (%v)", cfg.DEPLOY.CONTEXT_K8s, err)
 	}
-	// Create a buffer for stderr
-	var errThread bytes.Buffer
-
-	// Build the kubectl command
-	cmd := exec.Command("kubectl", "get", "deployment", deployment, "-n", namespace, "-o", "jsonpath={.spec.template.spec.containers}")
+	// with blue-green rollout the release runs in deployment service points to
+	deployment, err := cfg.ActiveDeployment(cfg.logger.CommandContext())
+	if err != nil {
+		return "", err
+	}
 	// Run the kubectl command and capture the output
-	cmd.Stderr = &errThread
-	output, err := cmd.Output()
+	output, err := RunExternalCmdContext(cfg.logger.CommandContext(), "", "failed to execute request to kubernetes", "kubectl", "get", "deployment", deployment,
+		"-n", namespace, "-o", "jsonpath={.spec.template.spec.containers}")
 	if err != nil {
-		return "", fmt.Errorf("failed to execute request to kubernetes: %v (%v)", err, errThread.String())
+		return "", err
 	}
 
 	// Trim leading/trailing spaces and newlines from the output
-	outputString := strings.TrimSpace(string(output))
+	outputString := strings.TrimSpace(output)
 
 	// Define the regular expression pattern
 	pattern := dockerImage + `:` + `(` + cfg.GIT.GIT_TAG_PREFIX + `?\d{1,2}\.\d{1,2}\.\d{1,2})`
@@ -102,19 +108,49 @@ func ConvertTagToNumeric(tag, prefix string) (int64, error) {
 	return numeric, nil
 }
 
+// GetCommitHashByTag returns hash of the commit the tag points to.
+// Both annotated and lightweight tags are supported: annotated tags
+// (even nested ones) are peeled until a commit is reached.
 func GetCommitHashByTag(gitRepository *git.Repository, tag string) (string, error) {
 	refTag, err := gitRepository.Tag(tag)
 	if err != nil {
 		return "", err
 	}
-	tagObj, err := gitRepository.TagObject(refTag.Hash())
+	commitHash, err := PeelToCommitHash(gitRepository, refTag.Hash())
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("resolving tag %s to commit failed: %w", tag, err)
 	}
-	// Resolve the commit hash from the tag reference
-	commitHash := tagObj.Target
 	return commitHash.String(), nil
-	// PrintInfo(logger, "Tag '%s' has commit hash %s", "v1.0.11", commitHash.String())
+}
+
+// PeelToCommitHash follows tag objects starting from given hash until a commit is found.
+// For a lightweight tag the hash already points to a commit and is returned as is.
+func PeelToCommitHash(gitRepository *git.Repository, hash plumbing.Hash) (plumbing.Hash, error) {
+	// nested annotated tags are rare, but we limit depth to avoid endless loops on broken repos
+	for i := 0; i < 10; i++ {
+		obj, err := gitRepository.Object(plumbing.AnyObject, hash)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		switch o := obj.(type) {
+		case *object.Commit:
+			return o.Hash, nil
+		case *object.Tag:
+			hash = o.Target
+		default:
+			return plumbing.ZeroHash, fmt.Errorf("object %s is %s, not a commit", hash, obj.Type())
+		}
+	}
+	return plumbing.ZeroHash, fmt.Errorf("too many nested tags starting from %s", hash)
+}
+
+// GetCommitInfo returns message and author name of commit
+func GetCommitInfo(gitRepository *git.Repository, commitHash string) (message, author string, err error) {
+	commitObj, err := gitRepository.CommitObject(plumbing.NewHash(commitHash))
+	if err != nil {
+		return "", "", err
+	}
+	return commitObj.Message, commitObj.Author.Name, nil
 }
 
 func CheckOutByCommitHash(gitRepository *git.Repository, commitHash string) error {
@@ -170,6 +206,44 @@ func GetTagsFromGitRepo(gitRepository *git.Repository, tagPrefix string) ([]stri
 	return repoTags, nil
 }
 
+// FilterTagsReachableFromBranch leaves only tags which commits are reachable from the head of given branch,
+// so tags created on other branches are ignored.
+func FilterTagsReachableFromBranch(gitRepository *git.Repository, tags []string, branch plumbing.ReferenceName) ([]string, error) {
+	branchRef, err := gitRepository.Reference(branch, true)
+	if err != nil {
+		return nil, fmt.Errorf("getting reference for branch %s failed: %w", branch.Short(), err)
+	}
+
+	commitIter, err := gitRepository.Log(&git.LogOptions{From: branchRef.Hash()})
+	if err != nil {
+		return nil, fmt.Errorf("getting log of branch %s failed: %w", branch.Short(), err)
+	}
+	defer commitIter.Close()
+
+	reachable := make(map[plumbing.Hash]bool)
+	err = commitIter.ForEach(func(c *object.Commit) error {
+		reachable[c.Hash] = true
+		return nil
+	})
+	// shallow clones have no parents for the oldest commits - that is not an error for us
+	if err != nil && err != plumbing.ErrObjectNotFound {
+		return nil, fmt.Errorf("walking log of branch %s failed: %w", branch.Short(), err)
+	}
+
+	filtered := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		commitHash, err := GetCommitHashByTag(gitRepository, tag)
+		if err != nil {
+			// tag which can not be resolved to commit is never reachable
+			continue
+		}
+		if reachable[plumbing.NewHash(commitHash)] {
+			filtered = append(filtered, tag)
+		}
+	}
+	return filtered, nil
+}
+
 func GetMaxTag(tags []string, maxTagValue string, prefix string) (int64, string, error) {
 	var tagString string = "v1.0.0"
 	if IsStringEmpty(maxTagValue) {
@@ -214,24 +288,6 @@ func CompareTwoTags(tag1, tag2, prefix string) (int, error) {
 
 }
 
-func Rsync(targetPath, folderPath string) error {
-	// Perform the rsync operation using the 'rsync' command
-	var errThread bytes.Buffer
-	err := os.MkdirAll(targetPath, os.ModePerm)
-	if err != nil {
-		return err
-	}
-	keys := Tiif(bool(FbVerbose), "-avzhq", "-avzh")
-	cmd := exec.Command("rsync", keys.(string), "--delete", "--recursive", folderPath, targetPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = &errThread
-	err = cmd.Run()
-	if err != nil {
-		return fmt.Errorf("rsync command failed: %v (%v)", err, errThread.String())
-	}
-	return nil
-}
-
 func GenerateManifest(templatePath string, data interface{}) (string, error) {
 	// Create a new template and parse the template string
 	rawManifest, err := os.ReadFile(templatePath)
@@ -260,3 +316,20 @@ func GenerateManifest(templatePath string, data interface{}) (string, error) {
 	resultString = buf.String()
 	return resultString, nil
 }
+
+// RenderString executes text/template in value with given data, values without templates are returned as is
+func RenderString(value string, data interface{}) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	tmpl, err := texttemplate.New("value").Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("error parsing template: %w", err)
+	}
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, data)
+	if err != nil {
+		return "", fmt.Errorf("error executing template: %w", err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,108 @@
+package cdddru
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	plumbing "github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+var testSignature = &object.Signature{Name: "tester", Email: "tester@example.com", When: time.Unix(1700000000, 0)}
+
+func commitTestFile(t *testing.T, repoPath string, wt *git.Worktree, name, content string) plumbing.Hash {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(repoPath, name), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wt.Add(name); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := wt.Commit("commit "+name, &git.CommitOptions{Author: testSignature})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestGetCommitHashByTag(t *testing.T) {
+	repoPath := t.TempDir()
+	repo, err := git.PlainInit(repoPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstCommit := commitTestFile(t, repoPath, wt, "a.txt", "a")
+	secondCommit := commitTestFile(t, repoPath, wt, "b.txt", "b")
+
+	// lightweight tag
+	if _, err = repo.CreateTag("v1.0.0", firstCommit, nil); err != nil {
+		t.Fatal(err)
+	}
+	// annotated tag
+	if _, err = repo.CreateTag("v1.0.1", secondCommit, &git.CreateTagOptions{Tagger: testSignature, Message: "release"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for tag, expected := range map[string]plumbing.Hash{"v1.0.0": firstCommit, "v1.0.1": secondCommit} {
+		hash, err := GetCommitHashByTag(repo, tag)
+		if err != nil {
+			t.Errorf("tag %s: expected no error, got %v", tag, err)
+		}
+		if hash != expected.String() {
+			t.Errorf("tag %s: expected %s, got %s", tag, expected, hash)
+		}
+	}
+
+	if _, err = GetCommitHashByTag(repo, "v9.9.9"); err == nil {
+		t.Errorf("expected error for missing tag")
+	}
+}
+
+func TestFilterTagsReachableFromBranch(t *testing.T) {
+	repoPath := t.TempDir()
+	repo, err := git.PlainInit(repoPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mainCommit := commitTestFile(t, repoPath, wt, "a.txt", "a")
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainBranch := head.Name()
+	if _, err = repo.CreateTag("v1.0.0", mainCommit, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// commit on other branch which is not reachable from main branch
+	err = wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("other"), Create: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCommit := commitTestFile(t, repoPath, wt, "b.txt", "b")
+	if _, err = repo.CreateTag("v2.0.0", otherCommit, &git.CreateTagOptions{Tagger: testSignature, Message: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := FilterTagsReachableFromBranch(repo, []string{"v1.0.0", "v2.0.0"}, mainBranch)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(tags) != 1 || tags[0] != "v1.0.0" {
+		t.Errorf("expected only v1.0.0 reachable from %s, got %v", mainBranch.Short(), tags)
+	}
+}
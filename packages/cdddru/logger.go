@@ -1,10 +1,16 @@
 package cdddru
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fatih/color"
 )
@@ -18,6 +24,14 @@ const (
 	ErrorLevel
 )
 
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogFormat is output format of loggers made by NewLogger: text (default) or json - one json record per line
+var LogFormat = strings.ToLower(GetEnvVar("CDDDRU_LOG_FORMAT", LogFormatText))
+
 type Logger struct {
 	debugLogger *log.Logger
 	infoLogger  *log.Logger
@@ -25,17 +39,55 @@ type Logger struct {
 	errorLogger *log.Logger
 	fatalLogger *log.Logger
 	logLevel    LogLevel
+
+	jobName  string
+	format   string
+	out      io.Writer
+	outError io.Writer
+	// release context added to json records
+	mu      sync.Mutex
+	step    string
+	release string
+	commit  string
+	// span of trace steps and commands of the job are children of
+	span *Span
+	// archive of records of release being run
+	archive *releaseArchive
+	// context of step being run, commands of the job are killed when it is done
+	ctx context.Context
+	// executor of commands of the job
+	executor Executor
+}
+
+// logRecord is one line of json log
+type logRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Job     string `json:"job"`
+	Step    string `json:"step,omitempty"`
+	Release string `json:"release,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+	Message string `json:"msg"`
 }
 
 func NewLogger(out io.Writer, outError io.Writer, level LogLevel, jobName string) *Logger {
 	if outError == nil {
 		outError = out
 	}
-	debugColor := color.New(color.FgHiCyan).SprintFunc()
-	infoColor := color.New(color.FgWhite).SprintFunc()
-	warnColor := color.New(color.FgHiYellow).SprintFunc()
-	errorColor := color.New(color.FgHiRed).SprintFunc()
-	fatalColor := color.New(color.FgHiMagenta).SprintFunc()
+	// colours are only for terminals - they are garbage in files and log collectors
+	colorFunc := func(w io.Writer, attr color.Attribute) func(a ...interface{}) string {
+		if !isTerminal(w) || IsStringNotEmpty(os.Getenv("NO_COLOR")) {
+			return fmt.Sprint
+		}
+		c := color.New(attr)
+		c.EnableColor()
+		return c.SprintFunc()
+	}
+	debugColor := colorFunc(out, color.FgHiCyan)
+	infoColor := colorFunc(out, color.FgWhite)
+	warnColor := colorFunc(out, color.FgHiYellow)
+	errorColor := colorFunc(outError, color.FgHiRed)
+	fatalColor := colorFunc(outError, color.FgHiMagenta)
 
 	debugLogger := log.New(out, debugColor(jobName+"->| DEBUG: "), log.Flags()|log.Llongfile)
 	warnLogger := log.New(out, warnColor(jobName+"->| WARNING: "), log.LstdFlags)
@@ -50,15 +102,205 @@ func NewLogger(out io.Writer, outError io.Writer, level LogLevel, jobName string
 		errorLogger: errorLogger,
 		fatalLogger: fatalLogger,
 		logLevel:    level,
+		jobName:     jobName,
+		format:      LogFormat,
+		out:         out,
+		outError:    outError,
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// SetFormat switches logger to text or json output
+func (l *Logger) SetFormat(format string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.format = format
+}
+
+// SetRelease sets release tag and commit added to json records, empty values clear them
+func (l *Logger) SetRelease(release, commit string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.release, l.commit = release, commit
+}
+
+// SetStep sets pipeline step added to json records, empty value clears it.
+// Records of the step are archived to own file if release log is open.
+func (l *Logger) SetStep(step string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.step = step
+	if l.archive != nil {
+		// archive stays with previous file if file of the step can not be opened
+		l.archive.open(step)
+	}
+}
+
+// SetSpan sets span which steps and commands of the job are traced as children of, nil clears it
+func (l *Logger) SetSpan(span *Span) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.span = span
+}
+
+// Span returns current span of the job or nil
+func (l *Logger) Span() *Span {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.span
+}
+
+// SetContext sets context of step being run - commands of the job are bound to it, nil clears it
+func (l *Logger) SetContext(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ctx = ctx
+}
+
+// SetExecutor sets executor commands of the job are run by, nil - OSExecutor
+func (l *Logger) SetExecutor(executor Executor) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.executor = executor
+}
+
+// CommandContext returns context which commands started with are run by executor of the job, traced as children
+// of current span of the job, have their output streamed to the logger and are killed when step being run is done
+func (l *Logger) CommandContext() context.Context {
+	ctx := context.Background()
+	var executor Executor
+	if l != nil {
+		l.mu.Lock()
+		if l.ctx != nil {
+			ctx = l.ctx
+		}
+		executor = l.executor
+		l.mu.Unlock()
+	}
+	ctx = ContextWithExecutor(context.WithValue(ctx, loggerContextKey{}, l), executor)
+	return ContextWithSpan(ctx, l.Span())
+}
+
+// CleanupContext is CommandContext for commands cleaning up after step: they run even if the step has timed out
+func (l *Logger) CleanupContext() context.Context {
+	return detachedContext{l.CommandContext()}
+}
+
+type loggerContextKey struct{}
+
+// LoggerFromContext returns logger of context or nil
+func LoggerFromContext(ctx context.Context) *Logger {
+	logger, _ := ctx.Value(loggerContextKey{}).(*Logger)
+	return logger
+}
+
+// lineWriter writes output of command to logger line by line as it comes
+type lineWriter struct {
+	logger *Logger
+	level  LogLevel
+	prefix string
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.print(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes the rest of output not ended with new line
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.print(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) print(line string) {
+	line = strings.TrimRight(line, "\r")
+	if len(strings.TrimSpace(line)) == 0 {
+		return
+	}
+	msg := fmt.Sprintf("%s | %s", w.prefix, line)
+	if w.level == DebugLevel {
+		w.logger.Debug(msg)
+		return
+	}
+	w.logger.Info(msg)
+}
+
+// archiveRecord writes message to archive of release being run, records of all levels are archived
+func (l *Logger) archiveRecord(level, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.archive != nil {
+		l.archive.write(level, Redact(msg))
+	}
+}
+
+// output writes message with text logger or as json records - one record per line of multi-line message
+func (l *Logger) output(textLogger *log.Logger, level string, msg string) {
+	msg = Redact(msg)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.format != LogFormatJSON {
+		textLogger.Output(3, msg+"\n")
+		return
+	}
+	out := l.out
+	if level == "error" || level == "fatal" {
+		out = l.outError
+	}
+	record := logRecord{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   level,
+		Job:     l.jobName,
+		Step:    l.step,
+		Release: l.release,
+		Commit:  l.commit,
+	}
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	for _, line := range strings.Split(strings.TrimRight(msg, "\n"), "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		record.Message = strings.TrimRight(line, "\r")
+		encoder.Encode(record)
+	}
+	if buf.Len() == 0 {
+		record.Message = msg
+		encoder.Encode(record)
 	}
+	out.Write(buf.Bytes())
 }
 
 func (l *Logger) Debug(msg string) {
 	if len(strings.TrimSpace(msg)) == 0 {
 		msg = "[passed empty message to logger]"
 	}
+	l.archiveRecord("debug", msg)
 	if l.logLevel <= DebugLevel {
-		l.debugLogger.Println(msg)
+		l.output(l.debugLogger, "debug", msg)
 	}
 }
 
@@ -67,8 +309,9 @@ func (l *Logger) Warning(msg string) {
 		msg = "[passed empty message to logger]"
 	}
 
+	l.archiveRecord("warning", msg)
 	if l.logLevel <= WarnLevel {
-		l.warnLogger.Println(msg)
+		l.output(l.warnLogger, "warning", msg)
 	}
 }
 
@@ -77,8 +320,9 @@ func (l *Logger) Info(msg string) {
 		msg = "[passed empty message to logger]"
 	}
 
+	l.archiveRecord("info", msg)
 	if l.logLevel <= InfoLevel {
-		l.infoLogger.Println(msg)
+		l.output(l.infoLogger, "info", msg)
 	}
 }
 
@@ -132,8 +376,9 @@ func (l *Logger) Error(msg string) {
 		msg = "[passed empty message to logger]"
 	}
 
+	l.archiveRecord("error", msg)
 	if l.logLevel <= ErrorLevel {
-		l.errorLogger.Println(msg)
+		l.output(l.errorLogger, "error", msg)
 	}
 }
 
@@ -142,8 +387,9 @@ func (l *Logger) Fatal(msg string) {
 		msg = "[passed empty message to logger]"
 	}
 
+	l.archiveRecord("fatal", msg)
 	if l.logLevel <= ErrorLevel {
-		l.fatalLogger.Println(msg)
+		l.output(l.fatalLogger, "fatal", msg)
 	}
 }
 
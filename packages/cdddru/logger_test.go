@@ -0,0 +1,65 @@
+package cdddru
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	var out, outError bytes.Buffer
+	logger := NewLogger(&out, &outError, InfoLevel, "main-site")
+	logger.SetFormat(LogFormatJSON)
+
+	logger.SetRelease("v1.0.1", "5d2f1c0")
+	logger.SetStep("build")
+	PrintInfo(logger, "#1 [internal] load build definition\n#2 [internal] load .dockerignore\n\n")
+	PrintDebug(logger, "hidden on info level")
+	logger.SetStep("")
+	logger.SetRelease("", "")
+	PrintError(logger, "build failed: <exit 1>")
+
+	records := make([]logRecord, 0)
+	scanner := bufio.NewScanner(strings.NewReader(out.String() + outError.String()))
+	for scanner.Scan() {
+		var record logRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("expected json record, got %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected every line of message to be a record, got %+v", records)
+	}
+	first := records[0]
+	if first.Level != "info" || first.Job != "main-site" || first.Step != "build" || first.Release != "v1.0.1" ||
+		first.Commit != "5d2f1c0" || first.Message != "#1 [internal] load build definition" {
+		t.Errorf("unexpected record %+v", first)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, first.Time); err != nil {
+		t.Errorf("expected RFC3339 time, got %q", first.Time)
+	}
+	if records[1].Message != "#2 [internal] load .dockerignore" {
+		t.Errorf("unexpected record %+v", records[1])
+	}
+	last := records[2]
+	if last.Level != "error" || last.Release != "" || last.Step != "" || last.Message != "build failed: <exit 1>" {
+		t.Errorf("unexpected record %+v", last)
+	}
+	if !strings.Contains(outError.String(), "<exit 1>") {
+		t.Errorf("expected errors in error output and html not escaped, got %q", outError.String())
+	}
+}
+
+func TestLoggerTextWithoutColours(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, nil, InfoLevel, "main-site")
+	logger.SetFormat(LogFormatText)
+	PrintWarning(logger, "check failed")
+	if !strings.HasPrefix(out.String(), "main-site->| WARNING: ") || strings.Contains(out.String(), "\x1b[") {
+		t.Errorf("expected plain text line, got %q", out.String())
+	}
+}
@@ -11,11 +11,12 @@ import (
 type DockerConfig struct {
 	DO_DOCKER_BUILD  bool     `json:"do_docker_build" yaml:"do_docker_build"`
 	DOCKER_FILE      string   `json:"docker_file" yaml:"docker_file"`
+	DOCKER_CONTEXT   string   `json:"docker_context" yaml:"docker_context"` // relative to repo root, default is repo root
 	DOCKER_IMAGE     string   `json:"docker_image" yaml:"docker_image"`
 	DOCKER_PLATFORMS []string `json:"docker_platforms" yaml:"docker_platforms"`
 	DOCKER_SERVER    string   `json:"docker_server" yaml:"docker_server"`
 	DOCKER_USER      string   `json:"docker_user" yaml:"docker_user"`
-	DOCKER_PASSWORD  string   `json:"docker_password" yaml:"docker_password"`
+	DOCKER_PASSWORD  string   `json:"docker_password" yaml:"docker_password" secret:"true"`
 	parentLink       *Config
 }
 
@@ -64,6 +65,7 @@ func (dkrcfg *DockerConfig) SetAuth(dockerConfigPath string) (err error) {
 
 	authStr := dockerUser + ":" + dockerToken
 	base64Auth := base64.StdEncoding.EncodeToString([]byte(authStr))
+	AddSecrets(dockerToken, base64Auth)
 
 	authEntries := map[string]string{dockerServer: base64Auth}
 
@@ -88,10 +90,11 @@ func (dcrcfg *DockerConfig) DockerImageBuildx(imageNameAndTag, contextPath strin
 	if err != nil {
 		return fmt.Errorf("docker build and push failed: %w", err)
 	}
-	var stdout string
-	stdout, err = RunExternalCmd("", "buildx error:", "docker", "buildx", "build",
-		"--push", "--platform", strings.Join(platforms, ","), "--progress=plain", "-t", imageNameAndTag, ".")
-	PrintInfo(logger, "%s", stdout)
-
-	return err
+	// progress of build is streamed to logger line by line
+	_, err = runCommand(logger.CommandContext(), Command{Name: "docker", Args: []string{"buildx", "build",
+		"--push", "--platform", strings.Join(platforms, ","), "--progress=plain", "-t", imageNameAndTag, "."}, Stream: true})
+	if err != nil {
+		return fmt.Errorf("buildx error: %w", err)
+	}
+	return nil
 }
@@ -1,17 +1,20 @@
 package cdddru
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	git "github.com/go-git/go-git/v5"
 	plumbing "github.com/go-git/go-git/v5/plumbing"
 	ssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	xssh "golang.org/x/crypto/ssh"
 	xagent "golang.org/x/crypto/ssh/agent"
+	"golang.org/x/exp/slices"
 )
 
 type GitConfig struct {
@@ -25,13 +28,44 @@ type GitConfig struct {
 	GIT_TAG_PREFIX     string `json:"git_tag_prefix" yaml:"git_tag_prefix"`
 	GIT_START_TAG_FILE string `json:"git_start_tag_file" yaml:"git_start_tag_file"`
 	GIT_LOCAL_FOLDER   string `json:"git_local_folder" yaml:"git_local_folder"`
-	branchName         string
-	publickeys         *ssh.PublicKeys
-	branch             plumbing.ReferenceName
-	parentLink         *Config
-	needAuth           bool
+	// consider only tags which commits are reachable from git_branch
+	GIT_TAGS_FROM_BRANCH_ONLY bool `json:"git_tags_from_branch_only,string,omitempty" yaml:"git_tags_from_branch_only"`
+	// limit clone and pull to the specified number of commits (0 - full history)
+	GIT_CLONE_DEPTH int `json:"git_clone_depth,omitempty" yaml:"git_clone_depth"`
+	// do not fetch all tags - list them on remote and fetch only the tag selected for release
+	GIT_FETCH_SELECTED_TAG_ONLY bool `json:"git_fetch_selected_tag_only,string,omitempty" yaml:"git_fetch_selected_tag_only"`
+	// checkout only directories the job uses (docker context, sync subfolder, manifest folder)
+	GIT_SPARSE_CHECKOUT bool `json:"git_sparse_checkout,string,omitempty" yaml:"git_sparse_checkout"`
+	// additional directories (relative to repo root) to checkout in sparse mode
+	GIT_SPARSE_DIRS []string `json:"git_sparse_dirs,omitempty" yaml:"git_sparse_dirs"`
+	// recursively update submodules at checked out release commit
+	GIT_SUBMODULES bool `json:"git_submodules,string,omitempty" yaml:"git_submodules"`
+	// replace git lfs pointers with real files at checked out release commit
+	GIT_LFS bool `json:"git_lfs,string,omitempty" yaml:"git_lfs"`
+	// how many times broken local clone may be moved aside and cloned again (0 - default 3, -1 - never)
+	GIT_MAX_RECLONES int `json:"git_max_reclones,omitempty" yaml:"git_max_reclones"`
+	// build and sync every release from its own immutable export of the tagged tree instead of git_local_folder
+	GIT_RELEASE_EXPORT bool `json:"git_release_export,string,omitempty" yaml:"git_release_export"`
+	// where release exports are stored (default is git_local_folder with ".releases" suffix)
+	GIT_RELEASES_FOLDER string `json:"git_releases_folder,omitempty" yaml:"git_releases_folder"`
+	// how many release exports to keep (0 - default 3)
+	GIT_RELEASES_KEEP int `json:"git_releases_keep,omitempty" yaml:"git_releases_keep"`
+	// secret of push webhooks of the repository which wake the job before check_interval passes
+	GIT_WEBHOOK_SECRET string `json:"git_webhook_secret,omitempty" yaml:"git_webhook_secret" secret:"true"`
+
+	branchName string
+	publickeys *ssh.PublicKeys
+	branch     plumbing.ReferenceName
+	parentLink *Config
+	needAuth   bool
+	reclones   int
 }
 
+const defaultMaxReclones = 3
+
+// ErrGitRepoBroken marks errors after which local clone can not be used anymore and should be cloned again
+var ErrGitRepoBroken = errors.New("local git repository is broken")
+
 func (gitcfg *GitConfig) AddKeyToSshAgent() (err error) {
 	var rawPrivateKeySsh []byte
 	cmdout := ""
@@ -62,9 +96,11 @@ func (gitcfg *GitConfig) AddKeyToSshAgent() (err error) {
 			}
 		}
 
+		AddSecrets(string(rawPrivateKeySsh))
+
 		if os.Getenv("SSH_AUTH_SOCK") == "" {
 			// Start a new ssh-agent
-			cmdout, err := RunExternalCmd("", "", "ssh-agent", "-s")
+			cmdout, err := RunExternalCmdContext(logger.CommandContext(), "", "", "ssh-agent", "-s")
 			if err != nil {
 				return fmt.Errorf("getting script for ssh agent failed: %w", err)
 			}
@@ -100,7 +136,7 @@ func (gitcfg *GitConfig) AddKeyToSshAgent() (err error) {
 			return fmt.Errorf("parsing ssh private key file %s failed: %w", privateKeyFile, err)
 		}
 
-		cmdout, err = RunExternalCmd("", "list ssh-agent failed", "ssh-add", "-l")
+		cmdout, err = RunExternalCmdContext(logger.CommandContext(), "", "list ssh-agent failed", "ssh-add", "-l")
 		CheckIfErrorFmt(logger, err, fmt.Errorf("add key to ssh-agent failed: %w", err), false)
 		PrintInfo(logger, "%s", cmdout)
 	}
@@ -110,11 +146,14 @@ func (gitcfg *GitConfig) AddKeyToSshAgent() (err error) {
 func (gitcfg *GitConfig) OpenOrCloneRepo(url string, logger *Logger) (gitRepository *git.Repository, gitWorkTree *git.Worktree, err error) {
 
 	PrintInfo(logger, "opening or cloning git repo: %s ...", url)
-	gitcfg.publickeys, err = ssh.NewPublicKeysFromFile("git", gitcfg.GIT_PRIVATE_KEY, "")
-	if err != nil {
-		err = fmt.Errorf("generate publickeys failed: %w", err)
-		return
-		// CheckIfError(logger, fmt.Errorf("generate publickeys failed: %w", err), true)
+	// local (file://) and http(s) remotes do not need ssh keys
+	if isSshURL(url) {
+		gitcfg.publickeys, err = ssh.NewPublicKeysFromFile("git", gitcfg.GIT_PRIVATE_KEY, "")
+		if err != nil {
+			err = fmt.Errorf("generate publickeys failed: %w", err)
+			return
+			// CheckIfError(logger, fmt.Errorf("generate publickeys failed: %w", err), true)
+		}
 	}
 
 	// Check if git repo exists in localRepoPath and open it, overwise - cloning
@@ -127,18 +166,38 @@ func (gitcfg *GitConfig) OpenOrCloneRepo(url string, logger *Logger) (gitReposit
 	if err == nil {
 		gitRepository, err = git.PlainOpen(gitcfg.GIT_LOCAL_FOLDER)
 		if err != nil {
-			err = fmt.Errorf("opening repository failed: %w", err)
+			err = fmt.Errorf("%w: opening repository failed: %v", ErrGitRepoBroken, err)
+			return
+		}
+		// PlainOpen does not read HEAD and objects, so damaged ones are found only here
+		var head *plumbing.Reference
+		if head, err = gitRepository.Head(); err == nil {
+			_, err = gitRepository.CommitObject(head.Hash())
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: reading HEAD commit failed: %v", ErrGitRepoBroken, err)
 			return
 		}
 		// CheckIfError(logger, err, true)
 	} else if os.IsNotExist(err) {
-		gitRepository, err = git.PlainClone(gitcfg.GIT_LOCAL_FOLDER, false, &git.CloneOptions{
-			Auth:          gitcfg.publickeys,
+		cloneOptions := &git.CloneOptions{
 			URL:           url,
 			SingleBranch:  true,
 			Progress:      os.Stdout,
 			ReferenceName: refName,
-		})
+			Depth:         gitcfg.GIT_CLONE_DEPTH,
+		}
+		if gitcfg.publickeys != nil {
+			cloneOptions.Auth = gitcfg.publickeys
+		}
+		if gitcfg.GIT_FETCH_SELECTED_TAG_ONLY {
+			cloneOptions.Tags = git.NoTags
+		}
+		// in sparse mode files will be populated by the first checkout with sparse directories
+		if len(gitcfg.SparseCheckoutDirs()) > 0 {
+			cloneOptions.NoCheckout = true
+		}
+		gitRepository, err = git.PlainCloneContext(logger.CommandContext(), gitcfg.GIT_LOCAL_FOLDER, false, cloneOptions)
 		if err != nil {
 			err = fmt.Errorf("cloning repository failed: %w", err)
 			return
@@ -155,24 +214,301 @@ func (gitcfg *GitConfig) OpenOrCloneRepo(url string, logger *Logger) (gitReposit
 	// Get the git worktree
 	gitWorkTree, err = gitRepository.Worktree()
 	if err != nil {
-		err = fmt.Errorf("getting worktree failed: %w", err)
+		err = fmt.Errorf("%w: getting worktree failed: %v", ErrGitRepoBroken, err)
 		return
 		// CheckIfError(logger, fmt.Errorf("failed to get worktree: %v", err.Error()), true)
 	}
 	return
 }
 
-func (gitcfg *GitConfig) CliPull(logger *Logger) (err error) {
-	err = os.Chdir(gitcfg.GIT_LOCAL_FOLDER)
+// OpenOrRecloneRepo works like OpenOrCloneRepo, but if existing local clone can not be opened
+// it is moved aside and cloned again.
+func (gitcfg *GitConfig) OpenOrRecloneRepo(url string, logger *Logger) (*git.Repository, *git.Worktree, error) {
+	gitRepository, gitWorkTree, err := gitcfg.OpenOrCloneRepo(url, logger)
+	if errors.Is(err, ErrGitRepoBroken) {
+		return gitcfg.RecloneRepo(url, err, logger)
+	}
+	return gitRepository, gitWorkTree, err
+}
+
+// RecloneRepo moves broken local clone aside (only the last broken copy is kept for investigation)
+// and clones repository again. Number of re-clones during job run is limited by git_max_reclones.
+func (gitcfg *GitConfig) RecloneRepo(url string, reason error, logger *Logger) (*git.Repository, *git.Worktree, error) {
+	localFolder := filepath.Clean(gitcfg.GIT_LOCAL_FOLDER)
+	maxReclones := gitcfg.GIT_MAX_RECLONES
+	if maxReclones == 0 {
+		maxReclones = defaultMaxReclones
+	}
+	if gitcfg.reclones >= maxReclones {
+		return nil, nil, fmt.Errorf("re-cloning of %s is not allowed (done %d times): %w", localFolder, gitcfg.reclones, reason)
+	}
+	gitcfg.reclones++
+
+	brokenFolder := fmt.Sprintf("%s.broken-%s", localFolder, time.Now().Format("20060102-150405"))
+	PrintWarning(logger, "%v", reason)
+	PrintWarning(logger, "moving local repo %s to %s and cloning it again (attempt %d of %d)",
+		localFolder, brokenFolder, gitcfg.reclones, maxReclones)
+
+	oldBrokenFolders, _ := filepath.Glob(localFolder + ".broken-*")
+	for _, oldBrokenFolder := range oldBrokenFolders {
+		if err := os.RemoveAll(oldBrokenFolder); err != nil {
+			PrintWarning(logger, "removing old broken copy %s failed: %v", oldBrokenFolder, err)
+		}
+	}
+	if err := os.Rename(localFolder, brokenFolder); err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("moving broken local repo %s aside failed: %w", localFolder, err)
+	}
+
+	gitRepository, gitWorkTree, err := gitcfg.OpenOrCloneRepo(url, logger)
 	if err != nil {
-		return fmt.Errorf("pulling git repository failed: %w", err)
+		return nil, nil, fmt.Errorf("re-cloning repo %s failed: %w", url, err)
+	}
+	PrintInfo(logger, "local repo %s re-cloned successfully", localFolder)
+	return gitRepository, gitWorkTree, nil
+}
+
+// CheckoutAndPull checks out git_branch dropping any local changes and updates it from remote.
+// States which can not be fixed in place are returned as ErrGitRepoBroken.
+func (gitcfg *GitConfig) CheckoutAndPull(gitWorkTree *git.Worktree, logger *Logger) error {
+	err := gitWorkTree.Checkout(gitcfg.CheckoutBranchOptions())
+	if err != nil {
+		return fmt.Errorf("%w: failed checkout %s branch: %v", ErrGitRepoBroken, gitcfg.GIT_BRANCH, err)
+	}
+
+	// in sparse mode status reports files out of sparse dirs as deleted, so we can not rely on it
+	if len(gitcfg.SparseCheckoutDirs()) == 0 {
+		if err = checkWorktreeIsClean(gitWorkTree); err != nil {
+			return err
+		}
+	}
+
+	err = gitcfg.CliPull(logger)
+	if err != nil {
+		if diverged, checkErr := gitcfg.isBranchDiverged(logger); checkErr != nil {
+			PrintDebug(logger, "comparing local and remote heads of %s failed: %v", gitcfg.GIT_BRANCH, checkErr)
+		} else if diverged {
+			return fmt.Errorf("%w: branch %s can not be updated from remote: %v", ErrGitRepoBroken, gitcfg.GIT_BRANCH, err)
+		}
+		return fmt.Errorf("git pull (external) failed: %w", err)
+	}
+	return nil
+}
+
+// isBranchDiverged reports if local head is not ancestor of remote head fetched by the last pull,
+// so branch can not be fast-forwarded whatever language git speaks
+func (gitcfg *GitConfig) isBranchDiverged(logger *Logger) (bool, error) {
+	_, err := runCommand(logger.CommandContext(), Command{Name: "git",
+		Args: []string{"-C", gitcfg.GIT_LOCAL_FOLDER, "merge-base", "--is-ancestor", "HEAD", "FETCH_HEAD"}})
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) && errors.Is(err, ErrCommandExit) && cmdErr.ExitCode == 1 {
+		return true, nil
+	}
+	return false, err
+}
+
+// checkWorktreeIsClean returns ErrGitRepoBroken if there are changed or untracked files (submodules are not counted)
+func checkWorktreeIsClean(gitWorkTree *git.Worktree) error {
+	status, err := gitWorkTree.Status()
+	if err != nil {
+		return fmt.Errorf("%w: getting worktree status failed: %v", ErrGitRepoBroken, err)
+	}
+	submodules, _ := gitWorkTree.Submodules()
+	for path, fileStatus := range status {
+		if fileStatus.Worktree == git.Unmodified && fileStatus.Staging == git.Unmodified {
+			continue
+		}
+		isSubmodule := false
+		for _, submodule := range submodules {
+			subPath := submodule.Config().Path
+			if path == subPath || strings.HasPrefix(path, subPath+"/") {
+				isSubmodule = true
+				break
+			}
+		}
+		if !isSubmodule {
+			return fmt.Errorf("%w: worktree is dirty after forced checkout:\n%s", ErrGitRepoBroken, status)
+		}
+	}
+	return nil
+}
+
+// isSshURL reports if git remote url uses ssh transport (scp-like user@host:path or ssh://)
+func isSshURL(url string) bool {
+	if strings.HasPrefix(url, "ssh://") || strings.HasPrefix(url, "git+ssh://") {
+		return true
+	}
+	if strings.Contains(url, "://") || strings.HasPrefix(url, "/") {
+		return false
 	}
+	return strings.Contains(url, "@") && strings.Contains(url, ":")
+}
+
+// Validate rejects combinations of options which can not work together
+func (gitcfg *GitConfig) Validate() error {
+	// tags are listed on remote and only the selected one is fetched, so there is no history to check them against
+	if gitcfg.GIT_TAGS_FROM_BRANCH_ONLY && gitcfg.GIT_FETCH_SELECTED_TAG_ONLY {
+		return fmt.Errorf("git_tags_from_branch_only can not be used with git_fetch_selected_tag_only")
+	}
+	return nil
+}
+
+// SparseCheckoutDirs returns directories (relative to repo root) to checkout in sparse mode.
+// Empty result means full checkout: sparse mode is off or some step needs the whole repo.
+func (gitcfg *GitConfig) SparseCheckoutDirs() []string {
+	if !gitcfg.GIT_SPARSE_CHECKOUT || gitcfg.parentLink == nil {
+		return nil
+	}
+	cfg := gitcfg.parentLink
+	dirs := make([]string, 0, len(gitcfg.GIT_SPARSE_DIRS)+3)
+
+	// returns false if path points to the repo root - so sparse checkout is useless
+	addDir := func(path string) bool {
+		path = strings.Trim(filepath.ToSlash(filepath.Clean(path)), "/")
+		if path == "" || path == "." {
+			return false
+		}
+		if !slices.Contains(dirs, path) {
+			dirs = append(dirs, path)
+		}
+		return true
+	}
+
+	for _, dir := range gitcfg.GIT_SPARSE_DIRS {
+		if !addDir(dir) {
+			return nil
+		}
+	}
+	for _, step := range cfg.Pipeline() {
+		switch step.TYPE {
+		case PipelineStepBuild:
+			if !addDir(cfg.DOCKER.DOCKER_CONTEXT) {
+				return nil
+			}
+		case PipelineStepSync:
+			sync := step.SyncConfig(cfg)
+			for _, mapping := range sync.Mappings() {
+				if !addDir(mapping.SOURCE) {
+					return nil
+				}
+			}
+		case PipelineStepDeploy, PipelineStepJob:
+			// manifest is needed only if it is taken from repo itself
+			if relPath, err := filepath.Rel(gitcfg.GIT_LOCAL_FOLDER, step.Manifests(cfg)); err == nil && !strings.HasPrefix(relPath, "..") {
+				if !addDir(filepath.Dir(relPath)) {
+					return nil
+				}
+			}
+		}
+	}
+	return dirs
+}
+
+// CheckoutBranchOptions returns options to checkout git_branch with respect to sparse checkout settings.
+func (gitcfg *GitConfig) CheckoutBranchOptions() *git.CheckoutOptions {
+	return &git.CheckoutOptions{
+		Branch:                    plumbing.ReferenceName(gitcfg.branchName),
+		Force:                     true,
+		SparseCheckoutDirectories: gitcfg.SparseCheckoutDirs(),
+	}
+}
+
+// CheckoutHashOptions returns options to checkout given commit with respect to sparse checkout settings.
+func (gitcfg *GitConfig) CheckoutHashOptions(hash plumbing.Hash) *git.CheckoutOptions {
+	return &git.CheckoutOptions{
+		Hash:                      hash,
+		SparseCheckoutDirectories: gitcfg.SparseCheckoutDirs(),
+	}
+}
+
+// PrepareCheckedOutRelease makes the checked out worktree complete: initialises submodules
+// and smudges lfs objects if we say so in config.
+func (gitcfg *GitConfig) PrepareCheckedOutRelease(gitWorkTree *git.Worktree, logger *Logger) error {
+	if gitcfg.GIT_SUBMODULES {
+		if err := gitcfg.UpdateSubmodules(gitWorkTree, logger); err != nil {
+			return err
+		}
+	}
+	if gitcfg.GIT_LFS {
+		count, err := gitcfg.SmudgeLfsObjects(gitcfg.GIT_LOCAL_FOLDER, logger)
+		if err != nil {
+			return fmt.Errorf("smudging lfs objects failed: %w", err)
+		}
+		PrintInfo(logger, "smudged %d lfs objects", count)
+	}
+	return nil
+}
+
+// UpdateSubmodules initialises and recursively updates submodules to commits recorded in checked out tree.
+// Submodules with ssh urls use the same key as the main repository.
+func (gitcfg *GitConfig) UpdateSubmodules(gitWorkTree *git.Worktree, logger *Logger) error {
+	submodules, err := gitWorkTree.Submodules()
+	if err != nil {
+		return fmt.Errorf("getting submodules failed: %w", err)
+	}
+	for _, submodule := range submodules {
+		options := &git.SubmoduleUpdateOptions{
+			Init:              true,
+			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+			Depth:             gitcfg.GIT_CLONE_DEPTH,
+		}
+		submoduleURL := submodule.Config().URL
+		if gitcfg.publickeys != nil && isSshURL(submoduleURL) {
+			options.Auth = gitcfg.publickeys
+		}
+		err = submodule.Update(options)
+		if err != nil {
+			return fmt.Errorf("updating submodule %s failed: %w", submodule.Config().Name, err)
+		}
+		PrintInfo(logger, "submodule %s updated from %s", submodule.Config().Path, submoduleURL)
+	}
+	return nil
+}
+
+func (gitcfg *GitConfig) CliPull(logger *Logger) (err error) {
+	args := []string{"-C", gitcfg.GIT_LOCAL_FOLDER, "pull", "-f"}
+	args = append(args, Tiif(gitcfg.GIT_FETCH_SELECTED_TAG_ONLY, "--no-tags", "--tags").(string))
+	if gitcfg.GIT_CLONE_DEPTH > 0 {
+		args = append(args, fmt.Sprintf("--depth=%d", gitcfg.GIT_CLONE_DEPTH))
+	}
+	args = append(args, "origin", gitcfg.GIT_BRANCH)
+
 	var stdout string
-	stdout, err = RunExternalCmd("", "pulling error:", "git", "pull", "-f", "--tags", "origin", gitcfg.GIT_BRANCH)
+	stdout, err = RunExternalCmdContext(logger.CommandContext(), "", "pulling error:", "git", args...)
 	PrintInfo(logger, "%s", stdout)
 	return err
 }
 
+// CliListRemoteTags returns names of tags with git_tag_prefix on remote without fetching them.
+func (gitcfg *GitConfig) CliListRemoteTags(logger *Logger) ([]string, error) {
+	stdout, err := RunExternalCmdContext(logger.CommandContext(), "", "listing remote tags error:", "git", "-C", gitcfg.GIT_LOCAL_FOLDER,
+		"ls-remote", "--tags", "--refs", "origin", "refs/tags/"+gitcfg.GIT_TAG_PREFIX+"*")
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, 4)
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		tags = append(tags, strings.TrimPrefix(fields[1], "refs/tags/"))
+	}
+	PrintDebug(logger, "remote tags with prefix %s: %v", gitcfg.GIT_TAG_PREFIX, tags)
+	return tags, nil
+}
+
+// CliFetchTag fetches (or moves if it was changed on remote) only one given tag.
+func (gitcfg *GitConfig) CliFetchTag(tag string, logger *Logger) error {
+	args := []string{"-C", gitcfg.GIT_LOCAL_FOLDER, "fetch", "-f", "--no-tags"}
+	if gitcfg.GIT_CLONE_DEPTH > 0 {
+		args = append(args, fmt.Sprintf("--depth=%d", gitcfg.GIT_CLONE_DEPTH))
+	}
+	args = append(args, "origin", fmt.Sprintf("+refs/tags/%s:refs/tags/%s", tag, tag))
+	stdout, err := RunExternalCmdContext(logger.CommandContext(), "", "fetching tag error:", "git", args...)
+	PrintDebug(logger, "fetch tag %s: %s", tag, stdout)
+	return err
+}
+
 func (gitcfg *GitConfig) Pull(gitWorkTree *git.Worktree, logger *Logger) (err error) {
 
 	err = gitWorkTree.Pull(&git.PullOptions{
@@ -0,0 +1,205 @@
+package cdddru
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+)
+
+func TestSparseCheckoutDirs(t *testing.T) {
+	config := Config{}
+	config.GIT.GIT_LOCAL_FOLDER = "/tmp/repo"
+	config.GIT.GIT_SPARSE_CHECKOUT = true
+	config.GIT.GIT_SPARSE_DIRS = []string{"scripts/"}
+	config.SYNC.DO_SUBFOLDER_SYNC = true
+	config.SYNC.GIT_SUB_FOLDER = "/assets/"
+	config.DEPLOY.DO_MANIFEST_DEPLOY = true
+	config.DEPLOY.MANIFESTS_K8S = "/tmp/repo/deploy/k8s/manifest.yaml"
+	config.SetParentLinks()
+
+	dirs := config.GIT.SparseCheckoutDirs()
+	expected := []string{"scripts", "assets", "deploy/k8s"}
+	if !reflect.DeepEqual(dirs, expected) {
+		t.Errorf("expected %v, got %v", expected, dirs)
+	}
+
+	// docker build from repo root needs the whole repo
+	config.DOCKER.DO_DOCKER_BUILD = true
+	if dirs = config.GIT.SparseCheckoutDirs(); dirs != nil {
+		t.Errorf("expected full checkout, got %v", dirs)
+	}
+
+	config.DOCKER.DOCKER_CONTEXT = "app"
+	config.GIT.GIT_SPARSE_CHECKOUT = false
+	if dirs = config.GIT.SparseCheckoutDirs(); dirs != nil {
+		t.Errorf("expected full checkout when sparse mode is off, got %v", dirs)
+	}
+}
+
+func TestGitConfigValidate(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "job.yaml")
+	content := "Common:\n  job_name: selected-tag\nGit:\n  git_fetch_selected_tag_only: true\n  git_tags_from_branch_only: true\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getOneConfig(configPath); err == nil || !strings.Contains(err.Error(), "git_tags_from_branch_only") {
+		t.Errorf("expected config with tags from branch only and selected tag only to be rejected, got %v", err)
+	}
+
+	config := Config{}
+	config.GIT.GIT_TAGS_FROM_BRANCH_ONLY = true
+	config.GIT.GIT_CLONE_DEPTH = 1
+	if err := config.GIT.Validate(); err != nil {
+		t.Errorf("expected shallow clone with tags from branch only to be valid, got %v", err)
+	}
+}
+
+func TestCliFetchSelectedTag(t *testing.T) {
+	remotePath := t.TempDir()
+	remoteRepo, err := git.PlainInit(remotePath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteWt, err := remoteRepo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstCommit := commitTestFile(t, remotePath, remoteWt, "a.txt", "a")
+	if _, err = remoteRepo.CreateTag("v1.0.0", firstCommit, nil); err != nil {
+		t.Fatal(err)
+	}
+	secondCommit := commitTestFile(t, remotePath, remoteWt, "b.txt", "b")
+	if _, err = remoteRepo.CreateTag("v1.0.1", secondCommit, nil); err != nil {
+		t.Fatal(err)
+	}
+	head, err := remoteRepo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{}
+	config.GIT.GIT_LOCAL_FOLDER = t.TempDir()
+	config.GIT.GIT_BRANCH = head.Name().Short()
+	config.GIT.GIT_TAG_PREFIX = "v"
+	config.GIT.GIT_CLONE_DEPTH = 1
+	config.GIT.GIT_FETCH_SELECTED_TAG_ONLY = true
+	config.SetParentLinks()
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+
+	localRepo, err := git.PlainClone(config.GIT.GIT_LOCAL_FOLDER, false, &git.CloneOptions{
+		URL:   "file://" + remotePath,
+		Depth: config.GIT.GIT_CLONE_DEPTH,
+		Tags:  git.NoTags,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := config.GIT.CliListRemoteTags(logger)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(tags) != 2 {
+		t.Errorf("expected 2 remote tags, got %v", tags)
+	}
+	if localTags, _ := GetTagsFromGitRepo(localRepo, "v"); len(localTags) != 0 {
+		t.Errorf("expected no local tags before fetch, got %v", localTags)
+	}
+
+	if err = config.GIT.CliFetchTag("v1.0.0", logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	hash, err := GetCommitHashByTag(localRepo, "v1.0.0")
+	if err != nil || hash != firstCommit.String() {
+		t.Errorf("expected v1.0.0 at %s, got %s (%v)", firstCommit, hash, err)
+	}
+	if _, err = GetCommitHashByTag(localRepo, "v1.0.1"); err == nil {
+		t.Errorf("expected v1.0.1 not to be fetched")
+	}
+}
+
+func TestRecloneBrokenRepo(t *testing.T) {
+	remotePath := t.TempDir()
+	remoteRepo, err := git.PlainInit(remotePath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteWt, err := remoteRepo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitTestFile(t, remotePath, remoteWt, "a.txt", "a")
+	head, err := remoteRepo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{}
+	config.GIT.GIT_LOCAL_FOLDER = filepath.Join(t.TempDir(), "repo")
+	config.GIT.GIT_BRANCH = head.Name().Short()
+	config.GIT.GIT_MAX_RECLONES = 1
+	config.SetParentLinks()
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+	url := "file://" + remotePath
+
+	_, wt, err := config.GIT.OpenOrRecloneRepo(url, logger)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// leftover file makes worktree dirty, but forced checkout cleans it
+	if err = os.WriteFile(filepath.Join(config.GIT.GIT_LOCAL_FOLDER, "leftover.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkWorktreeIsClean(wt); !errors.Is(err, ErrGitRepoBroken) {
+		t.Errorf("expected ErrGitRepoBroken for dirty worktree, got %v", err)
+	}
+	if err = config.GIT.CheckoutAndPull(wt, logger); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	// unreachable remote is not a reason to re-clone
+	if err = os.Rename(remotePath, remotePath+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err = config.GIT.CheckoutAndPull(wt, logger); err == nil || errors.Is(err, ErrGitRepoBroken) {
+		t.Errorf("expected pull error, got %v", err)
+	}
+	if err = os.Rename(remotePath+".moved", remotePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// local commit and remote one diverged
+	commitTestFile(t, config.GIT.GIT_LOCAL_FOLDER, wt, "local.txt", "local")
+	commitTestFile(t, remotePath, remoteWt, "a.txt", "remote")
+	if err = config.GIT.CheckoutAndPull(wt, logger); !errors.Is(err, ErrGitRepoBroken) {
+		t.Errorf("expected ErrGitRepoBroken for diverged branch, got %v", err)
+	}
+
+	// damaged .git can not be opened
+	if err = os.WriteFile(filepath.Join(config.GIT.GIT_LOCAL_FOLDER, ".git", "HEAD"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = config.GIT.OpenOrRecloneRepo(url, logger); err != nil {
+		t.Fatalf("expected broken repo to be re-cloned, got %v", err)
+	}
+	if broken, _ := filepath.Glob(config.GIT.GIT_LOCAL_FOLDER + ".broken-*"); len(broken) != 1 {
+		t.Errorf("expected broken clone to be moved aside, got %v", broken)
+	}
+	if isExist, _, _ := IsPathExists(filepath.Join(config.GIT.GIT_LOCAL_FOLDER, "a.txt")); !isExist {
+		t.Errorf("expected fresh clone to be checked out")
+	}
+
+	// limit is reached
+	if err = os.WriteFile(filepath.Join(config.GIT.GIT_LOCAL_FOLDER, ".git", "HEAD"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = config.GIT.OpenOrRecloneRepo(url, logger); err == nil {
+		t.Errorf("expected error when re-clone limit is reached")
+	}
+}
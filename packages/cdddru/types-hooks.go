@@ -0,0 +1,190 @@
+package cdddru
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	HookPreBuild   = "pre_build"
+	HookPostBuild  = "post_build"
+	HookPreSync    = "pre_sync"
+	HookPostSync   = "post_sync"
+	HookPreDeploy  = "pre_deploy"
+	HookPostDeploy = "post_deploy"
+	HookOnFailure  = "on_failure"
+	HookOnSuccess  = "on_success"
+
+	HookOnErrorFail     = "fail"
+	HookOnErrorContinue = "continue"
+
+	defaultHookTimeout = 300
+)
+
+// ErrHookFailed is returned when a hook with fail policy has not completed successfully
+var ErrHookFailed = errors.New("hook failed")
+
+// HooksConfig describes commands and k8s jobs run around steps of a release.
+// Hooks of one stage run one by one in given order, on_failure and on_success hooks run after the whole release.
+type HooksConfig struct {
+	PRE_BUILD   []Hook `json:"pre_build,omitempty" yaml:"pre_build"`
+	POST_BUILD  []Hook `json:"post_build,omitempty" yaml:"post_build"`
+	PRE_SYNC    []Hook `json:"pre_sync,omitempty" yaml:"pre_sync"`
+	POST_SYNC   []Hook `json:"post_sync,omitempty" yaml:"post_sync"`
+	PRE_DEPLOY  []Hook `json:"pre_deploy,omitempty" yaml:"pre_deploy"`
+	POST_DEPLOY []Hook `json:"post_deploy,omitempty" yaml:"post_deploy"`
+	ON_FAILURE  []Hook `json:"on_failure,omitempty" yaml:"on_failure"`
+	ON_SUCCESS  []Hook `json:"on_success,omitempty" yaml:"on_success"`
+
+	parentLink *Config
+}
+
+// Hook is a command or a k8s Job manifest. Command arguments and manifest are templates rendered with
+// the same data as k8s manifests ({{.Release}}, {{.Image}}). Commands get CDDDRU_JOB_NAME, CDDDRU_RELEASE,
+// CDDDRU_IMAGE, CDDDRU_HOOK_STAGE and (for on_failure) CDDDRU_ERROR env vars.
+type Hook struct {
+	// name in logs, command or manifest is used if empty
+	NAME string `json:"name,omitempty" yaml:"name"`
+	// command with arguments, must exit with zero code
+	COMMAND []string `json:"command,omitempty" yaml:"command"`
+	// path to template of k8s Job manifest, job is applied and waited for completion or failure
+	MANIFEST string `json:"manifest,omitempty" yaml:"manifest"`
+	// namespace of k8s job (default namespace_k8s of deploy section)
+	NAMESPACE string `json:"namespace,omitempty" yaml:"namespace"`
+	// seconds hook may take (0 - default 300)
+	TIMEOUT int `json:"timeout,omitempty" yaml:"timeout"`
+	// manifest hook: delete (default) - delete job when it is finished, delete-on-success - keep failed job, keep
+	JOB_CLEANUP string `json:"job_cleanup,omitempty" yaml:"job_cleanup"`
+	// fail (default) - release fails if hook fails, continue - error is only logged
+	ON_ERROR string `json:"on_error,omitempty" yaml:"on_error"`
+}
+
+// Hooks returns hooks of given stage
+func (hkcfg *HooksConfig) Hooks(stage string) []Hook {
+	switch stage {
+	case HookPreBuild:
+		return hkcfg.PRE_BUILD
+	case HookPostBuild:
+		return hkcfg.POST_BUILD
+	case HookPreSync:
+		return hkcfg.PRE_SYNC
+	case HookPostSync:
+		return hkcfg.POST_SYNC
+	case HookPreDeploy:
+		return hkcfg.PRE_DEPLOY
+	case HookPostDeploy:
+		return hkcfg.POST_DEPLOY
+	case HookOnFailure:
+		return hkcfg.ON_FAILURE
+	case HookOnSuccess:
+		return hkcfg.ON_SUCCESS
+	}
+	return nil
+}
+
+// RunHooks runs hooks of the stage one by one. It stops on the first failed hook with fail policy
+// and returns error wrapping ErrHookFailed, failed hooks with continue policy are only logged.
+func (hkcfg *HooksConfig) RunHooks(stage string, data ReleaseData, logger *Logger) error {
+	return hkcfg.runHooks(stage, hkcfg.Hooks(stage), data, nil, logger)
+}
+
+// RunFailureHooks runs on_failure hooks of the release failed with given reason, their errors are only logged
+func (hkcfg *HooksConfig) RunFailureHooks(data ReleaseData, reason interface{}, logger *Logger) {
+	err := hkcfg.runHooks(HookOnFailure, hkcfg.ON_FAILURE, data, []string{fmt.Sprintf("CDDDRU_ERROR=%v", reason)}, logger)
+	CheckIfError(logger, err, false)
+}
+
+func (hkcfg *HooksConfig) runHooks(stage string, hooks []Hook, data ReleaseData, env []string, logger *Logger) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	env = append(env,
+		"CDDDRU_JOB_NAME="+hkcfg.parentLink.COMMON.JOB_NAME,
+		"CDDDRU_RELEASE="+data.Release,
+		"CDDDRU_IMAGE="+data.Image,
+		"CDDDRU_HOOK_STAGE="+stage,
+	)
+	PrintInfo(logger, "start %s hooks of release %s: %d hooks", stage, data.Release, len(hooks))
+	for _, hook := range hooks {
+		span := logger.Span().StartChild(stage + " hook " + hook.Name())
+		_, err := hkcfg.runHook(ContextWithSpan(logger.CommandContext(), span), hook, data, env, logger)
+		span.SetError(err)
+		span.End()
+		if err == nil {
+			// output of hook is already streamed to logger
+			PrintInfo(logger, "%s hook %s completed", stage, hook.Name())
+			continue
+		}
+		if hook.ON_ERROR == HookOnErrorContinue {
+			PrintWarning(logger, "%s hook %s failed, continue: %v", stage, hook.Name(), err)
+			continue
+		}
+		return fmt.Errorf("%w: %s hook %s of %s: %v", ErrHookFailed, stage, hook.Name(), data.Release, err)
+	}
+	return nil
+}
+
+// Name is name of hook in logs
+func (hook Hook) Name() string {
+	if IsStringNotEmpty(hook.NAME) {
+		return hook.NAME
+	}
+	if IsStringNotEmpty(hook.MANIFEST) {
+		return hook.MANIFEST
+	}
+	return strings.Join(hook.COMMAND, " ")
+}
+
+func (hkcfg *HooksConfig) runHook(traceCtx context.Context, hook Hook, data ReleaseData, env []string,
+	logger *Logger) (string, error) {
+	switch hook.ON_ERROR {
+	case "", HookOnErrorFail, HookOnErrorContinue:
+	default:
+		return "", fmt.Errorf("unknown on_error policy %q", hook.ON_ERROR)
+	}
+	timeout := time.Duration(hook.TIMEOUT) * time.Second
+	if hook.TIMEOUT <= 0 {
+		timeout = defaultHookTimeout * time.Second
+	}
+	ctx, cancel := context.WithTimeout(traceCtx, timeout)
+	defer cancel()
+
+	if IsStringNotEmpty(hook.MANIFEST) {
+		return "", hkcfg.runJobHook(ctx, hook, data, timeout, logger)
+	}
+	if len(hook.COMMAND) == 0 {
+		return "", errors.New("neither command nor manifest is set")
+	}
+	command := make([]string, len(hook.COMMAND))
+	for i, arg := range hook.COMMAND {
+		rendered, err := RenderString(arg, data)
+		if err != nil {
+			return "", err
+		}
+		command[i] = rendered
+	}
+	return runHookCommand(ctx, "", env, command[0], command[1:]...)
+}
+
+// runJobHook runs k8s Job manifest like job step does: logs of its pods are streamed, the hook fails as soon as
+// the job fails and the job is cleaned up according to job_cleanup of the hook
+func (hkcfg *HooksConfig) runJobHook(ctx context.Context, hook Hook, data ReleaseData, timeout time.Duration,
+	logger *Logger) error {
+	if err := checkK8sJobCleanup(hook.JOB_CLEANUP); err != nil {
+		return err
+	}
+	manifest, err := GenerateManifest(hook.MANIFEST, data)
+	if err != nil {
+		return err
+	}
+	return hkcfg.parentLink.runK8sJobs(ctx, manifest, hook.NAMESPACE, hook.JOB_CLEANUP, timeout, data.Release, logger)
+}
+
+// runHookCommand runs command of hook (or kubectl) with extra environment and streams its output to logger,
+// it is killed when ctx is done
+func runHookCommand(ctx context.Context, stdinString string, env []string, commandName string, commandArgs ...string) (string, error) {
+	return runCommand(ctx, Command{Name: commandName, Args: commandArgs, Stdin: stdinString, Env: env, Stream: true})
+}
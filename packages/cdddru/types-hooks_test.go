@@ -0,0 +1,104 @@
+package cdddru
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHooks(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "hooks.log")
+	config := Config{}
+	config.COMMON.JOB_NAME = "main-site"
+	config.HOOKS.PRE_DEPLOY = []Hook{
+		{NAME: "migrate", COMMAND: []string{"sh", "-c", `echo "migrate $0 $CDDDRU_JOB_NAME $CDDDRU_HOOK_STAGE" >> ` + logFile, "{{.Release}}"}},
+		{NAME: "optional", COMMAND: []string{"sh", "-c", "exit 3"}, ON_ERROR: HookOnErrorContinue},
+		{NAME: "image", COMMAND: []string{"sh", "-c", `echo "image $CDDDRU_IMAGE" >> ` + logFile}},
+	}
+	config.HOOKS.POST_DEPLOY = []Hook{
+		{NAME: "slow", COMMAND: []string{"sleep", "5"}, TIMEOUT: 1},
+		{NAME: "never", COMMAND: []string{"sh", "-c", "echo never >> " + logFile}},
+	}
+	config.HOOKS.ON_FAILURE = []Hook{
+		{COMMAND: []string{"sh", "-c", `echo "failure $CDDDRU_RELEASE: $CDDDRU_ERROR" >> ` + logFile}},
+	}
+	config.SetParentLinks()
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+	data := ReleaseData{Release: "v1.0.1", Image: "ddru:v1.0.1"}
+
+	if err := config.HOOKS.RunHooks(HookPreDeploy, data, logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// no hooks for other stages
+	if err := config.HOOKS.RunHooks(HookPreBuild, data, logger); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	err := config.HOOKS.RunHooks(HookPostDeploy, data, logger)
+	if !errors.Is(err, ErrHookFailed) || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	config.HOOKS.RunFailureHooks(data, "deploy failed", logger)
+
+	content, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "migrate v1.0.1 main-site pre_deploy\nimage ddru:v1.0.1\nfailure v1.0.1: deploy failed\n"
+	if string(content) != expected {
+		t.Errorf("expected hooks output %q, got %q", expected, content)
+	}
+
+	config.HOOKS.PRE_SYNC = []Hook{{COMMAND: []string{"true"}, ON_ERROR: "ignore"}}
+	if err := config.HOOKS.RunHooks(HookPreSync, data, logger); !errors.Is(err, ErrHookFailed) {
+		t.Errorf("expected error for unknown on_error policy, got %v", err)
+	}
+}
+
+func TestRunJobHook(t *testing.T) {
+	k8sJobPollInterval = 10 * time.Millisecond
+	defer func() { k8sJobPollInterval = 5 * time.Second }()
+
+	manifest := filepath.Join(t.TempDir(), "job.yaml")
+	if err := os.WriteFile(manifest, []byte("kind: Job\nimage: \"{{.Image}}\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{}
+	config.DEPLOY.NAMESPACE_K8s = "test-app"
+	config.HOOKS.PRE_DEPLOY = []Hook{{MANIFEST: manifest, TIMEOUT: 60}}
+	config.SetParentLinks()
+	var out bytes.Buffer
+	logger := NewLogger(&out, &out, InfoLevel, "test")
+	data := ReleaseData{Release: "v1.0.1", Image: "ddru:v1.0.1"}
+
+	executor := fakeK8sJobExecutor("Complete=True")
+	logger.SetExecutor(executor)
+	if err := config.HOOKS.RunHooks(HookPreDeploy, data, logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	calls := kubectlCalls(executor)
+	if !strings.HasPrefix(calls, "-n test-app apply -f - -o name\nkind: Job\nimage: ddru:v1.0.1\n") {
+		t.Errorf("expected rendered manifest to be applied, got calls:\n%s", calls)
+	}
+	if !strings.Contains(calls, "-n test-app delete --ignore-not-found job.batch/migrate-v1.0.1") {
+		t.Errorf("expected completed job to be deleted, got calls:\n%s", calls)
+	}
+	if !strings.Contains(out.String(), "migrate-v1.0.1 | applying migration 0042") {
+		t.Errorf("expected logs of job pods in job logger, got:\n%s", out.String())
+	}
+
+	// failed job fails the hook at once instead of waiting for timeout of the hook
+	logger.SetExecutor(fakeK8sJobExecutor("Failed=True"))
+	started := time.Now()
+	if err := config.HOOKS.RunHooks(HookPreDeploy, data, logger); !errors.Is(err, ErrHookFailed) ||
+		!strings.Contains(err.Error(), ErrK8sJobFailed.Error()) {
+		t.Errorf("expected failed job to fail the hook, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("expected failed job to be detected promptly, took %v", elapsed)
+	}
+}
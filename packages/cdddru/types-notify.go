@@ -0,0 +1,263 @@
+package cdddru
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	NotifyReleaseStarted    = "release_started"
+	NotifyReleaseSucceeded  = "release_succeeded"
+	NotifyReleaseFailed     = "release_failed"
+	NotifyReleaseRolledBack = "release_rolled_back"
+	NotifyJobCrashed        = "job_crashed"
+
+	NotifySinkTelegram = "telegram"
+	NotifySinkSlack    = "slack"
+	NotifySinkWebhook  = "webhook"
+	NotifySinkEmail    = "email"
+
+	defaultTelegramAPI   = "https://api.telegram.org"
+	defaultNotifyMessage = "[{{.Job}}] {{.Title}}{{if .Release}} {{.Release}}{{end}}" +
+		"{{if .ShortCommit}} ({{.ShortCommit}}{{if .Author}} by {{.Author}}{{end}}){{end}}" +
+		"{{if .Duration}} in {{.Duration}}{{end}}{{if .CommitMessage}}\n{{.CommitMessage}}{{end}}{{if .Error}}\nerror: {{.Error}}{{end}}"
+	defaultNotifySubject = "[{{.Job}}] {{.Title}}{{if .Release}} {{.Release}}{{end}}"
+)
+
+// notifyTitles are human readable names of events used by default message template
+var notifyTitles = map[string]string{
+	NotifyReleaseStarted:    "release started",
+	NotifyReleaseSucceeded:  "release succeeded",
+	NotifyReleaseFailed:     "release failed",
+	NotifyReleaseRolledBack: "release rolled back",
+	NotifyJobCrashed:        "job crashed",
+}
+
+// NotifyConfig describes where events of releases and job are sent.
+// Notifications never fail a release - errors of sinks are only logged.
+type NotifyConfig struct {
+	SINKS []NotifySink `json:"sinks,omitempty" yaml:"sinks"`
+	// template of messages of all sinks, default is short line with tag, commit, author and duration
+	MESSAGE string `json:"message,omitempty" yaml:"message"`
+
+	parentLink *Config
+}
+
+// NotifySink is telegram chat, slack-compatible incoming webhook, generic json webhook or email recipients.
+// Message and subject are templates rendered with NotifyData: {{.Job}}, {{.Event}}, {{.Title}}, {{.Release}},
+// {{.Image}}, {{.Commit}}, {{.ShortCommit}}, {{.CommitMessage}}, {{.Author}}, {{.Duration}}, {{.Summary}}, {{.Error}}.
+type NotifySink struct {
+	// name in logs, type is used if empty
+	NAME string `json:"name,omitempty" yaml:"name"`
+	// telegram, slack, webhook or email
+	TYPE string `json:"type" yaml:"type"`
+	// events sent to the sink (empty - all): release_started, release_succeeded, release_failed, release_rolled_back, job_crashed
+	EVENTS []string `json:"events,omitempty" yaml:"events"`
+	// template of message of the sink (default is message of notify section)
+	MESSAGE string `json:"message,omitempty" yaml:"message"`
+	// url of slack or generic webhook, base url of telegram bot api (default https://api.telegram.org)
+	URL string `json:"url,omitempty" yaml:"url" secret:"true"`
+	// telegram bot token and chat
+	TELEGRAM_TOKEN   string `json:"telegram_token,omitempty" yaml:"telegram_token" secret:"true"`
+	TELEGRAM_CHAT_ID string `json:"telegram_chat_id,omitempty" yaml:"telegram_chat_id"`
+	// smtp server host:port, plain auth is used if user is set
+	SMTP_ADDR     string   `json:"smtp_addr,omitempty" yaml:"smtp_addr"`
+	SMTP_USER     string   `json:"smtp_user,omitempty" yaml:"smtp_user"`
+	SMTP_PASSWORD string   `json:"smtp_password,omitempty" yaml:"smtp_password" secret:"true"`
+	EMAIL_FROM    string   `json:"email_from,omitempty" yaml:"email_from"`
+	EMAIL_TO      []string `json:"email_to,omitempty" yaml:"email_to"`
+	// template of email subject
+	SUBJECT string `json:"subject,omitempty" yaml:"subject"`
+	// seconds sending may take (0 - default 10)
+	TIMEOUT int `json:"timeout,omitempty" yaml:"timeout"`
+}
+
+// NotifyData is data of notification templates
+type NotifyData struct {
+	Job           string `json:"job"`
+	Event         string `json:"event"`
+	Title         string `json:"title"`
+	Release       string `json:"release,omitempty"`
+	Image         string `json:"image,omitempty"`
+	Commit        string `json:"commit,omitempty"`
+	ShortCommit   string `json:"-"`
+	CommitMessage string `json:"commit_message,omitempty"`
+	Author        string `json:"author,omitempty"`
+	Duration      string `json:"duration,omitempty"`
+	Summary       string `json:"summary,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// Name is name of sink in logs
+func (sink NotifySink) Name() string {
+	if IsStringNotEmpty(sink.NAME) {
+		return sink.NAME
+	}
+	return sink.TYPE
+}
+
+// Notify sends event to sinks subscribed to it, errors of sinks are logged as warnings
+func (ntfcfg *NotifyConfig) Notify(event string, data NotifyData, logger *Logger) {
+	data.Event, data.Title = event, notifyTitles[event]
+	if len(data.Commit) > 7 {
+		data.ShortCommit = data.Commit[:7]
+	} else {
+		data.ShortCommit = data.Commit
+	}
+	data.CommitMessage = strings.TrimSpace(data.CommitMessage)
+	for _, sink := range ntfcfg.SINKS {
+		if len(sink.EVENTS) > 0 && !slices.Contains(sink.EVENTS, event) {
+			continue
+		}
+		err := ntfcfg.send(sink, data)
+		if err != nil {
+			PrintWarning(logger, "notification %s to %s failed: %v", event, sink.Name(), err)
+			continue
+		}
+		PrintDebug(logger, "notification %s is sent to %s", event, sink.Name())
+	}
+}
+
+// send renders message of sink and delivers it
+func (ntfcfg *NotifyConfig) send(sink NotifySink, data NotifyData) error {
+	template := sink.MESSAGE
+	if IsStringEmpty(template) {
+		template = Tiif(IsStringEmpty(ntfcfg.MESSAGE), defaultNotifyMessage, ntfcfg.MESSAGE).(string)
+	}
+	message, err := RenderString(template, data)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(sink.TIMEOUT) * time.Second
+	if sink.TIMEOUT <= 0 {
+		timeout = defaultNotifyTimeout * time.Second
+	}
+
+	switch sink.TYPE {
+	case NotifySinkTelegram:
+		if IsStringEmpty(sink.TELEGRAM_TOKEN) || IsStringEmpty(sink.TELEGRAM_CHAT_ID) {
+			return fmt.Errorf("telegram_token and telegram_chat_id are required")
+		}
+		api := Tiif(IsStringEmpty(sink.URL), defaultTelegramAPI, sink.URL).(string)
+		return postJson(strings.TrimSuffix(api, "/")+"/bot"+sink.TELEGRAM_TOKEN+"/sendMessage",
+			map[string]string{"chat_id": sink.TELEGRAM_CHAT_ID, "text": message}, timeout)
+	case NotifySinkSlack:
+		return postJson(sink.URL, map[string]string{"text": message}, timeout)
+	case NotifySinkWebhook:
+		return postJson(sink.URL, struct {
+			NotifyData
+			Message string `json:"message"`
+		}{data, message}, timeout)
+	case NotifySinkEmail:
+		return sendEmail(sink, data, message, timeout)
+	}
+	return fmt.Errorf("unknown notification sink type %q", sink.TYPE)
+}
+
+// postJson posts data as json and expects 2xx status
+func postJson(url string, data interface{}, timeout time.Duration) error {
+	if IsStringEmpty(url) {
+		return fmt.Errorf("url is not set")
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded %s", strings.SplitN(url, "?", 2)[0], resp.Status)
+	}
+	return nil
+}
+
+// sendEmail sends message to recipients of sink through its smtp server
+func sendEmail(sink NotifySink, data NotifyData, message string, timeout time.Duration) error {
+	if IsStringEmpty(sink.SMTP_ADDR) || IsStringEmpty(sink.EMAIL_FROM) || len(sink.EMAIL_TO) == 0 {
+		return fmt.Errorf("smtp_addr, email_from and email_to are required")
+	}
+	subject, err := RenderString(Tiif(IsStringEmpty(sink.SUBJECT), defaultNotifySubject, sink.SUBJECT).(string), data)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if IsStringNotEmpty(sink.SMTP_USER) {
+		auth = smtp.PlainAuth("", sink.SMTP_USER, sink.SMTP_PASSWORD, strings.Split(sink.SMTP_ADDR, ":")[0])
+	}
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		sink.EMAIL_FROM, strings.Join(sink.EMAIL_TO, ", "), strings.ReplaceAll(subject, "\n", " "),
+		strings.ReplaceAll(message, "\n", "\r\n"))
+
+	// the whole smtp dialog is bound by deadline of connection, so stuck server does not keep it open
+	conn, err := net.DialTimeout("tcp", sink.SMTP_ADDR, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	err = sendSMTPMessage(conn, sink, auth, []byte(body))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return fmt.Errorf("sending email through %s timed out: %w", sink.SMTP_ADDR, err)
+	}
+	return err
+}
+
+// sendSMTPMessage sends message over connection as smtp.SendMail does: with STARTTLS if server supports it
+func sendSMTPMessage(conn net.Conn, sink NotifySink, auth smtp.Auth, message []byte) error {
+	host, _, _ := net.SplitHostPort(sink.SMTP_ADDR)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err = client.Hello("localhost"); err != nil {
+		return err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp server %s does not support authentication", sink.SMTP_ADDR)
+		}
+		if err = client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(sink.EMAIL_FROM); err != nil {
+		return err
+	}
+	for _, to := range sink.EMAIL_TO {
+		if err = client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(message); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
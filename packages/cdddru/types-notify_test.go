@@ -0,0 +1,170 @@
+package cdddru
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startFakeSMTP serves minimal smtp dialog on localhost and returns its address and received messages
+func startFakeSMTP(t *testing.T) (addr string, messages func() []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var mu sync.Mutex
+	received := make([]string, 0)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				conn.Write([]byte("220 localhost fake smtp\r\n"))
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch command := strings.ToUpper(strings.TrimSpace(line)); {
+					case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+						conn.Write([]byte("250 localhost\r\n"))
+					case command == "DATA":
+						conn.Write([]byte("354 go ahead\r\n"))
+						var data strings.Builder
+						for {
+							dataLine, err := reader.ReadString('\n')
+							if err != nil || dataLine == ".\r\n" {
+								break
+							}
+							data.WriteString(dataLine)
+						}
+						mu.Lock()
+						received = append(received, data.String())
+						mu.Unlock()
+						conn.Write([]byte("250 queued\r\n"))
+					case command == "QUIT":
+						conn.Write([]byte("221 bye\r\n"))
+						return
+					default:
+						conn.Write([]byte("250 ok\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, received...)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]map[string]interface{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		payload := make(map[string]interface{})
+		json.Unmarshal(body, &payload)
+		mu.Lock()
+		requests[r.URL.Path] = payload
+		mu.Unlock()
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	smtpAddr, emails := startFakeSMTP(t)
+
+	config := &Config{}
+	config.NOTIFY.SINKS = []NotifySink{
+		{TYPE: NotifySinkTelegram, URL: server.URL, TELEGRAM_TOKEN: "123:bot-token", TELEGRAM_CHAT_ID: "-100500"},
+		{TYPE: NotifySinkSlack, URL: server.URL + "/slack", EVENTS: []string{NotifyReleaseFailed}},
+		{TYPE: NotifySinkWebhook, URL: server.URL + "/webhook", MESSAGE: "{{.Release}} by {{.Author}}: {{.Event}}"},
+		{NAME: "ops mail", TYPE: NotifySinkEmail, SMTP_ADDR: smtpAddr, EMAIL_FROM: "cdddru@example.com",
+			EMAIL_TO: []string{"ops@example.com"}, EVENTS: []string{NotifyReleaseSucceeded}},
+		{NAME: "broken", TYPE: NotifySinkSlack, URL: server.URL + "/broken"},
+	}
+	config.SetParentLinks()
+	var out bytes.Buffer
+	logger := NewLogger(&out, &out, InfoLevel, "test")
+	data := NotifyData{Job: "main-site", Release: "v1.0.1", Commit: "5d2f1c0a9b8e", Author: "Alex",
+		CommitMessage: "fix header\n", Duration: "42s"}
+
+	config.NOTIFY.Notify(NotifyReleaseSucceeded, data, logger)
+
+	telegram := requests["/bot123:bot-token/sendMessage"]
+	if telegram == nil || telegram["chat_id"] != "-100500" ||
+		telegram["text"] != "[main-site] release succeeded v1.0.1 (5d2f1c0 by Alex) in 42s\nfix header" {
+		t.Errorf("unexpected telegram message %v", telegram)
+	}
+	if requests["/slack"] != nil {
+		t.Errorf("expected slack sink to get only failures, got %v", requests["/slack"])
+	}
+	webhook := requests["/webhook"]
+	if webhook == nil || webhook["message"] != "v1.0.1 by Alex: release_succeeded" || webhook["commit"] != "5d2f1c0a9b8e" {
+		t.Errorf("unexpected webhook payload %v", webhook)
+	}
+	mails := emails()
+	if len(mails) != 1 || !strings.Contains(mails[0], "Subject: [main-site] release succeeded v1.0.1\r\n") ||
+		!strings.Contains(mails[0], "To: ops@example.com") {
+		t.Errorf("unexpected emails %q", mails)
+	}
+	if !strings.Contains(out.String(), "notification release_succeeded to broken failed") {
+		t.Errorf("expected failed sink to be logged, got:\n%s", out.String())
+	}
+
+	data.Error = "step deploy failed"
+	config.NOTIFY.Notify(NotifyReleaseFailed, data, logger)
+	if slack := requests["/slack"]; slack == nil || !strings.HasSuffix(slack["text"].(string), "\nerror: step deploy failed") {
+		t.Errorf("unexpected slack message %v", slack)
+	}
+	if len(emails()) != 1 {
+		t.Errorf("expected email sink to get only successes, got %q", emails())
+	}
+}
+
+func TestSendEmailTimeout(t *testing.T) {
+	// server accepts connection and never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	sink := NotifySink{TYPE: NotifySinkEmail, SMTP_ADDR: listener.Addr().String(), EMAIL_FROM: "cdddru@example.com",
+		EMAIL_TO: []string{"ops@example.com"}}
+	start := time.Now()
+	err = sendEmail(sink, NotifyData{Job: "main-site", Release: "v1.0.1"}, "message", 300*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected timeout error, got %v after %v", err, time.Since(start))
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected connection to stuck smtp server to be closed on timeout")
+	}
+}
@@ -0,0 +1,459 @@
+package cdddru
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	PipelineStepBuild  = "build"
+	PipelineStepSync   = "sync"
+	PipelineStepDeploy = "deploy"
+	PipelineStepHook   = "hook"
+	PipelineStepVerify = "verify"
+	PipelineStepNotify = "notify"
+	PipelineStepJob    = "job"
+
+	PipelineWhenSuccess = "success"
+	PipelineWhenFailure = "failure"
+	PipelineWhenAlways  = "always"
+
+	StepSucceeded = "succeeded"
+	StepFailed    = "failed"
+	StepPending   = "pending"
+	StepSkipped   = "skipped"
+
+	defaultNotifyTimeout = 10
+)
+
+// deploySleep waits for applied manifests to take effect until step is done, replaced in tests
+var deploySleep = sleepContext
+
+// ErrReleaseNotApplied is returned by deploy step if cluster does not run the release after waiting - it is applied again later
+var ErrReleaseNotApplied = errors.New("release is not applied")
+
+// PipelineStep is one step of release pipeline. Steps run in given order, by default a step runs
+// only if all previous steps succeeded.
+type PipelineStep struct {
+	// name in logs and results, type is used if empty
+	NAME string `json:"name,omitempty" yaml:"name"`
+	// build, sync, deploy, job, hook, verify or notify
+	TYPE string `json:"type" yaml:"type"`
+	// success (default) - all previous steps succeeded, failure - some step failed, always
+	WHEN string `json:"when,omitempty" yaml:"when"`
+	// run only for releases which tag matches regexp
+	TAG_REGEX string `json:"tag_regex,omitempty" yaml:"tag_regex"`
+	// fail (default) - failed step fails release, continue - error is only recorded
+	ON_ERROR string `json:"on_error,omitempty" yaml:"on_error"`
+	// sync step: mappings used instead of Sync section ones
+	SYNC_MAPPINGS []SyncMapping `json:"sync_mappings,omitempty" yaml:"sync_mappings"`
+	// deploy step: manifest template used instead of Deploy section one, job step: template of k8s Job manifest
+	MANIFESTS_K8S string `json:"manifests_k8s,omitempty" yaml:"manifests_k8s"`
+	// job step: namespace of k8s job (default namespace_k8s of deploy section)
+	NAMESPACE string `json:"namespace,omitempty" yaml:"namespace"`
+	// seconds the step may take - its commands are killed when they pass (0 - not limited, every command is limited
+	// by CDDDRU_COMMAND_TIMEOUT), job step: seconds to wait for the job to complete (0 - default 600)
+	TIMEOUT int `json:"timeout,omitempty" yaml:"timeout"`
+	// job step: delete (default) - delete job when it is finished, delete-on-success - keep failed job for investigation, keep
+	JOB_CLEANUP string `json:"job_cleanup,omitempty" yaml:"job_cleanup"`
+	// hook step: hooks to run
+	HOOKS []Hook `json:"hooks,omitempty" yaml:"hooks"`
+	// verify step: checks to run
+	CHECKS []VerifyCheck `json:"checks,omitempty" yaml:"checks"`
+	// notify step: url json with results of release is posted to
+	URL string `json:"url,omitempty" yaml:"url"`
+}
+
+// PipelineRun is state of one release passing through pipeline
+type PipelineRun struct {
+	Data ReleaseData
+	// folder with files of the release
+	ReleaseFolder string
+	// seconds spent waiting for deploy to take effect
+	WaitSeconds int
+	Steps       []StepResult
+}
+
+// StepResult is result of one pipeline step
+type StepResult struct {
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+	// failed step with continue policy does not fail release
+	ContinueOnError bool `json:"continue_on_error,omitempty"`
+}
+
+// Status is succeeded if all steps succeeded (or are allowed to fail), pending if deploy is not applied yet, failed otherwise
+func (run *PipelineRun) Status() string {
+	status := StepSucceeded
+	for _, step := range run.Steps {
+		switch step.Status {
+		case StepFailed:
+			if !step.ContinueOnError {
+				return StepFailed
+			}
+		case StepPending:
+			status = StepPending
+		}
+	}
+	return status
+}
+
+// Summary is one line with status of every step
+func (run *PipelineRun) Summary() string {
+	parts := make([]string, 0, len(run.Steps))
+	for _, step := range run.Steps {
+		parts = append(parts, fmt.Sprintf("%s: %s", step.Name, step.Status))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Name is name of step in logs
+func (step PipelineStep) Name() string {
+	if IsStringNotEmpty(step.NAME) {
+		return step.NAME
+	}
+	return step.TYPE
+}
+
+// SyncConfig returns Sync section of the job with mappings of sync step if they are given
+func (step PipelineStep) SyncConfig(cfg *Config) SyncConfig {
+	sync := cfg.SYNC
+	if len(step.SYNC_MAPPINGS) > 0 {
+		sync.SYNC_MAPPINGS = step.SYNC_MAPPINGS
+	}
+	return sync
+}
+
+// Manifests returns path to manifest template of deploy step
+func (step PipelineStep) Manifests(cfg *Config) string {
+	if IsStringNotEmpty(step.MANIFESTS_K8S) {
+		return step.MANIFESTS_K8S
+	}
+	return cfg.DEPLOY.MANIFESTS_K8S
+}
+
+// Pipeline returns steps of the job. If steps are not given in job file, pipeline
+// of build, sync and deploy steps is made according to do_docker_build, do_subfolder_sync and do_manifest_deploy flags.
+func (cfg *Config) Pipeline() []PipelineStep {
+	if len(cfg.STEPS) > 0 {
+		return cfg.STEPS
+	}
+	steps := make([]PipelineStep, 0, 3)
+	if cfg.DOCKER.DO_DOCKER_BUILD {
+		steps = append(steps, PipelineStep{TYPE: PipelineStepBuild})
+	}
+	if cfg.SYNC.DO_SUBFOLDER_SYNC {
+		steps = append(steps, PipelineStep{TYPE: PipelineStepSync})
+	}
+	if cfg.DEPLOY.DO_MANIFEST_DEPLOY {
+		steps = append(steps, PipelineStep{TYPE: PipelineStepDeploy})
+	}
+	return steps
+}
+
+// HasPipelineStep reports if pipeline has a step of given type
+func (cfg *Config) HasPipelineStep(stepType string) bool {
+	for _, step := range cfg.Pipeline() {
+		if step.TYPE == stepType {
+			return true
+		}
+	}
+	return false
+}
+
+// RunPipeline runs steps of pipeline for the release and records their results in run.
+// on_success or on_failure hooks are run at the end, release with pending deploy is neither succeeded nor failed.
+func (cfg *Config) RunPipeline(run *PipelineRun, logger *Logger) error {
+	var errs []error
+	for _, step := range cfg.Pipeline() {
+		result := StepResult{Name: step.Name(), Type: step.TYPE, Status: StepSkipped}
+		if isRun, err := step.shouldRun(run); err != nil || !isRun {
+			if err != nil {
+				result.Status, result.Error = StepFailed, err.Error()
+				errs = append(errs, err)
+			}
+			run.Steps = append(run.Steps, result)
+			continue
+		}
+
+		logger.SetStep(step.Name())
+		PrintInfo(logger, "start step %s of release %s", step.Name(), run.Data.Release)
+		releaseSpan := logger.Span()
+		stepSpan := releaseSpan.StartChild("step " + step.Name())
+		stepSpan.SetAttribute("cdddru.step.type", step.TYPE)
+		logger.SetSpan(stepSpan)
+		stepCtx, cancelStep := context.Background(), context.CancelFunc(func() {})
+		if step.TIMEOUT > 0 {
+			stepCtx, cancelStep = context.WithTimeout(context.Background(), time.Duration(step.TIMEOUT)*time.Second)
+		}
+		logger.SetContext(stepCtx)
+		start := time.Now()
+		err := cfg.runStep(step, run, logger)
+		result.Duration = time.Since(start)
+		if err != nil && errors.Is(stepCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("step timed out after %ds: %w", step.TIMEOUT, err)
+		}
+		logger.SetContext(nil)
+		cancelStep()
+		GetJobMetrics(cfg.COMMON.JOB_NAME).ObserveStep(step.TYPE, result.Duration)
+		logger.SetSpan(releaseSpan)
+		stepSpan.SetAttribute("duration_ms", result.Duration.Milliseconds())
+		stepSpan.SetError(err)
+		stepSpan.End()
+		switch {
+		case err == nil:
+			result.Status = StepSucceeded
+			PrintInfo(logger, "step %s of release %s succeeded in %v", step.Name(), run.Data.Release, result.Duration.Round(time.Second))
+		case errors.Is(err, ErrReleaseNotApplied):
+			result.Status, result.Error = StepPending, err.Error()
+			PrintWarning(logger, "step %s of release %s is pending: %v", step.Name(), run.Data.Release, err)
+		case step.ON_ERROR == HookOnErrorContinue:
+			result.Status, result.Error, result.ContinueOnError = StepFailed, err.Error(), true
+			PrintWarning(logger, "step %s of release %s failed, continue: %v", step.Name(), run.Data.Release, err)
+		default:
+			result.Status, result.Error = StepFailed, err.Error()
+			errs = append(errs, fmt.Errorf("step %s failed: %w", step.Name(), err))
+			PrintError(logger, "step %s of release %s failed: %v", step.Name(), run.Data.Release, err)
+		}
+		run.Steps = append(run.Steps, result)
+	}
+	logger.SetStep("")
+
+	switch run.Status() {
+	case StepSucceeded:
+		err := cfg.HOOKS.RunHooks(HookOnSuccess, run.Data, logger)
+		CheckIfError(logger, err, false)
+	case StepFailed:
+		cfg.HOOKS.RunFailureHooks(run.Data, errors.Join(errs...), logger)
+	case StepPending:
+		return ErrReleaseNotApplied
+	}
+	return errors.Join(errs...)
+}
+
+// shouldRun checks when condition and tag regexp of the step against previous steps of the run
+func (step PipelineStep) shouldRun(run *PipelineRun) (bool, error) {
+	if IsStringNotEmpty(step.TAG_REGEX) {
+		re, err := regexp.Compile(step.TAG_REGEX)
+		if err != nil {
+			return false, fmt.Errorf("wrong tag_regex of step %s: %w", step.Name(), err)
+		}
+		if !re.MatchString(run.Data.Release) {
+			return false, nil
+		}
+	}
+	status := run.Status()
+	switch step.WHEN {
+	case "", PipelineWhenSuccess:
+		return status == StepSucceeded, nil
+	case PipelineWhenFailure:
+		return status == StepFailed, nil
+	case PipelineWhenAlways:
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown when condition %q of step %s", step.WHEN, step.Name())
+}
+
+func (cfg *Config) runStep(step PipelineStep, run *PipelineRun, logger *Logger) error {
+	switch step.ON_ERROR {
+	case "", HookOnErrorFail, HookOnErrorContinue:
+	default:
+		return fmt.Errorf("unknown on_error policy %q", step.ON_ERROR)
+	}
+	switch step.TYPE {
+	case PipelineStepBuild:
+		return cfg.runBuildStep(run, logger)
+	case PipelineStepSync:
+		return cfg.runSyncStep(step, run, logger)
+	case PipelineStepDeploy:
+		return cfg.runDeployStep(step, run, logger)
+	case PipelineStepJob:
+		return cfg.runK8sJobStep(step, run, logger)
+	case PipelineStepHook:
+		return cfg.HOOKS.runHooks(step.Name(), step.HOOKS, run.Data, nil, logger)
+	case PipelineStepVerify:
+		return cfg.VERIFY.verifyChecks(step.Name(), step.CHECKS, run.Data, logger)
+	case PipelineStepNotify:
+		return cfg.runNotifyStep(step, run)
+	}
+	return fmt.Errorf("unknown step type %q", step.TYPE)
+}
+
+// runBuildStep builds and pushes multi-platform docker image of the release
+func (cfg *Config) runBuildStep(run *PipelineRun, logger *Logger) error {
+	// define platforms for building
+	var platforms []string = cfg.DOCKER.DOCKER_PLATFORMS
+	if len(platforms) == 0 {
+		platforms = DefaultDockerConfig.DOCKER_PLATFORMS
+	}
+	cfg.DOCKER.SetAuth("/run/configs/dockerconfig/")
+
+	err := cfg.HOOKS.RunHooks(HookPreBuild, run.Data, logger)
+	if err != nil {
+		return err
+	}
+	PrintInfo(logger, "starting building image %s", run.Data.Image)
+	// we use buildx to make multy-arch image
+	err = cfg.DOCKER.DockerImageBuildx(run.Data.Image, filepath.Join(run.ReleaseFolder, cfg.DOCKER.DOCKER_CONTEXT), platforms, logger)
+	if err != nil {
+		return fmt.Errorf("building image %s failed: %w", run.Data.Image, err)
+	}
+	PrintInfo(logger, "successfully build image %s", run.Data.Image)
+	err = cfg.VERIFY.VerifyRelease(VerifyAfterBuild, run.Data, logger)
+	if err != nil {
+		return err
+	}
+	return cfg.HOOKS.RunHooks(HookPostBuild, run.Data, logger)
+}
+
+// runSyncStep syncs content of git_sub_folder into target_folder (or every sync mapping)
+func (cfg *Config) runSyncStep(step PipelineStep, run *PipelineRun, logger *Logger) error {
+	sync := step.SyncConfig(cfg)
+	err := cfg.HOOKS.RunHooks(HookPreSync, run.Data, logger)
+	if err != nil {
+		return err
+	}
+	err = sync.SyncRelease(run.ReleaseFolder, run.Data.Release, logger)
+	if err != nil {
+		return fmt.Errorf("sync for tag %s failed: %w", run.Data.Release, err)
+	}
+	PrintInfo(logger, "successfully sync for tag %s", run.Data.Release)
+	err = cfg.VERIFY.VerifyRelease(VerifyAfterSync, run.Data, logger)
+	if err != nil {
+		return err
+	}
+	return cfg.HOOKS.RunHooks(HookPostSync, run.Data, logger)
+}
+
+// runDeployStep rolls the release out to the cluster according to rollout strategy of the job
+func (cfg *Config) runDeployStep(step PipelineStep, run *PipelineRun, logger *Logger) error {
+	os.Chdir(CurrentWD)
+	err := cfg.HOOKS.RunHooks(HookPreDeploy, run.Data, logger)
+	if err != nil {
+		return err
+	}
+
+	PrintInfo(logger, "start applying release %s (rollout strategy: %s)", run.Data.Release,
+		Tiif(IsStringEmpty(cfg.DEPLOY.ROLLOUT_STRATEGY), RolloutApply, cfg.DEPLOY.ROLLOUT_STRATEGY))
+	switch cfg.DEPLOY.ROLLOUT_STRATEGY {
+	case "", RolloutApply:
+		err = cfg.applyRollout(step, run, run.Data, logger)
+	case RolloutBlueGreen:
+		err = cfg.blueGreenRollout(step, run, logger)
+	case RolloutCanary:
+		err = cfg.canaryRollout(step, run, logger)
+	default:
+		err = fmt.Errorf("unknown rollout strategy %q", cfg.DEPLOY.ROLLOUT_STRATEGY)
+	}
+	if err != nil {
+		return err
+	}
+
+	// failed checks fail the step like checks after build and sync, so failure hooks run
+	err = cfg.VERIFY.VerifyRelease(VerifyAfterDeploy, run.Data, logger)
+	if err != nil {
+		return err
+	}
+	PrintInfo(logger, "release %s applyed successfully", run.Data.Release)
+	return cfg.HOOKS.RunHooks(HookPostDeploy, run.Data, logger)
+}
+
+// applyRollout applies manifest made from template with given data to the cluster and waits for deployment to run the release
+func (cfg *Config) applyRollout(step PipelineStep, run *PipelineRun, data ReleaseData, logger *Logger) error {
+	// now it's time to get final manifest for k8s/k3s deployment from given template
+	manifestToApply, err := GenerateManifest(step.Manifests(cfg), data)
+	if err != nil {
+		return err
+	}
+	// switch to given context
+	_, err = RunExternalCmdContext(logger.CommandContext(), "", fmt.Sprintf("error while switching to context %s", cfg.DEPLOY.CONTEXT_K8s),
+		"kubectx", cfg.DEPLOY.CONTEXT_K8s)
+	if err != nil {
+		return err
+	}
+	//  now apply it in given cluster
+	// command := []string{"kubectl", "apply", "-f", "-", "--dry-run=client")}
+	command := []string{"kubectl", "apply", "-f", "-"}
+	metrics := GetJobMetrics(cfg.COMMON.JOB_NAME)
+	applyStart := time.Now()
+	outManifestApply, err := RunExternalCmdContext(logger.CommandContext(), manifestToApply, "error while applying manifest", command[0], command[1:]...)
+	metrics.ObserveStep(MetricsStepApply, time.Since(applyStart))
+	if err != nil {
+		return err
+	}
+	PrintInfo(logger, "manifests of release %s are applied\n%v", data.Release, outManifestApply)
+
+	// waiting some time for changes take effect
+	waitStart := time.Now()
+	waitSpan := logger.Span().StartChild("readiness wait")
+	defer func() {
+		metrics.ObserveStep(MetricsStepReadinessWait, time.Since(waitStart))
+		waitSpan.End()
+	}()
+	checkIntervals := GetIntervals(cfg.COMMON.CHECK_INTERVAL)
+	isReady := false
+	for i := 0; i < 5; i++ {
+		intervalToWaitSeconds := checkIntervals[i]
+		if err = deploySleep(logger.CommandContext(), time.Duration(intervalToWaitSeconds)*time.Second); err != nil {
+			return fmt.Errorf("waiting for release %s is interrupted: %w", data.Release, err)
+		}
+		run.WaitSeconds += intervalToWaitSeconds
+		// now check readiness
+		isReady, _ = GetDeploymentReadinessStatus(cfg, data.Image)
+		if isReady {
+			break
+		}
+		PrintInfo(logger, "kubernetes manifests are not apllying yet for release %s", data.Image)
+	}
+	if !isReady {
+		return fmt.Errorf("%w: deployment is not ready with image %s", ErrReleaseNotApplied, data.Image)
+	}
+	currentClusterImageTag, err := GetImageTag(cfg)
+	if err != nil {
+		return err
+	}
+	if currentClusterImageTag != data.Release {
+		return fmt.Errorf("%w: cluster runs %s", ErrReleaseNotApplied, currentClusterImageTag)
+	}
+	return nil
+}
+
+// runNotifyStep posts json with results of the release steps done so far to url of the step
+func (cfg *Config) runNotifyStep(step PipelineStep, run *PipelineRun) error {
+	url, err := RenderString(step.URL, run.Data)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(struct {
+		Job     string       `json:"job"`
+		Release string       `json:"release"`
+		Image   string       `json:"image"`
+		Status  string       `json:"status"`
+		Steps   []StepResult `json:"steps"`
+	}{cfg.COMMON.JOB_NAME, run.Data.Release, run.Data.Image, run.Status(), run.Steps})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: defaultNotifyTimeout * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("notification to %s failed: %s", strings.SplitN(url, "?", 2)[0], resp.Status)
+	}
+	return nil
+}
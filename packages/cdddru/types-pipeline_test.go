@@ -0,0 +1,95 @@
+package cdddru
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultPipeline(t *testing.T) {
+	config := Config{}
+	config.DOCKER.DO_DOCKER_BUILD = true
+	config.DEPLOY.DO_MANIFEST_DEPLOY = true
+	types := make([]string, 0)
+	for _, step := range config.Pipeline() {
+		types = append(types, step.TYPE)
+	}
+	if !reflect.DeepEqual(types, []string{PipelineStepBuild, PipelineStepDeploy}) {
+		t.Errorf("expected build and deploy steps, got %v", types)
+	}
+	if config.HasPipelineStep(PipelineStepSync) {
+		t.Errorf("expected no sync step")
+	}
+
+	// steps of job file replace flags
+	config.STEPS = []PipelineStep{{TYPE: PipelineStepSync}}
+	if !config.HasPipelineStep(PipelineStepSync) || config.HasPipelineStep(PipelineStepDeploy) {
+		t.Errorf("expected only sync step, got %+v", config.Pipeline())
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	release := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(release, "assets"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(release, "assets", "index.html"), []byte("v1.0.1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+
+	var notified []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		notified = append(notified, payload)
+	}))
+	defer server.Close()
+
+	config := Config{}
+	config.COMMON.JOB_NAME = "main-site"
+	config.STEPS = []PipelineStep{
+		{TYPE: PipelineStepSync, SYNC_MAPPINGS: []SyncMapping{{SOURCE: "assets", TARGET: target}}},
+		{NAME: "optional", TYPE: PipelineStepHook, ON_ERROR: HookOnErrorContinue, HOOKS: []Hook{{COMMAND: []string{"false"}}}},
+		{NAME: "prerelease only", TYPE: PipelineStepHook, TAG_REGEX: `-rc\d+$`, HOOKS: []Hook{{COMMAND: []string{"false"}}}},
+		{TYPE: PipelineStepVerify, CHECKS: []VerifyCheck{{TYPE: VerifyCheckCommand, COMMAND: []string{"grep", "-q", "{{.Release}}", filepath.Join(target, "index.html")}}}},
+		{NAME: "on failure", TYPE: PipelineStepNotify, WHEN: PipelineWhenFailure, URL: server.URL},
+		{TYPE: PipelineStepNotify, WHEN: PipelineWhenAlways, URL: server.URL + "/{{.Release}}"},
+	}
+	config.SetParentLinks()
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+
+	run := &PipelineRun{Data: ReleaseData{Release: "v1.0.1", Image: "ddru:v1.0.1"}, ReleaseFolder: release}
+	if err := config.RunPipeline(run, logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	statuses := make([]string, 0)
+	for _, step := range run.Steps {
+		statuses = append(statuses, step.Status)
+	}
+	expected := []string{StepSucceeded, StepFailed, StepSkipped, StepSucceeded, StepSkipped, StepSucceeded}
+	if !reflect.DeepEqual(statuses, expected) || run.Status() != StepSucceeded {
+		t.Errorf("expected statuses %v, got %v (%s)", expected, statuses, run.Status())
+	}
+	if len(notified) != 1 || notified[0]["release"] != "v1.0.1" || notified[0]["status"] != StepSucceeded {
+		t.Errorf("unexpected notifications %v", notified)
+	}
+
+	// failed step skips next steps, steps on failure are run
+	notified = nil
+	config.STEPS[0].SYNC_MAPPINGS[0].DELETE_POLICY = "wipe"
+	run = &PipelineRun{Data: ReleaseData{Release: "v1.0.2"}, ReleaseFolder: release}
+	if err := config.RunPipeline(run, logger); err == nil {
+		t.Errorf("expected sync error")
+	}
+	if run.Status() != StepFailed || run.Steps[3].Status != StepSkipped {
+		t.Errorf("unexpected results %s", run.Summary())
+	}
+	if len(notified) != 2 || notified[1]["status"] != StepFailed {
+		t.Errorf("expected notifications on failure, got %v", notified)
+	}
+}
@@ -0,0 +1,286 @@
+package cdddru
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	VerifyCheckHTTP    = "http"
+	VerifyCheckTCP     = "tcp"
+	VerifyCheckCommand = "command"
+
+	VerifyAfterBuild  = "build"
+	VerifyAfterSync   = "sync"
+	VerifyAfterDeploy = "deploy"
+	VerifyCanary      = "canary"
+
+	defaultVerifyRetries       = 5
+	defaultVerifyRetryInterval = 10
+	defaultVerifyTimeout       = 10
+)
+
+// ErrVerifyFailed is returned when some check of a release step does not pass after all retries
+var ErrVerifyFailed = errors.New("release verification failed")
+
+// verifySleep waits between attempts of a check until step is done, replaced in tests
+var verifySleep = sleepContext
+
+// VerifyConfig describes checks run after build, sync and deploy steps of a release.
+// String values of checks are templates rendered with the same data as k8s manifests ({{.Release}}, {{.Image}}).
+type VerifyConfig struct {
+	AFTER_BUILD  []VerifyCheck `json:"after_build,omitempty" yaml:"after_build"`
+	AFTER_SYNC   []VerifyCheck `json:"after_sync,omitempty" yaml:"after_sync"`
+	AFTER_DEPLOY []VerifyCheck `json:"after_deploy,omitempty" yaml:"after_deploy"`
+	// checks of canary deployment, run again and again during canary_bake_time of Deploy section
+	AFTER_CANARY []VerifyCheck `json:"after_canary,omitempty" yaml:"after_canary"`
+	// attempts of every check before release is considered failed (0 - default 5)
+	RETRIES int `json:"retries,omitempty" yaml:"retries"`
+	// seconds between attempts (0 - default 10)
+	RETRY_INTERVAL int `json:"retry_interval,omitempty" yaml:"retry_interval"`
+
+	parentLink *Config
+}
+
+// VerifyCheck is one check of a release: http GET, tcp connect or command.
+type VerifyCheck struct {
+	// name in logs, type and target are used if empty
+	NAME string `json:"name,omitempty" yaml:"name"`
+	// http, tcp or command
+	TYPE string `json:"type" yaml:"type"`
+	// url of http check
+	URL string `json:"url,omitempty" yaml:"url"`
+	// expected status of http check (0 - default 200)
+	EXPECTED_STATUS int `json:"expected_status,omitempty" yaml:"expected_status"`
+	// regexp the body of http check must match
+	BODY_REGEX string `json:"body_regex,omitempty" yaml:"body_regex"`
+	// dotted path of field in json body of http check (e.g. meta.RELEASE) which must be equal to json_value
+	JSON_FIELD string `json:"json_field,omitempty" yaml:"json_field"`
+	JSON_VALUE string `json:"json_value,omitempty" yaml:"json_value"`
+	// host:port of tcp check
+	ADDRESS string `json:"address,omitempty" yaml:"address"`
+	// command with arguments, must exit with zero code
+	COMMAND []string `json:"command,omitempty" yaml:"command"`
+	// seconds one attempt may take (0 - default 10)
+	TIMEOUT int `json:"timeout,omitempty" yaml:"timeout"`
+	// attempts of this check, overrides retries of verify section
+	RETRIES int `json:"retries,omitempty" yaml:"retries"`
+}
+
+// Checks returns checks to run after given step (build, sync, deploy or canary)
+func (vrfcfg *VerifyConfig) Checks(step string) []VerifyCheck {
+	switch step {
+	case VerifyAfterBuild:
+		return vrfcfg.AFTER_BUILD
+	case VerifyAfterSync:
+		return vrfcfg.AFTER_SYNC
+	case VerifyAfterDeploy:
+		return vrfcfg.AFTER_DEPLOY
+	case VerifyCanary:
+		return vrfcfg.AFTER_CANARY
+	}
+	return nil
+}
+
+// VerifyRelease runs checks of the step one by one, every check is retried until it passes or attempts are over.
+// Error wraps ErrVerifyFailed if a check has not passed.
+func (vrfcfg *VerifyConfig) VerifyRelease(step string, data ReleaseData, logger *Logger) error {
+	return vrfcfg.verifyChecks(step, vrfcfg.Checks(step), data, logger)
+}
+
+func (vrfcfg *VerifyConfig) verifyChecks(step string, checks []VerifyCheck, data ReleaseData, logger *Logger) error {
+	if len(checks) == 0 {
+		return nil
+	}
+	interval := vrfcfg.RETRY_INTERVAL
+	if interval <= 0 {
+		interval = defaultVerifyRetryInterval
+	}
+	// checks and waits between their attempts are bound to the step
+	ctx := logger.CommandContext()
+	PrintInfo(logger, "start verification of release %s after %s: %d checks", data.Release, step, len(checks))
+	for _, check := range checks {
+		check, err := check.Render(data)
+		if err != nil {
+			return err
+		}
+		retries := check.RETRIES
+		if retries <= 0 {
+			retries = vrfcfg.RETRIES
+		}
+		if retries <= 0 {
+			retries = defaultVerifyRetries
+		}
+		for attempt := 1; ; attempt++ {
+			err = check.Run(ctx)
+			if err == nil {
+				PrintInfo(logger, "check %s passed", check.Name())
+				break
+			}
+			if attempt >= retries {
+				return fmt.Errorf("%w: check %s after %s of %s: %v", ErrVerifyFailed, check.Name(), step, data.Release, err)
+			}
+			PrintWarning(logger, "check %s failed (attempt %d of %d): %v", check.Name(), attempt, retries, err)
+			if err = verifySleep(ctx, time.Duration(interval)*time.Second); err != nil {
+				return fmt.Errorf("verification of %s after %s is interrupted: %w", data.Release, step, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Name is name of check in logs
+func (check VerifyCheck) Name() string {
+	if IsStringNotEmpty(check.NAME) {
+		return check.NAME
+	}
+	switch check.TYPE {
+	case VerifyCheckHTTP:
+		return check.TYPE + " " + check.URL
+	case VerifyCheckTCP:
+		return check.TYPE + " " + check.ADDRESS
+	}
+	return check.TYPE + " " + strings.Join(check.COMMAND, " ")
+}
+
+// Render returns copy of check with templates in its values executed for given release
+func (check VerifyCheck) Render(data ReleaseData) (VerifyCheck, error) {
+	var err error
+	render := func(value string) string {
+		if err != nil {
+			return value
+		}
+		var rendered string
+		rendered, err = RenderString(value, data)
+		if err != nil {
+			err = fmt.Errorf("check %s: %w", check.Name(), err)
+			return value
+		}
+		return rendered
+	}
+
+	rendered := check
+	rendered.NAME = render(check.NAME)
+	rendered.URL = render(check.URL)
+	rendered.BODY_REGEX = render(check.BODY_REGEX)
+	rendered.JSON_VALUE = render(check.JSON_VALUE)
+	rendered.ADDRESS = render(check.ADDRESS)
+	rendered.COMMAND = make([]string, len(check.COMMAND))
+	for i, arg := range check.COMMAND {
+		rendered.COMMAND[i] = render(arg)
+	}
+	return rendered, err
+}
+
+// Run makes one attempt of the check, it is stopped when ctx is done. Command check is run by executor of ctx.
+func (check VerifyCheck) Run(ctx context.Context) error {
+	timeout := time.Duration(check.TIMEOUT) * time.Second
+	if check.TIMEOUT <= 0 {
+		timeout = defaultVerifyTimeout * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	switch check.TYPE {
+	case VerifyCheckHTTP:
+		return check.runHTTP(ctx)
+	case VerifyCheckTCP:
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", check.ADDRESS)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case VerifyCheckCommand:
+		if len(check.COMMAND) == 0 {
+			return errors.New("command is empty")
+		}
+		_, err := runCommand(ctx, Command{Name: check.COMMAND[0], Args: check.COMMAND[1:]})
+		return err
+	}
+	return fmt.Errorf("unknown check type %q", check.TYPE)
+}
+
+func (check VerifyCheck) runHTTP(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	expectedStatus := check.EXPECTED_STATUS
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("expected status %d, got %d", expectedStatus, resp.StatusCode)
+	}
+	if IsStringNotEmpty(check.BODY_REGEX) {
+		re, err := regexp.Compile(check.BODY_REGEX)
+		if err != nil {
+			return fmt.Errorf("wrong body_regex: %w", err)
+		}
+		if !re.Match(body) {
+			return fmt.Errorf("body does not match %q", check.BODY_REGEX)
+		}
+	}
+	if IsStringNotEmpty(check.JSON_FIELD) {
+		value, err := jsonFieldValue(body, check.JSON_FIELD)
+		if err != nil {
+			return err
+		}
+		if value != check.JSON_VALUE {
+			return fmt.Errorf("expected %s to be %q, got %q", check.JSON_FIELD, check.JSON_VALUE, value)
+		}
+	}
+	return nil
+}
+
+// jsonFieldValue returns value of field by dotted path (array elements are addressed by index) as string
+func jsonFieldValue(body []byte, path string) (string, error) {
+	var current interface{}
+	if err := json.Unmarshal(body, &current); err != nil {
+		return "", fmt.Errorf("body is not json: %w", err)
+	}
+	for _, name := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[name]
+			if !ok {
+				return "", fmt.Errorf("field %s not found", path)
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(name)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", fmt.Errorf("field %s not found", path)
+			}
+			current = node[index]
+		default:
+			return "", fmt.Errorf("field %s not found", path)
+		}
+	}
+	switch value := current.(type) {
+	case string:
+		return value, nil
+	case nil:
+		return "", nil
+	}
+	raw, err := json.Marshal(current)
+	return string(raw), err
+}
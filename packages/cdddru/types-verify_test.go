@@ -0,0 +1,111 @@
+package cdddru
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyRelease(t *testing.T) {
+	verifySleep = func(context.Context, time.Duration) error { return nil }
+	defer func() { verifySleep = sleepContext }()
+
+	// site serves new release only from the third request
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		release := "v1.0.0"
+		if requests >= 3 {
+			release = "v1.0.1"
+		}
+		switch r.URL.Path {
+		case "/version.json":
+			fmt.Fprintf(w, `{"meta": {"RELEASE": %q, "builds": [1, 2]}}`, release)
+		case "/":
+			fmt.Fprintf(w, "<html>release %s</html>", release)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	config := Config{}
+	config.VERIFY.AFTER_SYNC = []VerifyCheck{
+		{TYPE: VerifyCheckHTTP, URL: server.URL + "/version.json", JSON_FIELD: "meta.RELEASE", JSON_VALUE: "{{.Release}}"},
+		{TYPE: VerifyCheckHTTP, URL: server.URL + "/", BODY_REGEX: `release {{.Release}}<`},
+		{TYPE: VerifyCheckHTTP, URL: server.URL + "/missing", EXPECTED_STATUS: http.StatusNotFound},
+		{TYPE: VerifyCheckTCP, ADDRESS: listener.Addr().String()},
+		{TYPE: VerifyCheckCommand, COMMAND: []string{"sh", "-c", `test "$0" = v1.0.1`, "{{.Release}}"}},
+	}
+	config.SetParentLinks()
+	logger := NewLogger(os.Stdout, os.Stderr, InfoLevel, "test")
+	data := ReleaseData{Release: "v1.0.1", Image: "ddru:v1.0.1"}
+
+	if err := config.VERIFY.VerifyRelease(VerifyAfterSync, data, logger); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if requests != 5 {
+		t.Errorf("expected json check to be retried until new release is served, got %d requests", requests)
+	}
+	// no checks for other steps
+	if err := config.VERIFY.VerifyRelease(VerifyAfterDeploy, data, logger); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	// failed check is retried given number of times
+	requests = 0
+	config.VERIFY.RETRIES = 2
+	config.VERIFY.AFTER_DEPLOY = []VerifyCheck{{NAME: "wrong release", TYPE: VerifyCheckHTTP, URL: server.URL + "/version.json",
+		JSON_FIELD: "meta.RELEASE", JSON_VALUE: "v2.0.0"}}
+	err = config.VERIFY.VerifyRelease(VerifyAfterDeploy, data, logger)
+	if !errors.Is(err, ErrVerifyFailed) || !strings.Contains(err.Error(), "wrong release") {
+		t.Errorf("expected verification error, got %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 attempts, got %d", requests)
+	}
+
+	listener.Close()
+	config.VERIFY.AFTER_BUILD = []VerifyCheck{
+		{TYPE: VerifyCheckTCP, ADDRESS: listener.Addr().String(), RETRIES: 1},
+	}
+	if err := config.VERIFY.VerifyRelease(VerifyAfterBuild, data, logger); !errors.Is(err, ErrVerifyFailed) {
+		t.Errorf("expected verification error of closed port, got %v", err)
+	}
+}
+
+func TestJsonFieldValue(t *testing.T) {
+	body := []byte(`{"RELEASE": "v1.0.1", "meta": {"builds": [{"id": 7}], "ok": true, "none": null}}`)
+	cases := []struct {
+		path  string
+		value string
+		fails bool
+	}{
+		{"RELEASE", "v1.0.1", false},
+		{"meta.builds.0.id", "7", false},
+		{"meta.ok", "true", false},
+		{"meta.none", "", false},
+		{"meta.builds.1.id", "", true},
+		{"meta.missing", "", true},
+		{"RELEASE.x", "", true},
+	}
+	for _, c := range cases {
+		value, err := jsonFieldValue(body, c.path)
+		if (err != nil) != c.fails || value != c.value {
+			t.Errorf("path %q: expected %q (fails: %v), got %q (%v)", c.path, c.value, c.fails, value, err)
+		}
+	}
+}
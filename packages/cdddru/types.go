@@ -48,7 +48,23 @@ type Config struct {
 
 	SYNC SyncConfig `json:"Sync" yaml:"Sync"`
 
+	VERIFY VerifyConfig `json:"Verify" yaml:"Verify"`
+
+	HOOKS HooksConfig `json:"Hooks" yaml:"Hooks"`
+
+	NOTIFY NotifyConfig `json:"Notify" yaml:"Notify"`
+
+	// release pipeline, if empty - build, sync and deploy steps according to their do_* flags
+	STEPS []PipelineStep `json:"steps,omitempty" yaml:"steps"`
+
 	logger *Logger
+	// runs external commands of the job, nil - OSExecutor
+	executor Executor
+}
+
+// SetExecutor sets executor external commands of the job are run by
+func (cfg *Config) SetExecutor(executor Executor) {
+	cfg.executor = executor
 }
 
 type CommonConfig struct {
@@ -62,7 +78,9 @@ type CommonConfig struct {
 	VARIABLE_3     string `json:"variable_3" yaml:"variable_3"`
 	VARIABLE_4     string `json:"variable_4" yaml:"variable_4"`
 	VARIABLE_5     string `json:"variable_5" yaml:"variable_5"`
-	parentLink     *Config
+	// log archives of how many last releases are kept (0 - default 10)
+	RELEASE_LOGS_KEEP int `json:"release_logs_keep,omitempty" yaml:"release_logs_keep"`
+	parentLink        *Config
 }
 
 type DeployConfig struct {
@@ -73,14 +91,88 @@ type DeployConfig struct {
 	NAMESPACE_K8s       string `json:"namespace_k8s" yaml:"namespace_k8s"`
 	DEPLOYMENT_NAME_K8s string `json:"deployment_name_k8s" yaml:"deployment_name_k8s"`
 	MANIFESTS_K8S       string `json:"manifests_k8s" yaml:"manifests_k8s"`
-	parentLink          *Config
+
+	// apply (default) - manifests are applied as is, blue-green - deployment of other colour is made and service
+	// is switched to it, canary - canary deployment is checked for bake time and then promoted or aborted
+	ROLLOUT_STRATEGY string `json:"rollout_strategy,omitempty" yaml:"rollout_strategy"`
+	// blue-green: service which selector colour label is switched to new deployment
+	SERVICE_NAME_K8s string `json:"service_name_k8s,omitempty" yaml:"service_name_k8s"`
+	// canary: replicas of canary deployment (0 - default 1)
+	CANARY_REPLICAS int `json:"canary_replicas,omitempty" yaml:"canary_replicas"`
+	// canary: seconds after_canary checks of Verify section run before promotion (0 - default 300)
+	CANARY_BAKE_TIME int `json:"canary_bake_time,omitempty" yaml:"canary_bake_time"`
+	// seconds to wait for rollout of blue-green or canary deployment (0 - default 600)
+	ROLLOUT_TIMEOUT int `json:"rollout_timeout,omitempty" yaml:"rollout_timeout"`
+
+	parentLink *Config
 }
 
+// SyncConfig describes syncing of git_sub_folder (relative to repo root) content into target_folder or,
+// if sync_mappings are given, syncing of every mapping. Content is synced into target folder itself -
+// trailing slash of source folder does not matter.
 type SyncConfig struct {
 	DO_SUBFOLDER_SYNC bool   `json:"do_subfolder_sync,string" yaml:"do_subfolder_sync"`
 	GIT_SUB_FOLDER    string `json:"git_sub_folder" yaml:"git_sub_folder"`
 	TARGET_FOLDER     string `json:"target_folder" yaml:"target_folder"`
-	parentLink        *Config
+	// in-place (default) - target_folder is updated file by file,
+	// atomic-swap - release is staged into its own folder and target_folder symlink is switched to it
+	SYNC_MODE string `json:"sync_mode,omitempty" yaml:"sync_mode"`
+	// how many release folders to keep in atomic-swap mode for rollback (0 - default 3)
+	SYNC_KEEP_RELEASES int `json:"sync_keep_releases,omitempty" yaml:"sync_keep_releases"`
+	// several folders of the same release synced to their own targets, git_sub_folder and target_folder are ignored if set
+	SYNC_MAPPINGS []SyncMapping `json:"sync_mappings,omitempty" yaml:"sync_mappings"`
+	// private key for sftp://user@host[:port]/path targets, file or VAR:NAME (empty - git_private_key is used)
+	SFTP_PRIVATE_KEY string `json:"sftp_private_key,omitempty" yaml:"sftp_private_key"`
+	// pinned host key of sftp targets: SHA256 fingerprint (as printed by ssh-keygen -lf) or public key line
+	SFTP_HOST_KEY string `json:"sftp_host_key,omitempty" yaml:"sftp_host_key"`
+	// known_hosts file to check host keys of sftp targets if sftp_host_key is empty (default ~/.ssh/known_hosts)
+	SFTP_KNOWN_HOSTS string `json:"sftp_known_hosts,omitempty" yaml:"sftp_known_hosts"`
+	// endpoint of s3 compatible storage for s3://bucket/prefix targets, path-style addressing is used (default AWS)
+	S3_ENDPOINT string `json:"s3_endpoint,omitempty" yaml:"s3_endpoint"`
+	// region requests are signed for (default us-east-1)
+	S3_REGION string `json:"s3_region,omitempty" yaml:"s3_region"`
+	// keys of s3 targets, file or VAR:NAME (empty - AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY env vars are used)
+	S3_ACCESS_KEY string `json:"s3_access_key,omitempty" yaml:"s3_access_key"`
+	S3_SECRET_KEY string `json:"s3_secret_key,omitempty" yaml:"s3_secret_key"`
+	// Cache-Control of uploaded objects - value of the first rule which pattern matches
+	S3_CACHE_CONTROL []S3CacheControlRule `json:"s3_cache_control,omitempty" yaml:"s3_cache_control"`
+
+	parentLink *Config
+}
+
+// S3CacheControlRule sets Cache-Control of objects which paths match pattern (same syntax as sync patterns).
+type S3CacheControlRule struct {
+	PATTERN string `json:"pattern" yaml:"pattern"`
+	VALUE   string `json:"value" yaml:"value"`
+}
+
+// SyncMapping describes syncing of one repo folder into one target folder.
+// Patterns are globs (* - within one path element, ** - any number of elements) matched against paths
+// relative to source. Pattern without slash matches name at any depth, pattern matching folder matches its content.
+type SyncMapping struct {
+	// folder relative to repo root, empty - whole repo
+	SOURCE string `json:"source" yaml:"source"`
+	// local folder, sftp://user@host[:port]/path or s3://bucket/prefix
+	TARGET string `json:"target" yaml:"target"`
+	// sync only matching paths (all if empty)
+	INCLUDE []string `json:"include,omitempty" yaml:"include"`
+	// do not sync matching paths, they are not deleted in target either
+	EXCLUDE []string `json:"exclude,omitempty" yaml:"exclude"`
+	// delete (default) - remove paths absent in source from target, keep - never remove anything from target
+	DELETE_POLICY string `json:"delete_policy,omitempty" yaml:"delete_policy"`
+}
+
+// ReleaseData is passed to templates of manifests and other config values rendered for a release
+type ReleaseData struct {
+	Release   string
+	Image     string
+	PgSecrets string
+	// blue or green for blue-green rollout - suffix of deployment name and value of colour label
+	Colour string
+	// stable or canary for canary rollout
+	Track string
+	// replicas of canary deployment, 0 - template default
+	Replicas int
 }
 
 var USER *user.User
@@ -99,6 +191,9 @@ func (cfg *Config) SetParentLinks() {
 	cfg.DOCKER.parentLink = cfg
 	cfg.DEPLOY.parentLink = cfg
 	cfg.SYNC.parentLink = cfg
+	cfg.VERIFY.parentLink = cfg
+	cfg.HOOKS.parentLink = cfg
+	cfg.NOTIFY.parentLink = cfg
 }
 
 func (cfg *Config) ReplaceConfigFields(content string) (isChanged bool, _ string, err error) {
@@ -214,7 +309,7 @@ func init() {
 
 	DefaultSyncConfig = SyncConfig{
 		DO_SUBFOLDER_SYNC: strings.ToLower(GetEnvVar("DO_SUBFOLDER_SYNC", "false")) == "true",
-		GIT_SUB_FOLDER:    GetEnvVar("GIT_SUB_FOLDER", ""),                                //if empty - all repo to rsync
+		GIT_SUB_FOLDER:    GetEnvVar("GIT_SUB_FOLDER", ""),                                //if empty - all repo to sync
 		TARGET_FOLDER:     GetEnvVar("TARGET_FOLDER", filepath.Join(USER.HomeDir, "app")), //where web app is
 
 	}
@@ -2,6 +2,7 @@ package cdddru
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"flag"
@@ -101,85 +102,63 @@ func PrettyJsonEncodeToString(data interface{}) (string, error) {
 }
 
 func RunExternalCmdsPiped(stdinStr, errorPrefix string, commands [][]string) (string, error) {
+	return RunExternalCmdsPipedContext(context.Background(), stdinStr, errorPrefix, commands)
+}
+
+// RunExternalCmdsPipedContext runs pipe of commands by executor of ctx, see RunExternalCmdContext
+func RunExternalCmdsPipedContext(ctx context.Context, stdinStr, errorPrefix string, commands [][]string) (string, error) {
 	if len(errorPrefix) == 0 {
 		errorPrefix = fmt.Sprintf("error occured in %v commands", "pipe of")
 	}
 	if len(commands) < 2 {
-		if err != nil {
-			return "", fmt.Errorf("%v: %v ", errorPrefix, "at least two commands are required")
-		}
-	}
-	var outBuf, errBuf bytes.Buffer
-	// cmd.Stdout = &outBuf
-	// cmd.Stderr = &errBuf
-
-	var cmd []*exec.Cmd
-	var err error
-
-	// Create the command objects
-	for _, c := range commands {
-		cmd = append(cmd, exec.Command(c[0], c[1:]...))
-	}
-
-	// Connect the commands in a pipeline
-	for i := 0; i < len(cmd)-1; i++ {
-		currCmd := cmd[i]
-		if len(stdinStr) > 0 && i == 0 {
-			currCmd.Stdin = strings.NewReader(stdinStr)
-		}
-		nextCmd := cmd[i+1]
-
-		pipe, err := currCmd.StdoutPipe()
-		if err != nil {
-			return "", fmt.Errorf("%v: error creating pipe: %w ", errorPrefix, err)
-		}
-		nextCmd.Stdin = pipe
+		return "", fmt.Errorf("%v: %v ", errorPrefix, "at least two commands are required")
 	}
-
-	// Set the last command's stdout to os.Stdout
-	lastCmd := cmd[len(cmd)-1]
-	lastCmd.Stdout = &outBuf
-	lastCmd.Stderr = &errBuf
-
-	// Start the commands in reverse order
-	for i := len(cmd) - 1; i >= 0; i-- {
-		err = cmd[i].Start()
-		if err != nil {
-			return "", fmt.Errorf("%v: error starting pipe: %w ", errorPrefix, err)
-		}
+	pipe := Command{Name: commands[0][0], Args: commands[0][1:], Stdin: stdinStr}
+	for _, c := range commands[1:] {
+		pipe.Pipe = append(pipe.Pipe, Command{Name: c[0], Args: c[1:]})
 	}
-
-	// Wait for the commands to finish
-	for _, c := range cmd {
-		err = c.Wait()
-		if err != nil {
-			return "", fmt.Errorf("%v: %v < details: (%v) >", errorPrefix, err, errBuf.String())
-		}
-	}
-	if len(errBuf.String()) > 0 {
-		return "", fmt.Errorf("%v: %v < details: (%v) >", errorPrefix, err, errBuf.String())
+	out, err := runCommand(ctx, pipe)
+	if err != nil {
+		return "", fmt.Errorf("%v: %w", errorPrefix, err)
 	}
-	return outBuf.String(), nil
+	return out, nil
 }
 
 func RunExternalCmd(stdinString, errorPrefix string, commandName string,
 	commandArgs ...string) (string, error) {
-	// Apply the Kubernetes manifest using the 'kubectl' command
-	cmd := exec.Command(commandName, commandArgs...)
-	var outBuf, errBuf bytes.Buffer
-	cmd.Stdout = &outBuf
-	cmd.Stderr = &errBuf
-	if len(stdinString) > 0 {
-		cmd.Stdin = strings.NewReader(stdinString)
-	}
-	err := cmd.Run()
+	return RunExternalCmdContext(context.Background(), stdinString, errorPrefix, commandName, commandArgs...)
+}
+
+// RunExternalCmdContext is RunExternalCmd run by executor of ctx, bound to ctx, traced as child of span of ctx
+// and streaming output to logger of ctx. Error is *CommandError wrapped with errorPrefix.
+func RunExternalCmdContext(ctx context.Context, stdinString, errorPrefix string, commandName string,
+	commandArgs ...string) (string, error) {
+	out, err := runCommand(ctx, Command{Name: commandName, Args: commandArgs, Stdin: stdinString})
 	if len(errorPrefix) == 0 {
 		errorPrefix = fmt.Sprintf("error occured in %v command", commandName)
 	}
 	if err != nil {
-		return "", fmt.Errorf("%v: %v < details: (%v) >", errorPrefix, err, errBuf.String())
+		return "", fmt.Errorf("%v: %w", errorPrefix, err)
+	}
+	return out, nil
+}
+
+// streamCommandOutput makes stdout and stderr of cmd also written line by line to logger of ctx as they come
+// (with level of CommandOutput), returned func writes the rest after cmd exits
+func streamCommandOutput(ctx context.Context, cmd *exec.Cmd, commandName string) func() {
+	logger := LoggerFromContext(ctx)
+	if logger == nil {
+		return func() {}
+	}
+	level := Tiif(CommandOutput == CommandOutputDebug, DebugLevel, InfoLevel).(LogLevel)
+	stdout := &lineWriter{logger: logger, level: level, prefix: commandName}
+	stderr := &lineWriter{logger: logger, level: level, prefix: commandName}
+	cmd.Stdout = io.MultiWriter(cmd.Stdout, stdout)
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, stderr)
+	return func() {
+		stdout.Flush()
+		stderr.Flush()
 	}
-	return outBuf.String(), nil
 }
 
 func ReplaceEnvs(content string) (string, error) {
@@ -197,6 +176,9 @@ func ReplaceEnvs(content string) (string, error) {
 	for _, match := range matches {
 		replacedText := match[0]
 		replacingText := GetEnvVar(match[1], "")
+		if secretNamePattern.MatchString(match[1]) {
+			AddSecrets(replacingText)
+		}
 		contentString = strings.ReplaceAll(contentString, replacedText, replacingText)
 	}
 	return contentString, nil
@@ -1,7 +1,9 @@
 package cdddru
 
 import (
-	"os"
+	"context"
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -10,17 +12,24 @@ func TestRunExternalCmd(t *testing.T) {
 	errorPrefix := "test error prefix:"
 	commandName := "kubectl"
 	commandArgs := []string{"get", "nodes"}
-	os.Setenv("KUBECONFIG", "/run/configs/kubeconfig/config")
-	output, err := RunExternalCmd(stdinString, errorPrefix, commandName, commandArgs...)
+	executor := NewFakeExecutor().OnOutput("kubectl get nodes", "node-1   Ready\n")
+	ctx := ContextWithExecutor(context.Background(), executor)
+	output, err := RunExternalCmdContext(ctx, stdinString, errorPrefix, commandName, commandArgs...)
 
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
+	expectedOutput := "node-1   Ready\n"
+	if output != expectedOutput {
+		t.Errorf("Expected output %v, got %v", expectedOutput, output)
+	}
+	if calls := executor.CommandLines("kubectl"); len(calls) != 1 || calls[0] != "kubectl get nodes" {
+		t.Errorf("Expected kubectl to be run once, got %v", calls)
+	}
 
-	t.Log(output)
-
-	// expectedOutput := "arg1 arg2\n"
-	// if output != expectedOutput {
-	// 	t.Errorf("Expected output %v, got %v", expectedOutput, output)
-	// }
+	executor.OnError("kubectl get nodes", &CommandError{Kind: ErrCommandExit, Command: commandName, Err: errors.New("exit status 1")})
+	_, err = RunExternalCmdContext(ctx, stdinString, errorPrefix, commandName, commandArgs...)
+	if !errors.Is(err, ErrCommandExit) || !strings.HasPrefix(err.Error(), errorPrefix) {
+		t.Errorf("Expected prefixed command error, got %v", err)
+	}
 }
@@ -1,6 +1,7 @@
 package cdddru
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"os"
@@ -13,6 +14,9 @@ import (
 	// memory "github.com/go-git/go-git/v5/storage/memory"
 )
 
+// checkCycles is how many times job checks for new releases before it completes, replaced in tests
+var checkCycles = math.MaxInt
+
 func RunOneJob(config *Config, wg *sync.WaitGroup) {
 	var err error
 	var originalSHA, currentSHA string
@@ -20,13 +24,47 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 	logLevel := Tiif(bool(FbVerbose), DebugLevel, InfoLevel).(LogLevel)
 	logger := NewLogger(os.Stdout, os.Stderr, logLevel, config.COMMON.JOB_NAME)
 	config.logger = logger
+	logger.SetExecutor(config.executor)
+	metrics := GetJobMetrics(config.COMMON.JOB_NAME)
+	metrics.SetActive(config.COMMON.IS_ACTIVE)
+	status := GetJobStatus(config.COMMON.JOB_NAME)
+	status.SetConfig(config)
+	RegisterJobTrigger(config)
+	// release being upgraded - if job leaves while it is set the release has failed
+	var pendingRelease *ReleaseData
+	// data of release notifications, job_crashed notification gets the last one
+	notice := NotifyData{Job: config.COMMON.JOB_NAME}
+	// job is restarted with changed config - its status is kept by new run
+	isRestarting := false
+	// traces of check cycle and release being run, they are exported when job leaves in the middle of them
+	var cycleSpan, releaseSpan *Span
 	defer func() {
+		v := recover()
+		if v != nil {
+			releaseSpan.SetError(fmt.Errorf("%v", v))
+			cycleSpan.SetError(fmt.Errorf("%v", v))
+		}
+		releaseSpan.End()
+		cycleSpan.End()
+		defer logger.CloseReleaseLog()
+		if !isRestarting && config.COMMON.IS_ACTIVE {
+			status.SetState(JobStateStopped)
+		}
+		if pendingRelease != nil {
+			reason := Tiif(v != nil, v, fmt.Sprintf("release %s is not completed", pendingRelease.Release))
+			config.HOOKS.RunFailureHooks(*pendingRelease, reason, logger)
+		}
+		if v != nil {
+			notice.Error = Redact(fmt.Sprint(v))
+			config.NOTIFY.Notify(NotifyJobCrashed, notice, logger)
+		}
 		wg.Done()
-		if v := recover(); v != nil {
+		if v != nil {
 			PrintFatal(logger, "job '%v' completes with fatal error: %v", config.COMMON.JOB_NAME, v)
 		}
 	}()
 	if !config.COMMON.IS_ACTIVE {
+		status.SetState(JobStateSuspended)
 		PrintInfo(logger, "job %s is not active", config.COMMON.JOB_NAME)
 		return
 	}
@@ -35,7 +73,7 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 		CheckIfErrorFmt(logger, err, fmt.Errorf("calculate SHA256 error: %w", err), true)
 	}
 
-	logger.Debug(fmt.Sprint(PrettyJsonEncodeToString(config)))
+	logger.Debug(fmt.Sprint(config.RedactedJson()))
 
 	// we trying read saved file with tag applyed if it is not exists we try to detect image version from kubectl
 	pathToStoreStartTag := config.GIT.GIT_START_TAG_FILE
@@ -52,7 +90,7 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 	rawStartImageTag, err := os.ReadFile(pathToStoreStartTag)
 	CheckIfError(logger, err, false)
 
-	if config.DEPLOY.DO_MANIFEST_DEPLOY {
+	if config.HasPipelineStep(PipelineStepDeploy) || config.HasPipelineStep(PipelineStepJob) {
 		// make some auth checks ...
 		// if we set path to file? containing kubeconfig in job file (Deploy-->kubeconfig)
 		// then we use it as our config
@@ -65,10 +103,13 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 				if len(os.Getenv("KUBE_CONFIG")) == 0 {
 					CheckIfError(logger, fmt.Errorf("env variable KUBECONFIG not sets. Job %s failed", config.COMMON.JOB_NAME), true)
 				}
+				AddSecrets(os.Getenv("KUBE_CONFIG"))
 				err := os.WriteFile("/run/configs/kubeconfig", []byte(os.Getenv("KUBE_CONFIG")), 0400)
 				CheckIfError(logger, fmt.Errorf("error write kubeconfig file: %w", err), true)
 			}
 		}
+	}
+	if config.HasPipelineStep(PipelineStepDeploy) {
 		// Here we get from cluster tag version it is currently running
 		currentClusterImageTag, errK8s = GetImageTag(config)
 		CheckIfError(logger, errK8s, false)
@@ -118,15 +159,17 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 
 	// do init open or clone git repo if we set it in job config
 	if config.GIT.DO_GIT_CLONE {
-		gitRepository, gitWorkTree, err = config.GIT.OpenOrCloneRepo(url, logger)
+		CheckIfError(logger, config.GIT.Validate(), true)
+		gitRepository, gitWorkTree, err = config.GIT.OpenOrRecloneRepo(url, logger)
 		if err != nil {
 			CheckIfError(logger, fmt.Errorf("opening or cloning repo %s failed: %s", url, err.Error()), true)
 		}
 
-		err = gitWorkTree.Checkout(&git.CheckoutOptions{
-			Branch: plumbing.ReferenceName(config.GIT.branchName),
-			Force:  true,
-		})
+		if dirs := config.GIT.SparseCheckoutDirs(); len(dirs) > 0 {
+			PrintInfo(logger, "sparse checkout of directories: %v", dirs)
+		}
+
+		err = gitWorkTree.Checkout(config.GIT.CheckoutBranchOptions())
 		if err != nil {
 			CheckIfError(logger, fmt.Errorf("failed checkout %s branch: %v", config.GIT.GIT_BRANCH, err), true)
 		}
@@ -140,6 +183,9 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 
 	// starting loop here
 	gitCurrentTag := startImageTag
+	metrics.SetDeployedTag(gitCurrentTag)
+	status.SetCurrentTag(gitCurrentTag)
+	status.SetState(JobStateWaiting)
 	PrintInfo(logger, "start checking for updates => start git tag version: %s", gitCurrentTag)
 
 	// cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -149,34 +195,63 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 	retryApply := 0
 	strMaxTag := ""
 	nMaxTag := int64(0)
-	nCount := Tiif(FbOnce, 1, math.MaxInt).(int)
+	nCount := Tiif(FbOnce, 1, checkCycles).(int)
 
 	// if we do git clone and pull to check for app versions
 	if config.GIT.DO_GIT_CLONE {
 		for i := 0; i < nCount; i++ {
+			metrics.Checked()
+			cycleSpan = StartTrace("check "+config.COMMON.JOB_NAME, logger)
+			cycleSpan.SetAttribute("cdddru.job", config.COMMON.JOB_NAME)
+			cycleSpan.SetAttribute("cdddru.current_tag", gitCurrentTag)
+			logger.SetSpan(cycleSpan)
 			currentTagsCommitHash, _ := GetCommitHashByTag(gitRepository, gitCurrentTag)
-			// checkout to branch given in config
-			err = gitWorkTree.Checkout(&git.CheckoutOptions{
-				Branch: plumbing.ReferenceName(config.GIT.branchName),
-				Force:  true,
-			})
-			if e := CheckIfErrorFmt(logger, err, fmt.Errorf("failed checkout %s branch: %w", config.GIT.GIT_BRANCH, err), false); e != nil {
-				return
-			}
-
-			// updating git repository
+			// checkout to branch given in config and updating git repository
 			// err = config.GIT.Pull(gitWorkTree, logger)
-			err = config.GIT.CliPull(logger)
-			if e := CheckIfErrorFmt(logger, err, fmt.Errorf("git pull (external) failed: %w", err), false); e != nil {
+			pullStart := time.Now()
+			pullSpan := cycleSpan.StartChild("git pull")
+			logger.SetSpan(pullSpan)
+			err = config.GIT.CheckoutAndPull(gitWorkTree, logger)
+			if errors.Is(err, ErrGitRepoBroken) {
+				// local clone can not be fixed in place - start from scratch
+				gitRepository, gitWorkTree, err = config.GIT.RecloneRepo(url, err, logger)
+				if err == nil {
+					err = config.GIT.CheckoutAndPull(gitWorkTree, logger)
+				}
+			}
+			metrics.ObserveStep(MetricsStepPull, time.Since(pullStart))
+			logger.SetSpan(cycleSpan)
+			pullSpan.SetError(err)
+			pullSpan.End()
+			if err != nil {
+				metrics.GitFetchError()
+			}
+			if e := CheckIfErrorFmt(logger, err, fmt.Errorf("updating local repo failed: %w", err), false); e != nil {
 				return
 			}
 
-			// getting all tags from repository after updating
-			repoTags, err := GetTagsFromGitRepo(gitRepository, config.GIT.GIT_TAG_PREFIX)
+			// getting all tags from repository after updating (or from remote if we fetch only selected tag)
+			var repoTags []string
+			if config.GIT.GIT_FETCH_SELECTED_TAG_ONLY {
+				repoTags, err = config.GIT.CliListRemoteTags(logger)
+				if err != nil {
+					metrics.GitFetchError()
+				}
+			} else {
+				repoTags, err = GetTagsFromGitRepo(gitRepository, config.GIT.GIT_TAG_PREFIX)
+			}
 			if e := CheckIfErrorFmt(logger, err, fmt.Errorf("get tags frm git failed: %w", err), false); e != nil {
 				return
 			}
 
+			// ignore tags placed on other branches if we say it in config
+			if config.GIT.GIT_TAGS_FROM_BRANCH_ONLY {
+				repoTags, err = FilterTagsReachableFromBranch(gitRepository, repoTags, config.GIT.branch)
+				if e := CheckIfErrorFmt(logger, err, fmt.Errorf("filter tags reachable from branch %s failed: %w", config.GIT.GIT_BRANCH, err), false); e != nil {
+					return
+				}
+			}
+
 			// getting max tag with specified tag prefix in updated repo to apply
 			nMaxTagCandidate, strMaxTagCandidate, err := GetMaxTag(repoTags, config.GIT.GIT_MAX_TAG, config.GIT.GIT_TAG_PREFIX)
 			if e := CheckIfErrorFmt(logger, err, fmt.Errorf("getting max tag failed: %w", err), false); e != nil {
@@ -187,6 +262,8 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 				retryApply = 0
 			}
 			nMaxTag, strMaxTag = nMaxTagCandidate, strMaxTagCandidate
+			status.Checked(strMaxTag)
+			cycleSpan.SetAttribute("cdddru.max_tag", strMaxTag)
 
 			// flag to upgrade or not
 			bDoUpgrade := false
@@ -194,14 +271,24 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 			curTag, err := ConvertTagToNumeric(gitCurrentTag, config.GIT.GIT_TAG_PREFIX)
 			CheckIfErrorFmt(logger, err, fmt.Errorf("convert tag to numeric failed: %w", err), false)
 
+			// only selected tag is fetched - and refetched every time to catch it moved to new commit
+			if config.GIT.GIT_FETCH_SELECTED_TAG_ONLY {
+				err = config.GIT.CliFetchTag(strMaxTag, logger)
+				if err != nil {
+					metrics.GitFetchError()
+				}
+				CheckIfErrorFmt(logger, err, fmt.Errorf("fetching tag %s failed: %w", strMaxTag, err), false)
+			}
+
 			strMaxTagCommitHash, err := GetCommitHashByTag(gitRepository, strMaxTag)
 			CheckIfErrorFmt(logger, err, fmt.Errorf("getting commit hash failed: %w", err), false)
 
 			if nMaxTag > curTag {
 				bDoUpgrade = true
 			}
+			// same tag moved to new commit - but only if we know where it pointed before
 			if strMaxTag == gitCurrentTag {
-				bDoUpgrade = strMaxTagCommitHash != currentTagsCommitHash
+				bDoUpgrade = IsStringNotEmpty(currentTagsCommitHash) && strMaxTagCommitHash != currentTagsCommitHash
 			}
 
 			PrintDebug(logger, "\nstrMaxTag: %s, strMaxTagCommitHash: %s,	gitCurrentTag: %s, currentTagsCommitHash: %s, bDoUpgrade: %v", strMaxTag, strMaxTagCommitHash,
@@ -212,158 +299,140 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 			if bDoUpgrade {
 				PrintInfo(logger, "starting upgrade for %s release (commit hash: %s)", strMaxTag, strMaxTagCommitHash)
 
+				// final docker image name with tag and data for manifest templates, checks and hooks
+				imageNameTag := fmt.Sprintf("%s:%s", config.DOCKER.DOCKER_IMAGE, strMaxTag)
+				releaseData := ReleaseData{Release: strMaxTag, Image: imageNameTag, PgSecrets: "/root/.config/pg"}
+				pendingRelease = &releaseData
+				if retryApply == 0 {
+					// pending release applied again is the same attempt
+					metrics.ReleaseAttempted()
+				}
+				status.SetState(JobStateUpgrading)
+				runRecord := RunRecord{Release: strMaxTag, Started: time.Now()}
+				notice = NotifyData{Job: config.COMMON.JOB_NAME, Release: strMaxTag, Image: imageNameTag, Commit: strMaxTagCommitHash}
+				notice.CommitMessage, notice.Author, err = GetCommitInfo(gitRepository, strMaxTagCommitHash)
+				CheckIfErrorFmt(logger, err, fmt.Errorf("getting commit of tag %s failed: %w", strMaxTag, err), false)
+				config.NOTIFY.Notify(NotifyReleaseStarted, notice, logger)
+				// every failure of started release is counted, recorded and notified, on_failure hooks are run
+				// when job leaves with pending release
+				releaseFailed := func(event string, err error) {
+					if runRecord.Finished.IsZero() {
+						runRecord.Finished = time.Now()
+					}
+					if err != nil && IsStringEmpty(runRecord.Error) {
+						runRecord.Error = Redact(err.Error())
+					}
+					runRecord.Outcome = RunOutcomeFailed
+					metrics.ReleaseFailed()
+					status.AddRun(runRecord)
+					notice.Summary, notice.Error = runRecord.Summary, runRecord.Error
+					notice.Duration = runRecord.Finished.Sub(runRecord.Started).Round(time.Second).String()
+					config.NOTIFY.Notify(event, notice, logger)
+				}
+				releaseSpan = cycleSpan.StartChild("release " + strMaxTag)
+				releaseSpan.SetAttribute("cdddru.release", strMaxTag)
+				releaseSpan.SetAttribute("cdddru.commit", strMaxTagCommitHash)
+				logger.SetSpan(releaseSpan)
+				logger.SetRelease(strMaxTag, strMaxTagCommitHash)
+				if IsStringNotEmpty(ReleaseLogsFolder) {
+					releaseLogDir := ReleaseLogDir(config.COMMON.JOB_NAME, strMaxTag)
+					err = logger.OpenReleaseLog(releaseLogDir)
+					if e := CheckIfErrorFmt(logger, err, fmt.Errorf("opening release log failed: %w", err), false); e == nil {
+						PrintInfo(logger, "logs of release %s are archived to %s", strMaxTag, releaseLogDir)
+						err = config.COMMON.CleanupReleaseLogs(releaseLogDir, logger)
+						CheckIfErrorFmt(logger, err, fmt.Errorf("cleanup of old release logs failed: %w", err), false)
+					}
+				}
+
 				// checkout to true tag
 				tagRefName := plumbing.ReferenceName(fmt.Sprintf("refs/tags/%s", strMaxTag))
 				refTag, err := gitRepository.ResolveRevision(plumbing.Revision(tagRefName))
 				if e := CheckIfErrorFmt(logger, err, fmt.Errorf("error get reference for tag: %v", err), false); e != nil {
+					releaseFailed(NotifyReleaseFailed, e)
 					return
 				}
 
-				err = gitWorkTree.Checkout(&git.CheckoutOptions{
-					Hash: *refTag,
-				})
+				err = gitWorkTree.Checkout(config.GIT.CheckoutHashOptions(*refTag))
 				if e := CheckIfErrorFmt(logger, err, fmt.Errorf("error checkout to tag: %v", err), false); e != nil {
+					releaseFailed(NotifyReleaseFailed, e)
 					return
 				}
 				PrintInfo(logger, "successfully checkout to tag %s hash: %v\n", strMaxTag, refTag)
 
-				// final docker image name with tag
-				imageNameTag := fmt.Sprintf("%s:%s", config.DOCKER.DOCKER_IMAGE, strMaxTag)
-
-				// define platforms for building
-				var platforms []string = config.DOCKER.DOCKER_PLATFORMS
-				if len(platforms) == 0 {
-					platforms = DefaultDockerConfig.DOCKER_PLATFORMS
+				err = config.GIT.PrepareCheckedOutRelease(gitWorkTree, logger)
+				if e := CheckIfErrorFmt(logger, err, fmt.Errorf("preparing checked out tag %s failed: %w", strMaxTag, err), false); e != nil {
+					releaseFailed(NotifyReleaseFailed, e)
+					return
 				}
 
-				// if we say in config to do docker build
-				if config.DOCKER.DO_DOCKER_BUILD {
-					config.DOCKER.SetAuth("/run/configs/dockerconfig/")
-
-					PrintInfo(logger, "starting building image %s", imageNameTag)
-
-					// we use buildx to make multy-arch image
-					err = config.DOCKER.DockerImageBuildx(imageNameTag, config.GIT.GIT_LOCAL_FOLDER, platforms, logger)
-					if e := CheckIfErrorFmt(logger, err, fmt.Errorf("building image %s failed: %w", imageNameTag, err), true); e != nil {
-						PrintInfo(logger, "job %s failed and will be closed", config.COMMON.JOB_NAME)
+				// folder with files of the release for build and sync steps
+				releaseFolder := config.GIT.GIT_LOCAL_FOLDER
+				if config.GIT.GIT_RELEASE_EXPORT {
+					releaseFolder, err = config.GIT.ExportRelease(gitRepository, gitWorkTree, strMaxTag, *refTag, logger)
+					if e := CheckIfErrorFmt(logger, err, fmt.Errorf("exporting release %s failed: %w", strMaxTag, err), false); e != nil {
+						releaseFailed(NotifyReleaseFailed, e)
 						return
 					}
-					if !(config.SYNC.DO_SUBFOLDER_SYNC || config.DEPLOY.DO_MANIFEST_DEPLOY) {
-						//  we say that new tag upgraded if no other steps in our pipeline
-						gitCurrentTag = strMaxTag
-						err = os.WriteFile(pathToStoreStartTag, []byte(gitCurrentTag), 0600)
-						CheckIfErrorFmt(logger, err, fmt.Errorf("write to file with start image failed: %w", err), false)
-					}
-					PrintInfo(logger, "successfully build image %s", imageNameTag)
-
-					// building docker image for different platforms
-					// for _, platform := range platforms {
-					// 	PrintInfo(logger, "starting build %s docker image for %s platform", imageNameTag, platform)
-					// 	err = DockerImageBuild(cli, imageNameTag, config.GIT.GIT_LOCAL_FOLDER, config.DOCKER.DOCKER_FILE, platform, logger)
-					// 	if err != nil {
-					// 		newError := fmt.Errorf("failed to build docker image %s for platform %s: %w", imageNameTag, platform, err)
-					// 		CheckIfError(logger, newError, true)
-					// 	}
-
-					// 	PrintInfo(logger, "starting pushing %s docker image for %s platform", imageNameTag, platform)
-					// 	err = DockerImagePush(cli, imageNameTag, platform, config, logger)
-					// 	if err != nil {
-					// 		newError := fmt.Errorf("failed to push docker image %s for platform %s: %w", imageNameTag, platform, err)
-					// 		CheckIfError(logger, newError, true)
-					// 	}
-					// 	PrintInfo(logger, "docker image %s for platform %s builded and pushed successfully", imageNameTag, platform)
-					// }
+					err = config.GIT.CleanupReleaseExports(releaseFolder, logger)
+					CheckIfErrorFmt(logger, err, fmt.Errorf("cleanup of old release exports failed: %w", err), false)
 				}
 
-				// rsync data on target_folder from git_sub_folder if specified
-				if config.SYNC.DO_SUBFOLDER_SYNC {
-					PrintInfo(logger, "start sync %s for tag %s",
-						filepath.Join(config.GIT.GIT_LOCAL_FOLDER, config.SYNC.GIT_SUB_FOLDER), strMaxTag)
-					err = Rsync(config.SYNC.TARGET_FOLDER, filepath.Join(config.GIT.GIT_LOCAL_FOLDER, config.SYNC.GIT_SUB_FOLDER))
-					if e := CheckIfErrorFmt(logger, err, fmt.Errorf("sync %s for tag %s failed: %w",
-						filepath.Join(config.GIT.GIT_LOCAL_FOLDER, config.SYNC.GIT_SUB_FOLDER),
-						strMaxTag, err), true); e != nil {
-
-						PrintInfo(logger, "job %s failed and will be closed", config.COMMON.JOB_NAME)
-						return
-					}
-					PrintInfo(logger, "successfully sync %s for tag %s",
-						filepath.Join(config.GIT.GIT_LOCAL_FOLDER, config.SYNC.GIT_SUB_FOLDER), strMaxTag)
+				// run release pipeline - build, sync, deploy and other steps of the job
+				run := &PipelineRun{Data: releaseData, ReleaseFolder: releaseFolder}
+				err = config.RunPipeline(run, logger)
+				totalWaitSeconds = run.WaitSeconds
+				runRecord.Summary, runRecord.Finished = run.Summary(), time.Now()
+				if err != nil {
+					runRecord.Error = Redact(err.Error())
 				}
-
-				if config.DEPLOY.DO_MANIFEST_DEPLOY {
-					// now it's time to get final manifest for k8s/k3s deployment from given template
-					PrintInfo(logger, "start applying release %s", strMaxTag)
-					os.Chdir(CurrentWD)
-					manifestToApply, err := GenerateManifest(config.DEPLOY.MANIFESTS_K8S,
-						struct {
-							Release   string
-							Image     string
-							PgSecrets string
-						}{
-							Release:   strMaxTag,
-							Image:     imageNameTag,
-							PgSecrets: "/root/.config/pg",
-						})
-					if e := CheckIfError(logger, err, false); e != nil {
-						PrintInfo(logger, "job %s is completed with error and will be closed", config.COMMON.JOB_NAME)
-						return
-					}
-
-					// switch to given context
-					_, err = RunExternalCmd("", fmt.Sprintf("error while switching to context %s", config.DEPLOY.CONTEXT_K8s),
-						"kubectx", config.DEPLOY.CONTEXT_K8s)
-					if e := CheckIfError(logger, err, false); e != nil {
-						PrintInfo(logger, "job %s is completed with error and will be closed", config.COMMON.JOB_NAME)
-						return
-					}
-
-					//  now apply it in given cluster
-					// command := []string{"kubectl", "apply", "-f", "-", "--dry-run=client")}
-					command := []string{"kubectl", "apply", "-f", "-"}
-					outManifestApply, err := RunExternalCmd(manifestToApply, "error while applying manifest", command[0], command[1:]...)
-					if e := CheckIfError(logger, err, false); e != nil {
-						PrintInfo(logger, "job %s is completed with error and will be closed", config.COMMON.JOB_NAME)
-						return
-					}
-
-					// waiting some time for changes take effect
-					checkIntervals := GetIntervals(config.COMMON.CHECK_INTERVAL)
-					isReady := false
+				notice.Summary, notice.Error = runRecord.Summary, runRecord.Error
+				releaseSpan.SetAttribute("cdddru.pipeline.status", run.Status())
+				releaseSpan.SetError(err)
+				releaseSpan.End()
+				logger.SetSpan(cycleSpan)
+				notice.Duration = runRecord.Finished.Sub(runRecord.Started).Round(time.Second).String()
+				switch {
+				case err == nil:
+					//  we say that new tag upgraded only if all steps of pipeline succeeded
+					gitCurrentTag = strMaxTag
+					err = os.WriteFile(pathToStoreStartTag, []byte(gitCurrentTag), 0600)
+					CheckIfErrorFmt(logger, err, fmt.Errorf("write to file with start image failed: %w", err), false)
+					retryApply = 0
+					metrics.ReleaseSucceeded()
+					metrics.SetDeployedTag(gitCurrentTag)
+					runRecord.Outcome = RunOutcomeSucceeded
+					status.SetCurrentTag(gitCurrentTag)
+					config.NOTIFY.Notify(NotifyReleaseSucceeded, notice, logger)
+					PrintInfo(logger, "release %s completed: %s", strMaxTag, run.Summary())
+				case errors.Is(err, ErrReleaseNotApplied):
+					// release is applied again on next iteration
 					retryApply += 1
-					for i := 0; i < 5; i++ {
-						intervalToWaitSeconds := checkIntervals[i]
-						time.Sleep(time.Duration(intervalToWaitSeconds) * time.Second)
-						totalWaitSeconds += intervalToWaitSeconds
-						// now check readiness
-						isReady, _ = GetDeploymentReadinessStatus(config, imageNameTag)
-						if isReady {
-							break
-						}
-						PrintInfo(logger, "kubernetes manifests are not apllying yet for release %s", imageNameTag)
-					}
-
-					if isReady {
-						currentClusterImageTag, errK8s = GetImageTag(config)
-						CheckIfError(logger, errK8s, true)
-
-						if currentClusterImageTag == strMaxTag {
-							PrintInfo(logger, "release %s applyed successfully \n%v", strMaxTag, outManifestApply)
-							gitCurrentTag = strMaxTag
-							err = os.WriteFile(pathToStoreStartTag, []byte(gitCurrentTag), 0755)
-							CheckIfError(logger, err, false)
-							retryApply = 0
-						} else {
-							PrintInfo(logger, "release %s DO NOT applyed successfully", strMaxTag)
-							PrintInfo(logger, "starting attempt number %v to apply release %s", retryApply+1, strMaxTag)
-						}
-					}
-
+					PrintInfo(logger, "release %s DO NOT applyed successfully: %s", strMaxTag, run.Summary())
 					if retryApply > 3 {
-						CheckIfError(logger,
-							fmt.Errorf("release %s DO NOT applyed successfully while 3 attempts. exiting", strMaxTag), true)
+						err = fmt.Errorf("release %s DO NOT applyed successfully while 3 attempts. exiting", strMaxTag)
+						runRecord.Error = Redact(err.Error())
+						releaseFailed(NotifyReleaseFailed, err)
+						CheckIfError(logger, err, true)
 					}
-				} // end do manifest apply
+					runRecord.Outcome = RunOutcomePending
+					status.AddRun(runRecord)
+					PrintInfo(logger, "starting attempt number %v to apply release %s", retryApply+1, strMaxTag)
+				default:
+					// on_failure hooks are already run by pipeline
+					pendingRelease = nil
+					// aborted canary is removed and stable deployment keeps serving previous release
+					releaseFailed(Tiif(errors.Is(err, ErrCanaryAborted), NotifyReleaseRolledBack, NotifyReleaseFailed).(string), err)
+					PrintError(logger, "release %s failed: %s", strMaxTag, run.Summary())
+					PrintInfo(logger, "job %s failed and will be closed", config.COMMON.JOB_NAME)
+					return
+				}
+				if runRecord.Outcome == RunOutcomeSucceeded {
+					status.AddRun(runRecord)
+				}
+				status.SetState(JobStateWaiting)
+				pendingRelease = nil
+				logger.CloseReleaseLog()
+				logger.SetRelease("", "")
 			} // end do upgrade
 			if !FbOnce {
 				currentSHA, err = CalculateSHA256(config.COMMON.JOB_PATH)
@@ -384,15 +453,19 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 								return
 							}
 						}
+						newConfig.executor = config.executor
 						config = newConfig
 						// suspend job if now it is not active in job's config file
 						if !config.COMMON.IS_ACTIVE {
+							metrics.SetActive(false)
+							status.SetState(JobStateSuspended)
 							PrintInfo(logger, "job %s is not active - suspend for resume ...", config.COMMON.JOB_NAME)
 							time.Sleep(time.Duration(config.COMMON.CHECK_INTERVAL) * time.Second)
 							continue
 						}
 						break
 					}
+					isRestarting = true
 					wg.Add(1)
 					go RunOneJob(config, wg)
 					PrintInfo(logger, "job %s now restarting", config.COMMON.JOB_NAME)
@@ -400,7 +473,13 @@ func RunOneJob(config *Config, wg *sync.WaitGroup) {
 
 				}
 
-				time.Sleep(time.Duration(config.COMMON.CHECK_INTERVAL-totalWaitSeconds) * time.Second)
+				cycleSpan.End()
+				logger.SetSpan(nil)
+				status.SetNextCheck(time.Now().Add(time.Duration(config.COMMON.CHECK_INTERVAL-totalWaitSeconds) * time.Second))
+				// polling is the fallback - push webhook wakes the job immediately
+				if WaitForNextCheck(config.COMMON.JOB_NAME, time.Duration(config.COMMON.CHECK_INTERVAL-totalWaitSeconds)*time.Second) {
+					PrintInfo(logger, "job %s is woken up by webhook", config.COMMON.JOB_NAME)
+				}
 			}
 		}
 	}
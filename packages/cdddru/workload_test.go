@@ -0,0 +1,297 @@
+package cdddru
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	plumbing "github.com/go-git/go-git/v5/plumbing"
+)
+
+// fakeCluster answers kubectl commands of deploy step as cluster running one deployment
+type fakeCluster struct {
+	mu       sync.Mutex
+	deployed string
+	ready    bool
+}
+
+func (cluster *fakeCluster) set(deployed string, ready bool) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.deployed, cluster.ready = deployed, ready
+}
+
+func (cluster *fakeCluster) script(executor *FakeExecutor) {
+	executor.OnOutput("kubectx", "")
+	// release is rolled out only if cluster is ready
+	executor.On("kubectl apply", func(ctx context.Context, c Command) (string, error) {
+		cluster.mu.Lock()
+		defer cluster.mu.Unlock()
+		if match := regexp.MustCompile(`image: repo/app:(\S+)`).FindStringSubmatch(c.Stdin); match != nil && cluster.ready {
+			cluster.deployed = match[1]
+		}
+		return "deployment.apps/app configured\n", nil
+	})
+	executor.On("kubectl get deployment app -n default", func(ctx context.Context, c Command) (string, error) {
+		cluster.mu.Lock()
+		defer cluster.mu.Unlock()
+		return fmt.Sprintf(`[{"name":"app","image":"repo/app:%s"}]`, cluster.deployed), nil
+	})
+	executor.On("kubectx test | kubectl get deployment app", func(ctx context.Context, c Command) (string, error) {
+		cluster.mu.Lock()
+		defer cluster.mu.Unlock()
+		return Tiif(cluster.ready, "1/1\n", "0/1\n").(string), nil
+	})
+}
+
+// tagTestCommit commits new file to repository and places (or moves) tag on the commit
+func tagTestCommit(t *testing.T, repoPath string, repo *git.Repository, tag string) plumbing.Hash {
+	t.Helper()
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := commitTestFile(t, repoPath, wt, strings.ReplaceAll(tag, ".", "_")+"-"+randomHex(4)+".txt", tag)
+	repo.DeleteTag(tag)
+	if _, err = repo.CreateTag(tag, hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// jobTest is job deploying tags of local remote repository to fake cluster
+type jobTest struct {
+	folder     string
+	remotePath string
+	remoteRepo *git.Repository
+	config     *Config
+	executor   *FakeExecutor
+	cluster    *fakeCluster
+	status     *JobStatus
+}
+
+// newJobTest makes job with remote repository tagged v1.0.0 and v1.0.1, cluster runs v1.0.0
+func newJobTest(t *testing.T, jobName string) *jobTest {
+	folder := t.TempDir()
+	releaseLogsFolder := ReleaseLogsFolder
+	ReleaseLogsFolder = filepath.Join(folder, "release-logs")
+	deploySleep = func(context.Context, time.Duration) error { return nil }
+	t.Cleanup(func() { ReleaseLogsFolder, deploySleep, checkCycles = releaseLogsFolder, sleepContext, math.MaxInt })
+
+	remotePath := filepath.Join(folder, "remote")
+	remoteRepo, err := git.PlainInit(remotePath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagTestCommit(t, remotePath, remoteRepo, "v1.0.0")
+	tagTestCommit(t, remotePath, remoteRepo, "v1.0.1")
+	head, err := remoteRepo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobPath, manifestPath := filepath.Join(folder, "job.yaml"), filepath.Join(folder, "deployment.yaml")
+	os.WriteFile(jobPath, []byte("job"), 0644)
+	os.WriteFile(manifestPath, []byte("image: repo/app:{{.Release}}\n"), 0644)
+	config := &Config{}
+	config.COMMON.JOB_NAME = jobName
+	config.COMMON.JOB_PATH = jobPath
+	config.COMMON.IS_ACTIVE = true
+	config.GIT.DO_GIT_CLONE = true
+	config.GIT.GIT_REPO_URL = "file://" + remotePath
+	config.GIT.GIT_LOCAL_FOLDER = filepath.Join(folder, "clone")
+	config.GIT.GIT_BRANCH = head.Name().Short()
+	config.GIT.GIT_TAG_PREFIX = "v"
+	config.GIT.GIT_MAX_TAG = "v9.9.9"
+	config.GIT.GIT_START_TAG_FILE = filepath.Join(folder, "start-tag")
+	config.DOCKER.DOCKER_IMAGE = "repo/app"
+	config.DEPLOY.CONTEXT_K8s = "test"
+	config.DEPLOY.DEPLOYMENT_NAME_K8s = "app"
+	config.DEPLOY.NAMESPACE_K8s = "default"
+	config.DEPLOY.MANIFESTS_K8S = manifestPath
+	config.STEPS = []PipelineStep{{TYPE: PipelineStepDeploy}}
+	config.SetParentLinks()
+
+	executor := NewFakeExecutor().Passthrough("git")
+	cluster := &fakeCluster{deployed: "v1.0.0", ready: true}
+	cluster.script(executor)
+	config.SetExecutor(executor)
+	return &jobTest{folder: folder, remotePath: remotePath, remoteRepo: remoteRepo, config: config,
+		executor: executor, cluster: cluster, status: GetJobStatus(jobName)}
+}
+
+// run runs job for given number of check cycles
+func (jt *jobTest) run(cycles int) {
+	checkCycles = cycles
+	var wg sync.WaitGroup
+	wg.Add(1)
+	RunOneJob(jt.config, &wg)
+	wg.Wait()
+}
+
+// applied lists releases applied to cluster
+func (jt *jobTest) applied() []string {
+	releases := make([]string, 0)
+	for _, c := range jt.executor.Calls() {
+		if strings.HasPrefix(c.String(), "kubectl apply") {
+			releases = append(releases, strings.TrimSpace(strings.TrimPrefix(c.Stdin, "image: repo/app:")))
+		}
+	}
+	return releases
+}
+
+func (jt *jobTest) lastRun() RunRecord {
+	jt.status.mu.Lock()
+	defer jt.status.mu.Unlock()
+	if len(jt.status.History) == 0 {
+		return RunRecord{}
+	}
+	return jt.status.History[len(jt.status.History)-1]
+}
+
+// checkReleaseCounters checks that every attempted release of job is counted as succeeded or failed
+func checkReleaseCounters(t *testing.T, jobName string, attempted, succeeded, failed uint64) {
+	t.Helper()
+	m := GetJobMetrics(jobName)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.releasesAttempted != attempted || m.releasesSucceeded != succeeded || m.releasesFailed != failed {
+		t.Errorf("expected %d attempted = %d succeeded + %d failed releases, got %d = %d + %d", attempted, succeeded, failed,
+			m.releasesAttempted, m.releasesSucceeded, m.releasesFailed)
+	}
+}
+
+func TestRunOneJobDecisions(t *testing.T) {
+	jt := newJobTest(t, "decisions-site")
+	config, executor, cluster, status := jt.config, jt.executor, jt.cluster, jt.status
+	runJob, applied, lastRun := jt.run, jt.applied, jt.lastRun
+	// cluster runs v1.0.0 - the newest tag is released
+	runJob(1)
+	if releases := applied(); len(releases) != 1 || releases[0] != "v1.0.1" {
+		t.Fatalf("expected v1.0.1 to be applied, got %v", releases)
+	}
+	if startTag, _ := os.ReadFile(config.GIT.GIT_START_TAG_FILE + ".decisions-site"); string(startTag) != "v1.0.1" {
+		t.Errorf("expected released tag to be stored, got %q", startTag)
+	}
+	if run := lastRun(); run.Release != "v1.0.1" || run.Outcome != RunOutcomeSucceeded {
+		t.Errorf("unexpected run %+v", run)
+	}
+	if pulls := executor.CommandLines("git -C " + config.GIT.GIT_LOCAL_FOLDER + " pull"); len(pulls) != 1 {
+		t.Errorf("expected one pull, got %v", pulls)
+	}
+
+	// nothing new - nothing is applied
+	runJob(1)
+	if releases := applied(); len(releases) != 1 {
+		t.Fatalf("expected no release without new tag, got %v", releases)
+	}
+
+	// the same tag is moved to new commit - it is released again
+	tagTestCommit(t, jt.remotePath, jt.remoteRepo, "v1.0.1")
+	runJob(1)
+	if releases := applied(); len(releases) != 2 || releases[1] != "v1.0.1" {
+		t.Fatalf("expected moved v1.0.1 to be applied again, got %v", releases)
+	}
+
+	// cluster does not become ready - release is retried and job gives up after 3 retries
+	tagTestCommit(t, jt.remotePath, jt.remoteRepo, "v1.0.2")
+	cluster.set("v1.0.1", false)
+	runJob(10)
+	if releases := applied(); len(releases) != 6 || releases[2] != "v1.0.2" || releases[5] != "v1.0.2" {
+		t.Fatalf("expected v1.0.2 to be applied 4 times, got %v", releases)
+	}
+	if run := lastRun(); run.Release != "v1.0.2" || run.Outcome != RunOutcomeFailed {
+		t.Errorf("unexpected run %+v", run)
+	}
+	checkReleaseCounters(t, config.COMMON.JOB_NAME, 3, 2, 1)
+
+	// max tag is lowered below running release - job goes down to the newest allowed tag
+	cluster.set("v1.0.1", true)
+	config.GIT.GIT_MAX_TAG = "v1.0.0"
+	runJob(1)
+	if releases := applied(); len(releases) != 7 || releases[6] != "v1.0.0" {
+		t.Fatalf("expected downgrade to v1.0.0, got %v", releases)
+	}
+	if cluster.deployed != "v1.0.0" || status.CurrentTag != "v1.0.0" {
+		t.Errorf("expected cluster and status to be at v1.0.0, got %s and %s", cluster.deployed, status.CurrentTag)
+	}
+}
+
+func TestRunOneJobFailedCheckout(t *testing.T) {
+	jt := newJobTest(t, "failed-checkout-site")
+	var mu sync.Mutex
+	events := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		events = append(events, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+	jt.config.NOTIFY.SINKS = []NotifySink{{TYPE: NotifySinkWebhook, URL: server.URL, MESSAGE: "{{.Event}}"}}
+	jt.config.SetParentLinks()
+	jt.run(1)
+	if releases := jt.applied(); len(releases) != 1 {
+		t.Fatalf("expected v1.0.1 to be applied, got %v", releases)
+	}
+
+	// tree of the next tag is lost after pull - checkout of the tag fails
+	commit, err := jt.remoteRepo.CommitObject(tagTestCommit(t, jt.remotePath, jt.remoteRepo, "v1.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := commit.TreeHash.String()
+	jt.executor.On("git -C "+jt.config.GIT.GIT_LOCAL_FOLDER+" pull", func(ctx context.Context, c Command) (string, error) {
+		out, err := OSExecutor{}.Run(ctx, c)
+		os.Remove(filepath.Join(jt.config.GIT.GIT_LOCAL_FOLDER, ".git", "objects", tree[:2], tree[2:]))
+		return out, err
+	})
+	jt.run(1)
+	if releases := jt.applied(); len(releases) != 1 {
+		t.Fatalf("expected nothing to be applied after failed checkout, got %v", releases)
+	}
+	if run := jt.lastRun(); run.Release != "v1.0.2" || run.Outcome != RunOutcomeFailed || !strings.Contains(run.Error, "checkout") {
+		t.Errorf("expected failed run of v1.0.2, got %+v", run)
+	}
+	checkReleaseCounters(t, jt.config.COMMON.JOB_NAME, 2, 1, 1)
+	mu.Lock()
+	defer mu.Unlock()
+	if last := events[len(events)-1]; !strings.Contains(last, `"message":"release_failed"`) {
+		t.Errorf("expected release_failed to be notified, got %v", events)
+	}
+}
+
+func TestRunOneJobFailedAfterDeployCheck(t *testing.T) {
+	jt := newJobTest(t, "verify-failed-site")
+	verifySleep = func(context.Context, time.Duration) error { return nil }
+	defer func() { verifySleep = sleepContext }()
+	jt.config.VERIFY.AFTER_DEPLOY = []VerifyCheck{{NAME: "smoke", TYPE: VerifyCheckCommand, COMMAND: []string{"smoke-test"}, RETRIES: 2}}
+	jt.config.HOOKS.ON_FAILURE = []Hook{{COMMAND: []string{"report-failure", "{{.Release}}"}}}
+	jt.config.SetParentLinks()
+	jt.executor.OnError("smoke-test", &CommandError{Kind: ErrCommandExit, Command: "smoke-test", ExitCode: 1, Err: ErrCommandExit})
+	jt.executor.OnOutput("report-failure", "")
+
+	// failed check fails the release instead of leaving it pending
+	jt.run(3)
+	if releases := jt.applied(); len(releases) != 1 || releases[0] != "v1.0.1" {
+		t.Fatalf("expected v1.0.1 to be applied once, got %v", releases)
+	}
+	if run := jt.lastRun(); run.Release != "v1.0.1" || run.Outcome != RunOutcomeFailed || !strings.Contains(run.Error, "smoke") {
+		t.Errorf("expected failed run, got %+v", run)
+	}
+	if hooks := jt.executor.CommandLines("report-failure"); len(hooks) != 1 || hooks[0] != "report-failure v1.0.1" {
+		t.Errorf("expected failure hook to run once, got %v", hooks)
+	}
+	checkReleaseCounters(t, jt.config.COMMON.JOB_NAME, 1, 0, 1)
+}